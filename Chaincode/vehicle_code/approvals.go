@@ -0,0 +1,424 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Approval indexes - Approval policies are stored under \x00approval_policy\x00<function> and proposals under
+//						\x00proposal\x00<chocoID>\x00<number>, zero padded so they range over in order.
+//==============================================================================================================================
+const   INDEX_APPROVAL_POLICY		= "approval_policy"
+const   INDEX_PROPOSAL				= "proposal"
+
+//==============================================================================================================================
+//	 Proposal lifetime - Proposals expire DEFAULT_PROPOSAL_TTL hours after they are made unless the policy sets another
+//						 lifetime, of at most MAX_PROPOSAL_TTL hours.
+//==============================================================================================================================
+const   DEFAULT_PROPOSAL_TTL		= 72
+const   MAX_PROPOSAL_TTL			= 720
+
+const   PROPOSAL_PENDING			= "pending"
+const   PROPOSAL_EXECUTED			= "executed"
+const   PROPOSAL_WITHDRAWN			= "withdrawn"
+const   PROPOSAL_EXPIRED			= "expired"
+
+//==============================================================================================================================
+//	Approval_Policy - Defines the signatures a transition needs before it is executed. Each signer is one signature, from
+//					  the participant named or from any participant with the role. JSON {"signers": [{"role": "DU_RHONE"},
+//					  {"username": "ibm"}], "ttlHours": 48}
+//==============================================================================================================================
+type Approval_Policy struct {
+	Function		string					`json:"function"`
+	Signers			[]Signer				`json:"signers"`
+	TTLHours		int						`json:"ttlHours"`
+}
+
+type Signer struct {
+	Username		string					`json:"username"`
+	Role			int						`json:"role"`				// 0 when the signer is named by username
+}
+
+//==============================================================================================================================
+//	Proposal - Defines the structure of a proposed transition. The signers are fixed from the policy when the transition is
+//			   proposed and Signatures lists who has signed, against the index of the signer each signature fills.
+//==============================================================================================================================
+type Proposal struct {
+	ChocoID			string					`json:"chocoID"`
+	Number			int						`json:"number"`
+	Function		string					`json:"function"`
+	Proposer		string					`json:"proposer"`
+	ProposerRole	int						`json:"proposerRole"`
+	Recipient		string					`json:"recipient"`
+	Status			string					`json:"status"`
+	DateProposed	string					`json:"dateProposed"`
+	ExpiresAt		string					`json:"expiresAt"`
+	DateResolved	string					`json:"dateResolved"`
+	Signers			[]Signer				`json:"signers"`
+	Signatures		[]Signature				`json:"signatures"`
+}
+
+type Signature struct {
+	Username		string					`json:"username"`
+	Role			int						`json:"role"`
+	Signer			int						`json:"signer"`
+	Timestamp		string					`json:"timestamp"`
+}
+
+//==============================================================================================================================
+//	 parse_approval_policy - Converts the JSON policy passed, with roles given by name or number, into an Approval_Policy.
+//==============================================================================================================================
+func parse_approval_policy(function string, value string) (Approval_Policy, error) {
+
+	var raw struct {
+		Signers		[]struct {
+			Username	string				`json:"username"`
+			Role		json.RawMessage		`json:"role"`
+		}									`json:"signers"`
+		TTLHours	int						`json:"ttlHours"`
+	}
+
+	policy := Approval_Policy{ Function: function, Signers: []Signer{}, TTLHours: DEFAULT_PROPOSAL_TTL }
+
+	err := json.Unmarshal([]byte(value), &raw)
+															if err != nil { return policy, errors.New("Invalid approval policy") }
+															if len(raw.Signers) == 0 || len(raw.Signers) > MAX_LIST_LENGTH { return policy, errors.New("Invalid approval policy: between 1 and " + strconv.Itoa(MAX_LIST_LENGTH) + " signers are required") }
+															if raw.TTLHours < 0 || raw.TTLHours > MAX_PROPOSAL_TTL { return policy, errors.New("Invalid approval policy: ttlHours must be at most " + strconv.Itoa(MAX_PROPOSAL_TTL)) }
+
+	if raw.TTLHours > 0 { policy.TTLHours = raw.TTLHours }
+
+	for _, s := range raw.Signers {
+
+		signer := Signer{ Username: strings.TrimSpace(s.Username) }
+
+		if len(s.Role) > 0 {
+
+			var role_value string
+
+			if err := json.Unmarshal(s.Role, &role_value); err != nil { role_value = string(s.Role) }		// Roles may be passed as a number or a name
+
+			signer.Role, err = parse_role(role_value)
+															if err != nil { return policy, err }
+		}
+
+															if (signer.Username == "") == (signer.Role == 0) { return policy, errors.New("Invalid approval policy: each signer needs either a username or a role") }
+
+		policy.Signers = append(policy.Signers, signer)
+	}
+
+	return policy, nil
+}
+
+//==============================================================================================================================
+//	 find_approval_policy - Returns the approval policy for the transition function named, or false if it needs none.
+//==============================================================================================================================
+func find_approval_policy(stub Stub, function string) (Approval_Policy, bool, error) {
+
+	var policy Approval_Policy
+
+	key, err := create_index_key(INDEX_APPROVAL_POLICY, function)
+															if err != nil { return policy, false, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return policy, false, errors.New("Error retrieving approval policy") }
+															if bytes == nil { return policy, false, nil }
+
+	err = json.Unmarshal(bytes, &policy)
+															if err != nil { return policy, false, errors.New("Corrupt approval policy") }
+
+	return policy, true, nil
+}
+
+//==============================================================================================================================
+//	 set_approval_policy - Sets the signatures needed before the transition named is executed. Passing an empty policy lets
+//						   the transition be invoked directly again. Only the registry administrator can set policies.
+//==============================================================================================================================
+func (t *SimpleChaincode) set_approval_policy(stub Stub, caller string, caller_affiliation int, function string, policy_json string) ([]byte, error) {
+
+															if caller_affiliation != REGISTRY_ADMIN { return nil, errors.New("Permission denied") }
+
+	transition, ok := t.get_transition(function)
+															if !ok { return nil, errors.New("Unknown transition " + function) }
+															if transition.Rework { return nil, errors.New("Rework transitions can't need approval") }		// A proposal has nowhere to carry the reason code
+
+	key, err := create_index_key(INDEX_APPROVAL_POLICY, function)
+															if err != nil { return nil, err }
+
+	if strings.TrimSpace(policy_json) == "" {
+
+		err = stub.DelState(key)
+															if err != nil { return nil, errors.New("Error removing approval policy") }
+		return nil, nil
+	}
+
+	policy, err := parse_approval_policy(function, policy_json)
+															if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(policy)
+															if err != nil { return nil, errors.New("Error converting approval policy") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SET_APPROVAL_POLICY: Error storing approval policy: %s", err); return nil, errors.New("Error storing approval policy") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 get_approval_policies - Returns every approval policy in transition order.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_approval_policies(stub Stub) ([]byte, error) {
+
+	policies := []Approval_Policy{}
+
+	for _, transition := range lifecycle {
+
+		policy, found, err := find_approval_policy(stub, transition.Function)
+															if err != nil { return nil, err }
+
+		if found { policies = append(policies, policy) }
+	}
+
+	return json.Marshal(policies)
+}
+
+//==============================================================================================================================
+//	 retrieve_proposal - Returns the proposal for the chocolates with the number passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_proposal(stub Stub, chocoID string, number int) (Proposal, error) {
+
+	var p Proposal
+
+	key, err := create_index_key(INDEX_PROPOSAL, chocoID, fmt.Sprintf("%04d", number))
+															if err != nil { return p, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return p, errors.New("Error retrieving proposal") }
+															if bytes == nil { return p, errors.New("Proposal " + strconv.Itoa(number) + " not found for " + chocoID) }
+
+	err = json.Unmarshal(bytes, &p)
+															if err != nil { return p, errors.New("Corrupt proposal") }
+
+	return p, nil
+}
+
+//==============================================================================================================================
+//	 save_proposal - Writes the proposal passed to the ledger.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_proposal(stub Stub, p Proposal) error {
+
+	key, err := create_index_key(INDEX_PROPOSAL, p.ChocoID, fmt.Sprintf("%04d", p.Number))
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(p)
+															if err != nil { return errors.New("Error converting proposal") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_PROPOSAL: Error storing proposal: %s", err); return errors.New("Error storing proposal") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 check_expiry - Marks a pending proposal as expired if its lifetime has passed by the time of the current transaction.
+//					Expiry is worked out as proposals are read, so nothing needs to run when a proposal expires.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_expiry(stub Stub, p *Proposal) error {
+
+	if p.Status != PROPOSAL_PENDING { return nil }
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return err }
+
+	expires, err := time.Parse(TIME_FORMAT, p.ExpiresAt)
+															if err != nil { return errors.New("Corrupt proposal expiry") }
+
+	if now.After(expires) { p.Status = PROPOSAL_EXPIRED; p.DateResolved = p.ExpiresAt }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 pending_proposal - Returns the chocolates' latest proposal if it is still pending.
+//==============================================================================================================================
+func (t *SimpleChaincode) pending_proposal(stub Stub, c Chocolates) (Proposal, error) {
+
+															if c.Proposal == 0 { return Proposal{}, errors.New("No transition has been proposed for " + c.ChocoID) }
+
+	p, err := t.retrieve_proposal(stub, c.ChocoID, c.Proposal)
+															if err != nil { return p, err }
+
+	err = t.check_expiry(stub, &p)
+															if err != nil { return p, err }
+															if p.Status != PROPOSAL_PENDING { return p, errors.New("Proposal " + strconv.Itoa(p.Number) + " is " + p.Status) }
+
+	return p, nil
+}
+
+//=================================================================================================================================
+//	 propose_transition - Proposes the transition named, to the recipient passed, for the signers in its approval policy to
+//						  sign. The caller must be able to make the transfer now; it is checked again when the last
+//						  signature is collected. Only one proposal can be pending for the chocolates at a time. Returns
+//						  the proposal number.
+//=================================================================================================================================
+func (t *SimpleChaincode) propose_transition(stub Stub, c Chocolates, caller string, caller_affiliation int, function string, recipient_name string) ([]byte, error) {
+
+	transition, ok := t.get_transition(function)
+															if !ok { return nil, errors.New("Unknown transition " + function) }
+
+	policy, found, err := find_approval_policy(stub, function)
+															if err != nil { return nil, err }
+															if !found { return nil, errors.New(function + " does not need approval and can be invoked directly") }
+
+	recipient_affiliation, err := t.get_affiliation(stub, recipient_name)
+															if err != nil { return nil, err }
+
+	err = t.check_transfer(transition, c, caller, caller_affiliation, recipient_affiliation)
+															if err != nil { return nil, err }
+
+	if c.Proposal > 0 {
+
+		if _, err := t.pending_proposal(stub, c); err == nil { return nil, errors.New("Proposal " + strconv.Itoa(c.Proposal) + " is still pending") }
+	}
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return nil, err }
+
+	p := Proposal{
+		ChocoID:		c.ChocoID,
+		Number:			c.Proposal + 1,
+		Function:		function,
+		Proposer:		caller,
+		ProposerRole:	caller_affiliation,
+		Recipient:		recipient_name,
+		Status:			PROPOSAL_PENDING,
+		DateProposed:	now.Format(TIME_FORMAT),
+		ExpiresAt:		now.Add(time.Duration(policy.TTLHours) * time.Hour).Format(TIME_FORMAT),
+		DateResolved:	"UNDEFINED",
+		Signers:		policy.Signers,
+		Signatures:		[]Signature{},
+	}
+
+	err = t.save_proposal(stub, p)
+															if err != nil { return nil, err }
+
+	c.Proposal = p.Number
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("PROPOSE_TRANSITION: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return []byte(strconv.Itoa(p.Number)), nil
+}
+
+//=================================================================================================================================
+//	 sign_proposal - Adds the caller's signature to the pending proposal, filling the first unsigned signer that names the
+//					 caller or their role. Once every signer has signed the transition is executed on behalf of the
+//					 proposer, whose role is looked up again and must still be the one the transition needs. Returns the
+//					 proposal.
+//=================================================================================================================================
+func (t *SimpleChaincode) sign_proposal(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	p, err := t.pending_proposal(stub, c)
+															if err != nil { return nil, err }
+
+	signed := map[int]bool{}
+
+	for _, signature := range p.Signatures {
+															if signature.Username == caller { return nil, errors.New(caller + " has already signed proposal " + strconv.Itoa(p.Number)) }
+		signed[signature.Signer] = true
+	}
+
+	slot := -1
+
+	for i, signer := range p.Signers {
+
+		if signed[i] { continue }
+
+		if signer.Username == caller || (signer.Username == "" && signer.Role == caller_affiliation) { slot = i; break }
+	}
+
+															if slot < 0 { return nil, errors.New("Permission denied") }
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return nil, err }
+
+	p.Signatures = append(p.Signatures, Signature{ Username: caller, Role: caller_affiliation, Signer: slot, Timestamp: now.Format(TIME_FORMAT) })
+
+	if len(p.Signatures) == len(p.Signers) {
+
+		transition, _ := t.get_transition(p.Function)
+
+		proposer_affiliation, err := t.get_affiliation(stub, p.Proposer)						// The proposer may have been deactivated or changed role since proposing
+															if err != nil { return nil, err }
+															if proposer_affiliation != transition.Caller { return nil, errors.New("Proposer " + p.Proposer + " can no longer make " + p.Function) }
+
+		recipient_affiliation, err := t.get_affiliation(stub, p.Recipient)
+															if err != nil { return nil, err }
+
+		_, err = t.transfer(stub, transition, c, p.Proposer, proposer_affiliation, p.Recipient, recipient_affiliation)
+															if err != nil { return nil, err }
+
+		p.Status       = PROPOSAL_EXECUTED
+		p.DateResolved = now.Format(TIME_FORMAT)
+	}
+
+	err = t.save_proposal(stub, p)
+															if err != nil { return nil, err }
+
+	return json.Marshal(p)
+}
+
+//=================================================================================================================================
+//	 withdraw_proposal - Withdraws the pending proposal. Only the participant that proposed the transition can withdraw it.
+//=================================================================================================================================
+func (t *SimpleChaincode) withdraw_proposal(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	p, err := t.pending_proposal(stub, c)
+															if err != nil { return nil, err }
+															if p.Proposer != caller { return nil, errors.New("Permission denied") }
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return nil, err }
+
+	p.Status       = PROPOSAL_WITHDRAWN
+	p.DateResolved = now.Format(TIME_FORMAT)
+
+	return nil, t.save_proposal(stub, p)
+}
+
+//==============================================================================================================================
+//	 get_proposal - Returns the chocolates' proposal with the number passed, or the latest if none is passed. The proposal
+//					can be seen by its signers as well as those allowed to see the chocolates.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_proposal(stub Stub, caller string, caller_affiliation int, chocoID string, number_value string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	number := c.Proposal
+
+	if number_value != "" {
+		number, err = strconv.Atoi(number_value)
+															if err != nil || number < 1 || number > c.Proposal { return nil, errors.New("Invalid proposal " + number_value) }
+	}
+															if number == 0 { return nil, errors.New("No transition has been proposed for " + chocoID) }
+
+	p, err := t.retrieve_proposal(stub, chocoID, number)
+															if err != nil { return nil, err }
+
+	err = t.check_expiry(stub, &p)
+															if err != nil { return nil, err }
+
+	for _, signer := range p.Signers {
+		if signer.Username == caller || (signer.Username == "" && signer.Role == caller_affiliation) { return json.Marshal(p) }
+	}
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	return json.Marshal(p)
+}
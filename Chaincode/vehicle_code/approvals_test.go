@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const test_approval_policy = `{"signers": [{"role": "DU_RHONE"}, {"username": "ibm"}], "ttlHours": 48}`
+
+func TestApprovalPolicy(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	if _, err := l.invoke("printer", "set_approval_policy", "production_to_delivery", test_approval_policy); err == nil { t.Error("expected policy set by printer to fail") }
+
+	invalid := [][]string{
+		{ "scrap_chocolates",			test_approval_policy },
+		{ "production_to_delivery",		`{"signers": []}` },
+		{ "production_to_delivery",		`{"signers": [{"role": "taster"}]}` },
+		{ "production_to_delivery",		`{"signers": [{"role": 1, "username": "ibm"}]}` },
+		{ "production_to_delivery",		`{"signers": [{"role": 1}], "ttlHours": 1000}` },
+	}
+
+	for _, args := range invalid {
+		if _, err := l.invoke("durhone", "set_approval_policy", args...); err == nil { t.Errorf("expected %v to fail", args) }
+	}
+
+	l.must_invoke("durhone", "set_approval_policy", "production_to_delivery", test_approval_policy)
+	l.must_invoke("durhone", "set_approval_policy", "testing_to_produciton", `{"signers": [{"role": 1}]}`)
+
+	var policies []Approval_Policy
+	json.Unmarshal(l.must_query("printer", "get_approval_policies"), &policies)
+
+	if len(policies) != 2 || policies[0].Function != "testing_to_produciton" || policies[0].TTLHours != DEFAULT_PROPOSAL_TTL ||
+	   policies[1].Signers[0].Role != DU_RHONE || policies[1].Signers[1].Username != "ibm" {
+		t.Errorf("unexpected policies %+v", policies)
+	}
+
+	l.must_invoke("durhone", "set_approval_policy", "testing_to_produciton", "")
+
+	json.Unmarshal(l.must_query("printer", "get_approval_policies"), &policies)
+
+	if len(policies) != 1 { t.Errorf("policies = %+v, want one", policies) }
+}
+
+func TestProposeTransition(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_PRODUCTION)
+	l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+	l.must_invoke("durhone", "set_approval_policy", "production_to_delivery", test_approval_policy)
+
+	if _, err := l.invoke("durhone", "production_to_delivery", "shipper", "AB1234567"); err == nil { t.Fatal("expected transfer without approval to fail") }
+	if _, err := l.invoke("durhone", "propose_transition", "production_to_delivery", "ibm", "AB1234567"); err == nil { t.Error("expected proposal to the wrong recipient to fail") }
+	if _, err := l.invoke("durhone", "propose_transition", "delivery_to_delivered", "ibm", "AB1234567"); err == nil { t.Error("expected proposal without a policy to fail") }
+
+	if number := string(l.must_invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567")); number != "1" { t.Errorf("proposal = %s, want 1", number) }
+
+	if _, err := l.invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567"); err == nil { t.Error("expected second pending proposal to fail") }
+	if _, err := l.invoke("printer", "sign_proposal", "AB1234567"); err == nil { t.Error("expected signature by printer to fail") }
+
+	l.must_invoke("durhone2", "sign_proposal", "AB1234567")
+
+	if _, err := l.invoke("durhone", "sign_proposal", "AB1234567"); err == nil { t.Error("expected a second du rhone signature to fail") }
+	if _, err := l.invoke("durhone2", "sign_proposal", "AB1234567"); err == nil { t.Error("expected a repeated signature to fail") }
+
+	if c := l.chocolates("AB1234567"); c.Status != STATE_PRODUCTION { t.Fatalf("transition executed before every signature: %+v", c) }
+
+	var p Proposal
+	json.Unmarshal(l.must_invoke("ibm", "sign_proposal", "AB1234567"), &p)
+
+	if p.Status != PROPOSAL_EXECUTED || len(p.Signatures) != 2 || p.Signatures[1].Signer != 1 { t.Errorf("unexpected proposal %+v", p) }
+
+	if l.stub.event_name != EVENT_TRANSFERRED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_TRANSFERRED) }
+
+	c := l.chocolates("AB1234567")
+
+	if c.Status != STATE_DELIVERY || c.Custodian != "shipper" || c.Owner != "durhone" { t.Errorf("unexpected chocolates %+v", c) }
+
+	json.Unmarshal(l.must_query("ibm", "get_proposal", "AB1234567"), &p)
+
+	if p.Number != 1 || p.Proposer != "durhone" || p.Recipient != "shipper" { t.Errorf("unexpected proposal %+v", p) }
+
+	if _, err := l.query("supplier", "get_proposal", "AB1234567"); err == nil { t.Error("expected query by supplier to fail") }
+}
+
+func TestWithdrawAndExpireProposal(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_PRODUCTION)
+	l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+	l.must_invoke("durhone", "set_approval_policy", "production_to_delivery", `{"signers": [{"username": "ibm"}], "ttlHours": 2}`)
+
+	l.must_invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567")
+
+	if _, err := l.invoke("ibm", "withdraw_proposal", "AB1234567"); err == nil { t.Error("expected withdrawal by a signer to fail") }
+
+	l.must_invoke("durhone", "withdraw_proposal", "AB1234567")
+
+	if _, err := l.invoke("ibm", "sign_proposal", "AB1234567"); err == nil { t.Error("expected signature of a withdrawn proposal to fail") }
+
+	l.must_invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567")
+
+	for i := 0; i < 3; i++ { l.must_query("durhone", "get_proposal", "AB1234567") }			// Each transaction is an hour after the last
+
+	var p Proposal
+	json.Unmarshal(l.must_query("ibm", "get_proposal", "AB1234567"), &p)
+
+	if p.Number != 2 || p.Status != PROPOSAL_EXPIRED { t.Errorf("unexpected proposal %+v", p) }
+
+	if _, err := l.invoke("ibm", "sign_proposal", "AB1234567"); err == nil { t.Error("expected signature of an expired proposal to fail") }
+
+	json.Unmarshal(l.must_query("durhone", "get_proposal", "AB1234567", "1"), &p)
+
+	if p.Status != PROPOSAL_WITHDRAWN { t.Errorf("status = %s, want %s", p.Status, PROPOSAL_WITHDRAWN) }
+
+	l.must_invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567")
+	l.must_invoke("ibm", "sign_proposal", "AB1234567")
+
+	if c := l.chocolates("AB1234567"); c.Status != STATE_DELIVERY || c.Proposal != 3 { t.Errorf("unexpected chocolates %+v", c) }
+}
+
+func TestProposerRechecked(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		ok			bool
+	}{
+		{ "proposer unchanged",			nil,																				true },
+		{ "proposer changed role",		func(l *test_ledger) { l.must_invoke("durhone2", "change_role", "durhone", "IBM") },	false },
+		{ "proposer deactivated",		func(l *test_ledger) { l.must_invoke("durhone2", "deactivate_participant", "durhone") },	false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", STATE_PRODUCTION)
+			l.register("durhone", DU_RHONE)
+			l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+			l.must_invoke("durhone", "set_approval_policy", "production_to_delivery", `{"signers": [{"username": "ibm"}]}`)
+			l.must_invoke("durhone", "propose_transition", "production_to_delivery", "shipper", "AB1234567")
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke("ibm", "sign_proposal", "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if c := l.chocolates("AB1234567"); (c.Status == STATE_DELIVERY) != test.ok { t.Errorf("unexpected chocolates %+v", c) }
+		})
+	}
+}
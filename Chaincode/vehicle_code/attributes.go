@@ -0,0 +1,217 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Attribute defaults - The values given to new chocolates for the attributes that aren't passed to create_chocolates. The
+//						  establish date defaults to the date of the transaction.
+//==============================================================================================================================
+const   DEFAULT_CHOCOLATIER			= "Du Rhone-IBM"
+const   DEFAULT_METHOD				= "Chef Watson + Chocolatier"
+
+//==============================================================================================================================
+//	 Attribute limits - Text attributes are limited to MAX_TEXT_LENGTH characters and lists to MAX_LIST_LENGTH entries
+//==============================================================================================================================
+const   MAX_TEXT_LENGTH				= 256
+const   MAX_LIST_LENGTH				= 50
+
+//==============================================================================================================================
+//	Choco_Attributes - Defines the initial attributes that can be passed to create_chocolates. Every attribute is optional.
+//					   JSON {"chocolatier": "Du Rhone-IBM", "establishDate": "2016-08-01", "method": "...",
+//					   "ingredients": ["cocoa"], "contributers": ["Chef Watson"]}
+//==============================================================================================================================
+type Choco_Attributes struct {
+	Chocolatier		string
+	EstablishDate	string
+	Method			string
+	Ingredients		[]string
+	Contributers	[]string
+}
+
+//==============================================================================================================================
+//	Field_Error - Describes why the value passed for a single field was rejected.
+//==============================================================================================================================
+type Field_Error struct {
+	Field			string			`json:"field"`
+	Message			string			`json:"message"`
+}
+
+//==============================================================================================================================
+//	Validation_Error - Returned when a payload fails validation. Lists every field that was rejected, in field order.
+//==============================================================================================================================
+type Validation_Error struct {
+	Fields			[]Field_Error
+}
+
+func (e *Validation_Error) Error() string {
+
+	messages := []string{}
+
+	for _, field := range e.Fields { messages = append(messages, field.Field + ": " + field.Message) }
+
+	return "Invalid attributes: " + strings.Join(messages, "; ")
+}
+
+func (e *Validation_Error) add(field string, message string) {
+
+	e.Fields = append(e.Fields, Field_Error{ Field: field, Message: message })
+}
+
+//==============================================================================================================================
+//	 attribute_schema - The attributes accepted by create_chocolates, keyed by JSON name. Each entry validates the raw value
+//						passed and stores it in the attributes, returning a message if it is invalid.
+//==============================================================================================================================
+var attribute_schema = map[string]func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string{
+	"chocolatier":		func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string { return parse_text(raw, &a.Chocolatier) },
+	"method":			func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string { return parse_text(raw, &a.Method) },
+	"ingredients":		func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string { return parse_text_list(raw, &a.Ingredients) },
+	"contributers":		func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string { return parse_text_list(raw, &a.Contributers) },
+	"establishDate":	func(t *SimpleChaincode, raw json.RawMessage, a *Choco_Attributes) string { return t.parse_date(raw, &a.EstablishDate) },
+}
+
+//==============================================================================================================================
+//	 parse_attributes - Validates the JSON object passed against the attribute schema. Attributes that aren't passed are
+//						left empty for new_chocolates to default; an empty string is treated as no attributes.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_attributes(value string) (Choco_Attributes, error) {
+
+	var a Choco_Attributes
+
+	if strings.TrimSpace(value) == "" { return a, nil }
+
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(value), &fields)
+															if err != nil || fields == nil { return a, &Validation_Error{ []Field_Error{ { "attributes", "must be a JSON object" } } } }
+
+	names := []string{}
+
+	for name := range fields { names = append(names, name) }
+
+	sort.Strings(names)
+
+	invalid := &Validation_Error{}
+
+	for _, name := range names {
+
+		parse, ok := attribute_schema[name]
+
+		if !ok { invalid.add(name, "unknown attribute"); continue }
+
+		if message := parse(t, fields[name], &a); message != "" { invalid.add(name, message) }
+	}
+
+	if len(invalid.Fields) > 0 { return a, invalid }
+
+	return a, nil
+}
+
+//==============================================================================================================================
+//	 parse_text - Reads a non-empty string of at most MAX_TEXT_LENGTH characters.
+//==============================================================================================================================
+func parse_text(raw json.RawMessage, value *string) string {
+
+	err := json.Unmarshal(raw, value)
+															if err != nil { return "must be a string" }
+
+	*value = strings.TrimSpace(*value)
+
+	if *value == ""							{ return "must not be empty" }
+	if len([]rune(*value)) > MAX_TEXT_LENGTH	{ return "must be at most " + strconv.Itoa(MAX_TEXT_LENGTH) + " characters" }
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 parse_date - Reads a date in the format YYYY-MM-DD.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_date(raw json.RawMessage, value *string) string {
+
+	if message := parse_text(raw, value); message != "" { return message }
+
+	if t.check_date(*value) == false { return "must be a date in the format YYYY-MM-DD" }
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 parse_text_list - Reads an array of at most MAX_LIST_LENGTH strings, each of which must be valid text.
+//==============================================================================================================================
+func parse_text_list(raw json.RawMessage, values *[]string) string {
+
+	var items []json.RawMessage
+
+	err := json.Unmarshal(raw, &items)
+															if err != nil || items == nil { return "must be an array of strings" }
+															if len(items) > MAX_LIST_LENGTH { return "must have at most " + strconv.Itoa(MAX_LIST_LENGTH) + " entries" }
+
+	*values = make([]string, len(items))
+
+	for i, item := range items {
+		if message := parse_text(item, &(*values)[i]); message != "" { return "entries " + message }
+	}
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 new_chocolates - Returns the record for newly created chocolates, owned and held by the caller. Attributes that were
+//					  not passed are given their defaults and every other field is UNDEFINED until it is updated.
+//==============================================================================================================================
+func new_chocolates(chocoID string, caller string, caller_affiliation int, a Choco_Attributes, date string) Chocolates {
+
+	c := Chocolates{
+		Chocolatier:		DEFAULT_CHOCOLATIER,
+		EstablishDate:		date,
+		ChocoID:			chocoID,
+		Product:			"UNDEFINED",
+		BoxOrderDate:		"UNDEFINED",
+		BoxDelvDate:		"UNDEFINED",
+		IngredOrderDate:	"UNDEFINED",
+		IngredDelvDate:		"UNDEFINED",
+		IngredOrigin:		"UNDEFINED",
+		Contributers:		[]string{},
+		Ingredients:		[]string{},
+		Method:				DEFAULT_METHOD,
+		Test:				"UNDEFINED",
+		Testers:			[]string{},
+		Revisions:			[]string{},
+		TestDate:			"UNDEFINED",
+		DateFinalized:		"UNDEFINED",
+		DateProduced:		"UNDEFINED",
+		DatePackaged:		"UNDEFINED",
+		DateArrived:		"UNDEFINED",
+		DeliveredBy:		"UNDEFINED",
+		Deliveries:			[]Proof_Of_Delivery{},
+		DisputeStatus:		"UNDEFINED",
+		Recall:				"UNDEFINED",
+		RecallStatus:		"UNDEFINED",
+		DelivererID:		"UNDEFINED",
+		ShipmentID:			"UNDEFINED",
+		Receipt:			"UNDEFINED",
+		Lots:				[]Lot_Usage{},
+		Reworks:			[]Rework{},
+		HoldReason:			"UNDEFINED",
+		Holds:				[]Hold{},
+		ClosedReason:		"UNDEFINED",
+		Owner:				caller,
+		OwnerRole:			caller_affiliation,
+		Custodian:			caller,
+		CustodianRole:		caller_affiliation,
+		Delivered:			false,
+		Status:				STATE_CONCEPTING,
+	}
+
+	if a.Chocolatier   != ""  { c.Chocolatier   = a.Chocolatier }
+	if a.EstablishDate != ""  { c.EstablishDate = a.EstablishDate }
+	if a.Method        != ""  { c.Method        = a.Method }
+	if a.Ingredients   != nil { c.Ingredients   = a.Ingredients }
+	if a.Contributers  != nil { c.Contributers  = a.Contributers }
+
+	return c
+}
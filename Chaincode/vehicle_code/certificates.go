@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"net/url"
+)
+
+//==============================================================================================================================
+//	 Role extension - Certificates issued with attributes carry them as JSON, {"attrs": {"role": "2"}}, in this extension
+//==============================================================================================================================
+var ROLE_EXTENSION_OID = asn1.ObjectIdentifier{ 1, 2, 3, 4, 5, 6, 7, 8, 1 }
+
+//==============================================================================================================================
+//	 Certificate errors - Returned by the functions below so callers can tell why a certificate was refused.
+//==============================================================================================================================
+type Malformed_Certificate_Error struct {
+	Reason			string
+}
+
+func (e *Malformed_Certificate_Error) Error() string { return "Malformed certificate: " + e.Reason }
+
+type Unknown_Role_Error struct {
+	Role			string
+}
+
+func (e *Unknown_Role_Error) Error() string { return "Unknown role " + e.Role }
+
+type Missing_Attribute_Error struct {
+	Attribute		string
+}
+
+func (e *Missing_Attribute_Error) Error() string { return "Certificate has no " + e.Attribute + " attribute" }
+
+//==============================================================================================================================
+//	 decode_ecert - Takes an ecert as returned by the REST API, url encoded PEM, and returns the certificate it holds.
+//==============================================================================================================================
+func decode_ecert(ecert string) (*x509.Certificate, error) {
+
+	decoded, err := url.QueryUnescape(ecert)
+															if err != nil { return nil, &Malformed_Certificate_Error{ "invalid url encoding" } }
+
+	block, _ := pem.Decode([]byte(decoded))
+															if block == nil { return nil, &Malformed_Certificate_Error{ "no PEM block found" } }
+															if block.Type != "CERTIFICATE" { return nil, &Malformed_Certificate_Error{ "unexpected PEM block " + block.Type } }
+
+	return parse_certificate(block.Bytes)
+}
+
+//==============================================================================================================================
+//	 parse_certificate - Parses a DER encoded certificate, such as the caller's certificate.
+//==============================================================================================================================
+func parse_certificate(der []byte) (*x509.Certificate, error) {
+
+															if len(der) == 0 { return nil, &Malformed_Certificate_Error{ "empty certificate" } }
+
+	cert, err := x509.ParseCertificate(der)
+															if err != nil { return nil, &Malformed_Certificate_Error{ err.Error() } }
+
+	return cert, nil
+}
+
+//==============================================================================================================================
+//	 certificate_identity - Returns the username and affiliation held in a certificate. The affiliation is read from the
+//							legacy name\group\affiliation common name if the certificate follows that convention and from
+//							the role extension otherwise. The username is still returned with a Missing_Attribute_Error so
+//							the role can be looked for elsewhere.
+//==============================================================================================================================
+func certificate_identity(cert *x509.Certificate) (string, int, error) {
+
+	name, affiliation, legacy, err := parse_common_name(cert.Subject.CommonName)
+															if err != nil { return "", -1, err }
+															if legacy { return name, affiliation, nil }
+
+	affiliation, err = extension_role(cert)
+															if err != nil { return name, -1, err }
+
+	return name, affiliation, nil
+}
+
+//==============================================================================================================================
+//	 parse_common_name - Splits a legacy name\group\affiliation common name. legacy is false, and the common name returned
+//						 as the username, for common names that don't follow the convention.
+//==============================================================================================================================
+func parse_common_name(cn string) (string, int, bool, error) {
+
+															if strings.TrimSpace(cn) == "" { return "", -1, false, &Malformed_Certificate_Error{ "empty common name" } }
+															if !strings.Contains(cn, "\\") { return cn, -1, false, nil }
+
+	parts := strings.Split(cn, "\\")
+															if len(parts) != 3 || parts[0] == "" { return "", -1, false, &Malformed_Certificate_Error{ "common name is not name\\group\\affiliation" } }
+
+	affiliation, err := strconv.Atoi(parts[2])
+															if err != nil || !is_role(affiliation) { return "", -1, false, &Unknown_Role_Error{ parts[2] } }
+
+	return parts[0], affiliation, true, nil
+}
+
+//==============================================================================================================================
+//	 extension_role - Returns the affiliation named by the role attribute in the certificate's role extension.
+//==============================================================================================================================
+func extension_role(cert *x509.Certificate) (int, error) {
+
+	for _, ext := range cert.Extensions {
+
+		if !ext.Id.Equal(ROLE_EXTENSION_OID) { continue }
+
+		var attributes struct {
+			Attrs	map[string]string	`json:"attrs"`
+		}
+
+		err := json.Unmarshal(ext.Value, &attributes)
+															if err != nil { return -1, &Malformed_Certificate_Error{ "invalid attribute extension" } }
+
+		role, ok := attributes.Attrs[ROLE_ATTRIBUTE]
+															if !ok { break }
+
+		return parse_role(role)
+	}
+
+	return -1, &Missing_Attribute_Error{ ROLE_ATTRIBUTE }
+}
+
+//==============================================================================================================================
+//	 attribute_role - Returns the affiliation named by the role attribute of the transaction certificate.
+//==============================================================================================================================
+func attribute_role(stub Stub) (int, error) {
+
+	role, err := stub.ReadCertAttribute(ROLE_ATTRIBUTE)
+															if err != nil || len(role) == 0 { return -1, &Missing_Attribute_Error{ ROLE_ATTRIBUTE } }
+
+	return parse_role(string(role))
+}
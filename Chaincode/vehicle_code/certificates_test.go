@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+	"encoding/pem"
+	"net/url"
+)
+
+func encode_ecert(der []byte) string {
+
+	return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der })))
+}
+
+func TestCheckAffiliation(t *testing.T) {
+
+	cc := &SimpleChaincode{}
+
+	valid := []struct {
+		name		string
+		ecert		string
+		want		int
+	}{
+		{ "legacy common name",	encode_ecert(create_certificate("bob\\group1\\3")),											SUPPLIER },
+		{ "role extension",		encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": {"role": "4"}}`))),			SHIPPING_CO },
+		{ "role name",			encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": {"role": "ibm"}}`))),		IBM },
+	}
+
+	for _, c := range valid {
+		t.Run(c.name, func(t *testing.T) {
+			affiliation, err := cc.check_affiliation(nil, c.ecert)
+			if err != nil || affiliation != c.want { t.Errorf("check_affiliation = %d, %v, want %d", affiliation, err, c.want) }
+		})
+	}
+
+	malformed := map[string]string{
+		"not url encoded":		"%zz",
+		"not PEM":				"hello",
+		"wrong PEM block":		url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{ Type: "PRIVATE KEY", Bytes: []byte{ 1 } }))),
+		"not a certificate":	url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: []byte{ 1, 2, 3 } }))),
+		"short common name":	encode_ecert(create_certificate("bob\\group1")),
+		"long common name":		encode_ecert(create_certificate("bob\\group1\\1\\2")),
+		"empty common name":	encode_ecert(create_certificate("")),
+		"bad extension":		encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": `))),
+	}
+
+	for name, ecert := range malformed {
+		t.Run(name, func(t *testing.T) {
+			_, err := cc.check_affiliation(nil, ecert)
+			if _, ok := err.(*Malformed_Certificate_Error); !ok { t.Errorf("check_affiliation error = %#v, want Malformed_Certificate_Error", err) }
+		})
+	}
+
+	unknown := map[string]string{
+		"non numeric common name":	encode_ecert(create_certificate("bob\\group1\\x")),
+		"unknown number":			encode_ecert(create_certificate("bob\\group1\\0")),
+		"unknown extension role":	encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": {"role": "taster"}}`))),
+	}
+
+	for name, ecert := range unknown {
+		t.Run(name, func(t *testing.T) {
+			_, err := cc.check_affiliation(nil, ecert)
+			if _, ok := err.(*Unknown_Role_Error); !ok { t.Errorf("check_affiliation error = %#v, want Unknown_Role_Error", err) }
+		})
+	}
+
+	missing := map[string]string{
+		"no extension":				encode_ecert(create_certificate("bob")),
+		"no role in extension":		encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": {"team": "red"}}`))),
+	}
+
+	for name, ecert := range missing {
+		t.Run(name, func(t *testing.T) {
+			_, err := cc.check_affiliation(nil, ecert)
+			if _, ok := err.(*Missing_Attribute_Error); !ok { t.Errorf("check_affiliation error = %#v, want Missing_Attribute_Error", err) }
+		})
+	}
+}
+
+//==============================================================================================================================
+//	 check_certificate_error - Fails the fuzz test unless err is nil or one of the certificate errors.
+//==============================================================================================================================
+func check_certificate_error(t *testing.T, err error) {
+
+	switch err.(type) {
+		case nil, *Malformed_Certificate_Error, *Unknown_Role_Error, *Missing_Attribute_Error:
+		default:
+			t.Fatalf("unexpected error %#v", err)
+	}
+}
+
+func FuzzCheckAffiliation(f *testing.F) {
+
+	f.Add(encode_ecert(create_certificate("bob\\group1\\3")))
+	f.Add(encode_ecert(create_certificate_with("bob", role_extension(`{"attrs": {"role": "2"}}`))))
+	f.Add(url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: []byte{ 0x30, 0x03, 0x02, 0x01, 0x01 } }))))
+	f.Add("-----BEGIN CERTIFICATE-----")
+	f.Add("")
+
+	cc := &SimpleChaincode{}
+
+	f.Fuzz(func(t *testing.T, ecert string) {
+
+		affiliation, err := cc.check_affiliation(nil, ecert)
+
+		check_certificate_error(t, err)
+
+		if err == nil && !is_role(affiliation) { t.Fatalf("check_affiliation returned unknown affiliation %d", affiliation) }
+	})
+}
+
+func FuzzCertificateIdentity(f *testing.F) {
+
+	f.Add(create_certificate("bob\\group1\\3"))
+	f.Add(create_certificate_with("bob", role_extension(`{"attrs": {"role": "IBM"}}`)))
+	f.Add([]byte{})
+	f.Add([]byte{ 0x30, 0x82, 0xff, 0xff })
+
+	f.Fuzz(func(t *testing.T, der []byte) {
+
+		cert, err := parse_certificate(der)
+
+		check_certificate_error(t, err)
+
+		if err != nil { return }
+
+		_, affiliation, err := certificate_identity(cert)
+
+		check_certificate_error(t, err)
+
+		if err == nil && !is_role(affiliation) { t.Fatalf("certificate_identity returned unknown affiliation %d", affiliation) }
+	})
+}
+
+func FuzzParseCommonName(f *testing.F) {
+
+	for _, seed := range []string{ "bob\\group1\\1", "bob", "\\\\", "bob\\g\\-1", "bob\\g\\99999999999999999999", "" } { f.Add(seed) }
+
+	f.Fuzz(func(t *testing.T, cn string) {
+
+		name, affiliation, legacy, err := parse_common_name(cn)
+
+		check_certificate_error(t, err)
+
+		if legacy && (name == "" || !is_role(affiliation)) { t.Fatalf("parse_common_name(%q) = %q, %d", cn, name, affiliation) }
+	})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Cold chain indexes - Storage limits are stored under \x00storage_limits\x00<product> and batches of readings under
+//						  \x00readings\x00<chocoID>\x00<batch>, zero padded so they range over in order.
+//==============================================================================================================================
+const   INDEX_STORAGE_LIMITS		= "storage_limits"
+const   INDEX_READINGS				= "readings"
+
+//==============================================================================================================================
+//	 Default storage limits - Products without limits of their own are kept between 12 and 18 degrees Celsius and at no more
+//							  than 55% relative humidity, above which sugar bloom sets in.
+//==============================================================================================================================
+const   DEFAULT_MIN_TEMPERATURE		= 12.0
+const   DEFAULT_MAX_TEMPERATURE		= 18.0
+const   DEFAULT_MIN_HUMIDITY		= 0.0
+const   DEFAULT_MAX_HUMIDITY		= 55.0
+
+const   MAX_READINGS				= 500			// The most readings that can be submitted in one batch
+
+//==============================================================================================================================
+//	 Cold chain status - Whether the readings taken of the chocolates kept within their storage limits. Chocolates that no
+//						 readings were taken of have no data, which says nothing either way.
+//==============================================================================================================================
+const   COLD_CHAIN_NO_DATA			= "no_data"
+const   COLD_CHAIN_WITHIN_RANGE		= "within_range"
+const   COLD_CHAIN_EXCURSION		= "excursion"
+
+//==============================================================================================================================
+//	Storage_Limits - Defines the range of temperatures, in degrees Celsius, and relative humidity, in percent, a product must
+//					 be kept within. JSON {"minTemperature": 12, "maxTemperature": 18, "minHumidity": 0, "maxHumidity": 55}
+//==============================================================================================================================
+type Storage_Limits struct {
+	Product			string					`json:"product"`
+	MinTemperature	float64					`json:"minTemperature"`
+	MaxTemperature	float64					`json:"maxTemperature"`
+	MinHumidity		float64					`json:"minHumidity"`
+	MaxHumidity		float64					`json:"maxHumidity"`
+}
+
+//==============================================================================================================================
+//	Reading_Batch - Defines the structure of a batch of readings submitted by the carrier of a shipment. Each reading is
+//					checked against the limits in force when the batch is submitted and Breaches names the measurements
+//					that were out of range, empty if the reading was within them.
+//==============================================================================================================================
+type Reading_Batch struct {
+	ChocoID			string					`json:"chocoID"`
+	Batch			int						`json:"batch"`
+	ShipmentID		string					`json:"shipmentID"`
+	Leg				int						`json:"leg"`
+	Carrier			string					`json:"carrier"`
+	TxID			string					`json:"txID"`
+	DateSubmitted	string					`json:"dateSubmitted"`
+	Limits			Storage_Limits			`json:"limits"`
+	Excursions		int						`json:"excursions"`
+	Readings		[]Reading				`json:"readings"`
+}
+
+type Reading struct {
+	Time			string					`json:"time"`
+	Temperature		float64					`json:"temperature"`
+	Humidity		float64					`json:"humidity"`
+	Sensor			string					`json:"sensor"`
+	Breaches		[]string				`json:"breaches"`
+}
+
+//==============================================================================================================================
+//	Cold_Chain_Report - Summarises the readings taken of the chocolates in transit. Delivered is true once IBM has accepted
+//						the chocolates. Status is one of the cold chain statuses; WithinRange is true only if readings
+//						were taken and none of them was an excursion.
+//==============================================================================================================================
+type Cold_Chain_Report struct {
+	ChocoID			string					`json:"chocoID"`
+	Product			string					`json:"product"`
+	Delivered		bool					`json:"delivered"`
+	Batches			int						`json:"batches"`
+	Readings		int						`json:"readings"`
+	Excursions		[]Excursion				`json:"excursions"`
+	Status			string					`json:"status"`
+	WithinRange		bool					`json:"withinRange"`
+}
+
+type Excursion struct {
+	Batch			int						`json:"batch"`
+	ShipmentID		string					`json:"shipmentID"`
+	Carrier			string					`json:"carrier"`
+	Limits			Storage_Limits			`json:"limits"`
+	Reading			Reading					`json:"reading"`
+}
+
+//==============================================================================================================================
+//	 parse_storage_limits - Converts the JSON limits passed into Storage_Limits. The humidity limits are optional and default
+//							to the default limits.
+//==============================================================================================================================
+func parse_storage_limits(product string, value string) (Storage_Limits, error) {
+
+	var raw struct {
+		MinTemperature	*float64			`json:"minTemperature"`
+		MaxTemperature	*float64			`json:"maxTemperature"`
+		MinHumidity		*float64			`json:"minHumidity"`
+		MaxHumidity		*float64			`json:"maxHumidity"`
+	}
+
+	limits := Storage_Limits{ Product: product, MinHumidity: DEFAULT_MIN_HUMIDITY, MaxHumidity: DEFAULT_MAX_HUMIDITY }
+
+	err := json.Unmarshal([]byte(value), &raw)
+															if err != nil { return limits, errors.New("Invalid storage limits") }
+															if raw.MinTemperature == nil || raw.MaxTemperature == nil { return limits, errors.New("Invalid storage limits: minTemperature and maxTemperature are required") }
+
+	limits.MinTemperature = *raw.MinTemperature
+	limits.MaxTemperature = *raw.MaxTemperature
+
+	if raw.MinHumidity != nil { limits.MinHumidity = *raw.MinHumidity }
+	if raw.MaxHumidity != nil { limits.MaxHumidity = *raw.MaxHumidity }
+
+															if limits.MinTemperature >= limits.MaxTemperature { return limits, errors.New("Invalid storage limits: minTemperature must be below maxTemperature") }
+															if limits.MinHumidity < 0 || limits.MaxHumidity > 100 || limits.MinHumidity >= limits.MaxHumidity { return limits, errors.New("Invalid storage limits: humidity must be a range within 0 to 100") }
+
+	return limits, nil
+}
+
+//==============================================================================================================================
+//	 get_storage_limits - Returns the storage limits for the product named, or the default limits if it has none.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_storage_limits(stub Stub, product string) (Storage_Limits, error) {
+
+	limits := Storage_Limits{ product, DEFAULT_MIN_TEMPERATURE, DEFAULT_MAX_TEMPERATURE, DEFAULT_MIN_HUMIDITY, DEFAULT_MAX_HUMIDITY }
+
+	key, err := create_index_key(INDEX_STORAGE_LIMITS, product)
+															if err != nil { return limits, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return limits, errors.New("Error retrieving storage limits") }
+															if bytes == nil { return limits, nil }
+
+	err = json.Unmarshal(bytes, &limits)
+															if err != nil { return limits, errors.New("Corrupt storage limits") }
+
+	return limits, nil
+}
+
+//==============================================================================================================================
+//	 set_storage_limits - Sets the storage limits for the product named. Passing empty limits puts the product back on the
+//						  default limits. Only the registry administrator can set limits.
+//==============================================================================================================================
+func (t *SimpleChaincode) set_storage_limits(stub Stub, caller string, caller_affiliation int, product string, limits_json string) ([]byte, error) {
+
+															if caller_affiliation != REGISTRY_ADMIN { return nil, errors.New("Permission denied") }
+
+	product = strings.TrimSpace(product)
+															if product == "" { return nil, errors.New("Invalid value passed for product") }
+
+	key, err := create_index_key(INDEX_STORAGE_LIMITS, product)
+															if err != nil { return nil, err }
+
+	if strings.TrimSpace(limits_json) == "" {
+
+		err = stub.DelState(key)
+															if err != nil { return nil, errors.New("Error removing storage limits") }
+		return nil, nil
+	}
+
+	limits, err := parse_storage_limits(product, limits_json)
+															if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(limits)
+															if err != nil { return nil, errors.New("Error converting storage limits") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SET_STORAGE_LIMITS: Error storing storage limits: %s", err); return nil, errors.New("Error storing storage limits") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 parse_readings - Validates the JSON array of readings passed, returning a Validation_Error listing every field that is
+//					  invalid. Readings must be taken while the shipment is under way, from departure up to now. JSON
+//					  [{"time": "2016-08-10T10:00:00Z", "temperature": 16.5, "humidity": 40, "sensor": "T-17"}]
+//==============================================================================================================================
+func parse_readings(value string, departed time.Time, now time.Time) ([]Reading, error) {
+
+	var raw []struct {
+		Time			string				`json:"time"`
+		Temperature		*float64			`json:"temperature"`
+		Humidity		*float64			`json:"humidity"`
+		Sensor			string				`json:"sensor"`
+	}
+
+	err := json.Unmarshal([]byte(value), &raw)
+															if err != nil { return nil, &Validation_Error{ []Field_Error{ { "readings", "must be a JSON array" } } } }
+															if len(raw) == 0 || len(raw) > MAX_READINGS { return nil, &Validation_Error{ []Field_Error{ { "readings", "must have between 1 and " + strconv.Itoa(MAX_READINGS) + " readings" } } } }
+
+	invalid  := &Validation_Error{}
+	readings := []Reading{}
+
+	for i, r := range raw {
+
+		field := fmt.Sprintf("readings[%d]", i)
+
+		taken, err := time.Parse(TIME_FORMAT, r.Time)
+
+		if err != nil										{ invalid.add(field + ".time", "must be an RFC 3339 timestamp")
+		} else if taken.Before(departed) || taken.After(now)	{ invalid.add(field + ".time", "must be between the departure of the shipment and now") }
+
+		if r.Temperature == nil								{ invalid.add(field + ".temperature", "is required") }
+		if r.Humidity == nil								{ invalid.add(field + ".humidity", "is required")
+		} else if *r.Humidity < 0 || *r.Humidity > 100		{ invalid.add(field + ".humidity", "must be between 0 and 100") }
+
+		if len(invalid.Fields) > 0 { continue }
+
+		readings = append(readings, Reading{ Time: r.Time, Temperature: *r.Temperature, Humidity: *r.Humidity, Sensor: strings.TrimSpace(r.Sensor), Breaches: []string{} })
+	}
+
+	if len(invalid.Fields) > 0 { return nil, invalid }
+
+	return readings, nil
+}
+
+//==============================================================================================================================
+//	 check_reading - Returns the measurements of the reading passed that are outside the limits.
+//==============================================================================================================================
+func check_reading(r Reading, limits Storage_Limits) []string {
+
+	breaches := []string{}
+
+	if r.Temperature < limits.MinTemperature	{ breaches = append(breaches, "temperature below " + strconv.FormatFloat(limits.MinTemperature, 'f', -1, 64)) }
+	if r.Temperature > limits.MaxTemperature	{ breaches = append(breaches, "temperature above " + strconv.FormatFloat(limits.MaxTemperature, 'f', -1, 64)) }
+	if r.Humidity < limits.MinHumidity			{ breaches = append(breaches, "humidity below " + strconv.FormatFloat(limits.MinHumidity, 'f', -1, 64)) }
+	if r.Humidity > limits.MaxHumidity			{ breaches = append(breaches, "humidity above " + strconv.FormatFloat(limits.MaxHumidity, 'f', -1, 64)) }
+
+	return breaches
+}
+
+//=================================================================================================================================
+//	 record_readings - Records a batch of temperature and humidity readings taken of chocolates in transit, by the carrier
+//					   holding them or sensors acting under its identity. Readings outside the storage limits of the
+//					   chocolates' product are flagged as excursions. Returns the batch as recorded.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_readings(stub Stub, c Chocolates, caller string, caller_affiliation int, readings_json string) ([]byte, error) {
+
+	s, err := t.current_shipment(stub, c)
+															if err != nil { return nil, err }
+
+	if 		c.Status			!= STATE_DELIVERY		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= SHIPPING_CO			||
+			s.Status			!= SHIPMENT_IN_TRANSIT	||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction time") }
+
+	departed, err := time.Parse(TIME_FORMAT, s.Legs[0].ActualDeparture)
+															if err != nil { return nil, errors.New("Corrupt shipment " + s.ShipmentID) }
+
+	readings, err := parse_readings(readings_json, departed, now)
+															if err != nil { return nil, err }
+
+	limits, err := t.get_storage_limits(stub, c.Product)
+															if err != nil { return nil, err }
+
+	batch := Reading_Batch{
+		ChocoID:		c.ChocoID,
+		Batch:			c.ReadingBatches + 1,
+		ShipmentID:		s.ShipmentID,
+		Leg:			s.CurrentLeg,
+		Carrier:		caller,
+		TxID:			stub.GetTxID(),
+		DateSubmitted:	now.Format(TIME_FORMAT),
+		Limits:			limits,
+		Readings:		readings,
+	}
+
+	for i := range batch.Readings {
+
+		batch.Readings[i].Breaches = check_reading(batch.Readings[i], limits)
+
+		if len(batch.Readings[i].Breaches) > 0 { batch.Excursions++ }
+	}
+
+	key, err := create_index_key(INDEX_READINGS, c.ChocoID, fmt.Sprintf("%06d", batch.Batch))
+															if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(batch)
+															if err != nil { return nil, errors.New("Error converting readings") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("RECORD_READINGS: Error storing readings: %s", err); return nil, errors.New("Error storing readings") }
+
+	c.ReadingBatches = batch.Batch
+	c.Excursions    += batch.Excursions
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("RECORD_READINGS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return bytes, nil
+}
+
+//==============================================================================================================================
+//	 get_cold_chain_report - Reports every excursion recorded for the chocolates in transit, across all their shipments, and
+//							 whether they were kept within their storage limits throughout, or that no readings were taken.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_cold_chain_report(stub Stub, caller string, caller_affiliation int, chocoID string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	report := Cold_Chain_Report{ ChocoID: c.ChocoID, Product: c.Product, Delivered: c.Delivered, Excursions: []Excursion{} }
+
+	prefix, err := create_index_key(INDEX_READINGS, c.ChocoID)
+															if err != nil { return nil, err }
+
+	iter, err := stub.RangeQueryState(prefix + KEY_SEPARATOR, prefix + KEY_SEPARATOR + KEY_MAX)
+															if err != nil { fmt.Printf("GET_COLD_CHAIN_REPORT: Error querying readings: %s", err); return nil, errors.New("Error querying readings") }
+	defer iter.Close()
+
+	for iter.HasNext() {
+
+		_, bytes, err := iter.Next()
+															if err != nil { fmt.Printf("GET_COLD_CHAIN_REPORT: Error reading readings: %s", err); return nil, errors.New("Error reading readings") }
+
+		var batch Reading_Batch
+
+		err = json.Unmarshal(bytes, &batch)
+															if err != nil { return nil, errors.New("Corrupt readings for " + c.ChocoID) }
+
+		report.Batches++
+		report.Readings += len(batch.Readings)
+
+		for _, r := range batch.Readings {
+			if len(r.Breaches) > 0 { report.Excursions = append(report.Excursions, Excursion{ batch.Batch, batch.ShipmentID, batch.Carrier, batch.Limits, r }) }
+		}
+	}
+
+	switch {
+		case report.Readings == 0:			report.Status = COLD_CHAIN_NO_DATA
+		case len(report.Excursions) > 0:	report.Status = COLD_CHAIN_EXCURSION
+		default:							report.Status = COLD_CHAIN_WITHIN_RANGE
+	}
+
+	report.WithinRange = report.Status == COLD_CHAIN_WITHIN_RANGE
+
+	return json.Marshal(report)
+}
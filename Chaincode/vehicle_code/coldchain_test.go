@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 new_transit_ledger - Returns a ledger with chocolates on the first leg of shipment SH-1, and the time they departed.
+//==============================================================================================================================
+func new_transit_ledger(t *testing.T) (*test_ledger, time.Time) {
+
+	l := new_shipment_ledger(t)
+	l.must_invoke("durhone", "update_product", "Dark 70%", "AB1234567")
+	l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")
+	l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+
+	var s Shipment
+	json.Unmarshal(l.must_query("durhone", "get_shipment", "SH-1"), &s)
+
+	departed, _ := time.Parse(TIME_FORMAT, s.Legs[0].ActualDeparture)
+
+	return l, departed
+}
+
+func readings_at(departed time.Time, values ...float64) string {
+
+	readings := []string{}
+
+	for i := 0; i + 1 < len(values); i += 2 {
+		readings = append(readings, fmt.Sprintf(`{"time": "%s", "temperature": %g, "humidity": %g, "sensor": "T-17"}`, departed.Add(time.Duration(i) * time.Minute).Format(TIME_FORMAT), values[i], values[i+1]))
+	}
+
+	return fmt.Sprintf("[%s]", strings.Join(readings, ", "))
+}
+
+func TestStorageLimits(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	if _, err := l.invoke("shipper", "set_storage_limits", "Dark 70%", `{"minTemperature": 10, "maxTemperature": 20}`); err == nil { t.Error("expected limits set by shipper to fail") }
+
+	invalid := []string{
+		`{"maxTemperature": 20}`,
+		`{"minTemperature": 20, "maxTemperature": 10}`,
+		`{"minTemperature": 10, "maxTemperature": 20, "maxHumidity": 120}`,
+		`"cold"`,
+	}
+
+	for _, limits := range invalid {
+		if _, err := l.invoke("durhone", "set_storage_limits", "Dark 70%", limits); err == nil { t.Errorf("expected %s to fail", limits) }
+	}
+
+	l.must_invoke("durhone", "set_storage_limits", "Dark 70%", `{"minTemperature": 10, "maxTemperature": 20}`)
+
+	var limits Storage_Limits
+	json.Unmarshal(l.must_query("shipper", "get_storage_limits", "Dark 70%"), &limits)
+
+	if limits.MinTemperature != 10 || limits.MaxTemperature != 20 || limits.MaxHumidity != DEFAULT_MAX_HUMIDITY { t.Errorf("unexpected limits %+v", limits) }
+
+	l.must_invoke("durhone", "set_storage_limits", "Dark 70%", "")
+
+	json.Unmarshal(l.must_query("shipper", "get_storage_limits", "Dark 70%"), &limits)
+
+	if limits.MinTemperature != DEFAULT_MIN_TEMPERATURE || limits.MaxTemperature != DEFAULT_MAX_TEMPERATURE { t.Errorf("limits = %+v, want the defaults", limits) }
+}
+
+func TestRecordReadings(t *testing.T) {
+
+	l, departed := new_transit_ledger(t)
+	l.must_invoke("durhone", "set_storage_limits", "Dark 70%", `{"minTemperature": 10, "maxTemperature": 20, "maxHumidity": 60}`)
+
+	if _, err := l.invoke("shipper2", "record_readings", readings_at(departed, 15, 40), "AB1234567"); err == nil { t.Error("expected readings from the next carrier to fail") }
+
+	tests := map[string][]Field_Error{
+		`[]`:		{ { "readings", "must have between 1 and 500 readings" } },
+		fmt.Sprintf(`[{"time": "%s", "temperature": 15, "humidity": 140}, {"time": "yesterday", "humidity": 40}]`, departed.Format(TIME_FORMAT)):
+					{ { "readings[0].humidity", "must be between 0 and 100" }, { "readings[1].time", "must be an RFC 3339 timestamp" }, { "readings[1].temperature", "is required" } },
+		readings_at(departed.Add(-time.Hour), 15, 40):
+					{ { "readings[0].time", "must be between the departure of the shipment and now" } },
+	}
+
+	for readings_json, want := range tests {
+
+		_, err := l.invoke("shipper", "record_readings", readings_json, "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected a validation error, got %v", readings_json, err); continue }
+
+		got, _ := json.Marshal(invalid.Fields)
+		expected, _ := json.Marshal(want)
+
+		if string(got) != string(expected) { t.Errorf("%s:\n got %s\nwant %s", readings_json, got, expected) }
+	}
+
+	var batch Reading_Batch
+	json.Unmarshal(l.must_invoke("shipper", "record_readings", readings_at(departed, 15, 40, 22.5, 40, 8, 70), "AB1234567"), &batch)
+
+	if batch.Batch != 1 || batch.ShipmentID != "SH-1" || batch.Carrier != "shipper" || batch.Excursions != 2 || batch.Limits.MaxTemperature != 20 {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+
+	if breaches := batch.Readings[2].Breaches; len(breaches) != 2 || breaches[0] != "temperature below 10" || breaches[1] != "humidity above 60" {
+		t.Errorf("unexpected breaches %v", breaches)
+	}
+
+	if c := l.chocolates("AB1234567"); c.ReadingBatches != 1 || c.Excursions != 2 { t.Errorf("unexpected chocolates %+v", c) }
+
+	l.must_invoke("durhone", "place_hold", "Heat damage suspected", "AB1234567")
+	l.must_invoke("shipper", "record_readings", readings_at(departed, 16, 45), "AB1234567")
+
+	if c := l.chocolates("AB1234567"); c.ReadingBatches != 2 || c.Excursions != 2 { t.Errorf("unexpected chocolates %+v", c) }
+}
+
+func TestColdChainReport(t *testing.T) {
+
+	handed := func(l *test_ledger, departed time.Time) {
+		l.must_invoke("shipper", "handover_shipment", "AB1234567")
+		l.must_invoke("shipper2", "accept_handover", "AB1234567")
+	}
+
+	delivered := func(l *test_ledger, departed time.Time) {
+		l.must_invoke("shipper", "record_readings", readings_at(departed, 15, 40, 16, 42), "AB1234567")
+		handed(l, departed)
+		l.must_invoke("shipper2", "record_readings", readings_at(departed, 17, 41), "AB1234567")
+		l.must_invoke("shipper2", "delivery_to_delivered", "ibm", "AB1234567")
+	}
+
+	accepted := func(l *test_ledger, departed time.Time) {
+		delivered(l, departed)
+		l.must_invoke("ibm", "update_receipt", "R-100", "AB1234567")
+		l.must_invoke("ibm", "accept_delivery", `{"quantity": 0, "condition": "good"}`, "AB1234567")
+	}
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger, departed time.Time)
+		user		string
+		ok			bool
+		check		func(r Cold_Chain_Report) bool
+	}{
+		{ "no readings",					nil,		"durhone",	true,
+			func(r Cold_Chain_Report) bool { return r.Status == COLD_CHAIN_NO_DATA && !r.WithinRange && r.Readings == 0 && !r.Delivered } },
+		{ "readings in transit",			func(l *test_ledger, departed time.Time) {
+			l.must_invoke("shipper", "record_readings", readings_at(departed, 15, 40), "AB1234567")
+		},												"shipper",	true,
+			func(r Cold_Chain_Report) bool { return r.Status == COLD_CHAIN_WITHIN_RANGE && r.WithinRange && r.Readings == 1 && !r.Delivered } },
+		{ "delivered but not accepted",		delivered,	"ibm",		true,
+			func(r Cold_Chain_Report) bool { return r.Status == COLD_CHAIN_WITHIN_RANGE && r.Batches == 2 && r.Readings == 3 && !r.Delivered && r.Product == "Dark 70%" } },
+		{ "accepted",						accepted,	"ibm",		true,
+			func(r Cold_Chain_Report) bool { return r.Status == COLD_CHAIN_WITHIN_RANGE && r.WithinRange && r.Delivered } },
+		{ "accepted with no readings",		func(l *test_ledger, departed time.Time) {
+			handed(l, departed)
+			l.must_invoke("shipper2", "delivery_to_delivered", "ibm", "AB1234567")
+			l.must_invoke("ibm", "update_receipt", "R-100", "AB1234567")
+			l.must_invoke("ibm", "accept_delivery", `{"quantity": 0, "condition": "good"}`, "AB1234567")
+		},												"ibm",		true,
+			func(r Cold_Chain_Report) bool { return r.Status == COLD_CHAIN_NO_DATA && !r.WithinRange && r.Delivered } },
+		{ "excursion",						func(l *test_ledger, departed time.Time) {
+			l.must_invoke("shipper", "record_readings", readings_at(departed, 15, 40, 25, 40), "AB1234567")
+			handed(l, departed)
+		},												"durhone",	true,
+			func(r Cold_Chain_Report) bool {
+				return r.Status == COLD_CHAIN_EXCURSION && !r.WithinRange && len(r.Excursions) == 1 && r.Excursions[0].Carrier == "shipper" &&
+					   r.Excursions[0].Reading.Temperature == 25 && r.Excursions[0].Limits.MaxTemperature == DEFAULT_MAX_TEMPERATURE
+			} },
+		{ "report for supplier",			nil,		"supplier",	false,	nil },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l, departed := new_transit_ledger(t)
+
+			if test.prepare != nil { test.prepare(l, departed) }
+
+			result, err := l.query(test.user, "get_cold_chain_report", "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if !test.ok { return }
+
+			var report Cold_Chain_Report
+			json.Unmarshal(result, &report)
+
+			if !test.check(report) { t.Errorf("unexpected report %+v", report) }
+		})
+	}
+}
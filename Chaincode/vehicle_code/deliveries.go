@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+const   DELIVERY_ACCEPTED			= "accepted"
+const   DELIVERY_REJECTED			= "rejected"
+
+const   CONDITION_GOOD				= "good"
+const   CONDITION_DAMAGED			= "damaged"
+
+const   DISCREPANCY_SHORT			= "short"
+const   DISCREPANCY_OVER			= "over"
+const   DISCREPANCY_DAMAGED			= "damaged"
+
+//==============================================================================================================================
+//	Proof_Of_Delivery - Records the recipient accepting or rejecting a delivery of the chocolates. An accepted delivery
+//						gives the receipt IBM issued, if any, the quantity received and the condition the chocolates
+//						arrived in, and any difference from what was sent is listed in Discrepancies. The quantity received
+//						is null, and the condition UNDEFINED, when they weren't recorded. A rejected delivery gives the
+//						reason it was refused.
+//						JSON passed to accept_delivery {"quantity": 100, "condition": "good", "notes": "Pallet 2 wet"}
+//==============================================================================================================================
+type Proof_Of_Delivery struct {
+	Outcome				string				`json:"outcome"`
+	Recipient			string				`json:"recipient"`
+	Carrier				string				`json:"carrier"`
+	ShipmentID			string				`json:"shipmentID"`
+	Receipt				string				`json:"receipt"`
+	Date				string				`json:"date"`
+	QuantitySent		int					`json:"quantitySent"`
+	QuantityReceived	*int				`json:"quantityReceived"`
+	Condition			string				`json:"condition"`
+	Notes				string				`json:"notes"`
+	Reason				string				`json:"reason"`
+	Discrepancies		[]Discrepancy		`json:"discrepancies"`
+}
+
+type Discrepancy struct {
+	Type			string					`json:"type"`				// One of "short", "over" or "damaged"
+	Detail			string					`json:"detail"`
+}
+
+//==============================================================================================================================
+//	 parse_delivery_receipt - Validates the JSON passed to accept_delivery, returning a Validation_Error listing every field
+//							  that is invalid.
+//==============================================================================================================================
+func parse_delivery_receipt(value string) (Proof_Of_Delivery, error) {
+
+	var raw struct {
+		Quantity		*int				`json:"quantity"`
+		Condition		string				`json:"condition"`
+		Notes			string				`json:"notes"`
+	}
+
+	pod := Proof_Of_Delivery{ Outcome: DELIVERY_ACCEPTED, Reason: "UNDEFINED", Discrepancies: []Discrepancy{} }
+
+	err := json.Unmarshal([]byte(value), &raw)
+															if err != nil { return pod, &Validation_Error{ []Field_Error{ { "delivery", "must be a JSON object" } } } }
+
+	invalid := &Validation_Error{}
+
+	if raw.Quantity == nil							{ invalid.add("quantity", "is required")
+	} else if *raw.Quantity < 0						{ invalid.add("quantity", "must not be negative")
+	} else											{ pod.QuantityReceived = raw.Quantity }
+
+	pod.Condition = strings.ToLower(strings.TrimSpace(raw.Condition))
+	pod.Notes     = strings.TrimSpace(raw.Notes)
+
+	if pod.Condition != CONDITION_GOOD && pod.Condition != CONDITION_DAMAGED { invalid.add("condition", "must be good or damaged") }
+
+	if len(invalid.Fields) > 0 { return pod, invalid }
+
+	return pod, nil
+}
+
+//==============================================================================================================================
+//	 find_discrepancies - Returns the ways the delivery recorded differs from what was sent. The quantity is only checked
+//						  if both the quantity sent and the quantity received were recorded.
+//==============================================================================================================================
+func find_discrepancies(pod Proof_Of_Delivery) []Discrepancy {
+
+	discrepancies := []Discrepancy{}
+
+	if pod.QuantitySent > 0 && pod.QuantityReceived != nil {
+
+		received := *pod.QuantityReceived
+		detail   := "sent " + strconv.Itoa(pod.QuantitySent) + ", received " + strconv.Itoa(received)
+
+		if received < pod.QuantitySent { discrepancies = append(discrepancies, Discrepancy{ DISCREPANCY_SHORT, detail }) }
+		if received > pod.QuantitySent { discrepancies = append(discrepancies, Discrepancy{ DISCREPANCY_OVER, detail }) }
+	}
+
+	if pod.Condition == CONDITION_DAMAGED { discrepancies = append(discrepancies, Discrepancy{ DISCREPANCY_DAMAGED, pod.Notes }) }
+
+	return discrepancies
+}
+
+//=================================================================================================================================
+//	 deliver - Run by delivery_to_delivered. Remembers which carrier delivered the chocolates, so a rejected delivery can be
+//			   handed back to them, before the shipment arrives.
+//=================================================================================================================================
+func (t *SimpleChaincode) deliver(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	c.DeliveredBy = caller
+
+	return t.arrive_shipment(stub, c, caller, recipient_name)
+}
+
+//=================================================================================================================================
+//	 accept_delivery - Signs for the chocolates once IBM holds them, recording what was received.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_delivery(stub Stub, c Chocolates, caller string, caller_affiliation int, delivery_json string) ([]byte, error) {
+
+	pod, err := parse_delivery_receipt(delivery_json)
+															if err != nil { return nil, err }
+
+	return t.sign_for_delivery(stub, c, caller, caller_affiliation, pod)
+}
+
+//=================================================================================================================================
+//	 finish_delivery - Kept for clients written before deliveries were signed for. Accepts the delivery without recording
+//					   the quantity received or the condition the chocolates arrived in.
+//=================================================================================================================================
+func (t *SimpleChaincode) finish_delivery(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	return t.sign_for_delivery(stub, c, caller, caller_affiliation, Proof_Of_Delivery{ Outcome: DELIVERY_ACCEPTED, Condition: "UNDEFINED", Reason: "UNDEFINED" })
+}
+
+//=================================================================================================================================
+//	 sign_for_delivery - Completes the proof of delivery passed and adds it to the chocolates. IBM becomes their owner and
+//						 the delivery is complete. The receipt IBM issued with update_receipt is recorded on the proof,
+//						 UNDEFINED if none was issued. The date of arrival is taken from the transaction timestamp so every
+//						 peer records the same value.
+//=================================================================================================================================
+func (t *SimpleChaincode) sign_for_delivery(stub Stub, c Chocolates, caller string, caller_affiliation int, pod Proof_Of_Delivery) ([]byte, error) {
+
+	if 		c.Status			!= STATE_DELIVERED		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= IBM					||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+	date_arrived, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("SIGN_FOR_DELIVERY: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+
+	pod.Recipient     = caller
+	pod.Carrier       = c.DeliveredBy
+	pod.ShipmentID    = c.ShipmentID
+	pod.Receipt       = c.Receipt
+	pod.Date          = date_arrived
+	pod.QuantitySent  = c.Quantity
+	pod.Discrepancies = find_discrepancies(pod)
+
+	if !is_defined(pod.Receipt) { pod.Receipt = "UNDEFINED" }
+
+	c.Deliveries  = append(c.Deliveries, pod)
+	c.Owner       = caller								// IBM buys the chocolates by signing for them
+	c.OwnerRole   = caller_affiliation
+	c.Delivered   = true
+	c.DateArrived = date_arrived
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("SIGN_FOR_DELIVERY: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return json.Marshal(pod)
+}
+
+//=================================================================================================================================
+//	 reject_delivery - Refuses the chocolates, handing them back to the carrier that delivered them. The shipment is back
+//					   under way, so the carrier can deliver them again or return them to Du Rhone.
+//=================================================================================================================================
+func (t *SimpleChaincode) reject_delivery(stub Stub, c Chocolates, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+	reason = strings.TrimSpace(reason)
+															if reason == "" { return nil, errors.New("Invalid value passed for reason") }
+
+	if 		c.Status			!= STATE_DELIVERED		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= IBM					||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+															if !is_defined(c.DeliveredBy) { return nil, errors.New("The carrier that delivered the chocolates is not known") }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("REJECT_DELIVERY: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+
+	if is_defined(c.ShipmentID) {
+
+		s, err := t.retrieve_shipment(stub, c.ShipmentID)
+															if err != nil { return nil, err }
+
+		s.Status = SHIPMENT_IN_TRANSIT
+		s.Legs[len(s.Legs) - 1].ActualArrival = "UNDEFINED"
+
+		err = t.save_shipment(stub, s)
+															if err != nil { return nil, err }
+	}
+
+	c.Deliveries = append(c.Deliveries, Proof_Of_Delivery{
+		Outcome:		DELIVERY_REJECTED,
+		Recipient:		caller,
+		Carrier:		c.DeliveredBy,
+		ShipmentID:		c.ShipmentID,
+		Receipt:		"UNDEFINED",
+		Date:			date,
+		QuantitySent:	c.Quantity,
+		Condition:		"UNDEFINED",
+		Reason:			reason,
+		Discrepancies:	[]Discrepancy{},
+	})
+
+	c.Status        = STATE_DELIVERY
+	c.Custodian     = c.DeliveredBy
+	c.CustodianRole = SHIPPING_CO
+	c.DeliveredBy   = "UNDEFINED"
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("REJECT_DELIVERY: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
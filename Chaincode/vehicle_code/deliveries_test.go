@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+func TestAcceptDelivery(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_PRODUCTION)
+	l.must_invoke("durhone", "update_quantity", "120", "AB1234567")
+	l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+	l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+	l.must_invoke("shipper", "delivery_to_delivered", "ibm", "AB1234567")
+
+	if c := l.chocolates("AB1234567"); c.Owner != "durhone" || c.DeliveredBy != "shipper" { t.Errorf("unexpected chocolates before acceptance %+v", c) }
+
+	l.must_invoke("ibm", "update_receipt", "R-100", "AB1234567")
+
+	if _, err := l.invoke("shipper", "accept_delivery", `{"quantity": 118, "condition": "good"}`, "AB1234567"); err == nil { t.Fatal("expected acceptance by shipper to fail") }
+
+	tests := map[string][]Field_Error{
+		`"signed"`:								{ { "delivery", "must be a JSON object" } },
+		`{"condition": "wet"}`:					{ { "quantity", "is required" }, { "condition", "must be good or damaged" } },
+		`{"quantity": -1, "condition": "good"}`:	{ { "quantity", "must not be negative" } },
+	}
+
+	for delivery_json, want := range tests {
+
+		_, err := l.invoke("ibm", "accept_delivery", delivery_json, "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected a validation error, got %v", delivery_json, err); continue }
+
+		got, _ := json.Marshal(invalid.Fields)
+		expected, _ := json.Marshal(want)
+
+		if string(got) != string(expected) { t.Errorf("%s:\n got %s\nwant %s", delivery_json, got, expected) }
+	}
+
+	var pod Proof_Of_Delivery
+	json.Unmarshal(l.must_invoke("ibm", "accept_delivery", `{"quantity": 118, "condition": "Damaged", "notes": "Two boxes crushed"}`, "AB1234567"), &pod)
+
+	if pod.Outcome != DELIVERY_ACCEPTED || pod.Carrier != "shipper" || pod.Receipt != "R-100" || pod.QuantitySent != 120 || *pod.QuantityReceived != 118 || len(pod.Discrepancies) != 2 ||
+	   pod.Discrepancies[0] != (Discrepancy{ DISCREPANCY_SHORT, "sent 120, received 118" }) || pod.Discrepancies[1] != (Discrepancy{ DISCREPANCY_DAMAGED, "Two boxes crushed" }) {
+		t.Errorf("unexpected proof of delivery %+v", pod)
+	}
+
+	if l.stub.event_name != EVENT_DELIVERED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_DELIVERED) }
+
+	c := l.chocolates("AB1234567")
+
+	if !c.Delivered || !l.cc.check_date(c.DateArrived) || c.Owner != "ibm" || c.OwnerRole != IBM || len(c.Deliveries) != 1 { t.Errorf("delivery not accepted: %+v", c) }
+
+	if _, err := l.invoke("ibm", "update_receipt", "R-101", "AB1234567"); err == nil { t.Error("expected update after delivery to fail") }
+	if _, err := l.invoke("ibm", "reject_delivery", "Too late", "AB1234567"); err == nil { t.Error("expected rejection after acceptance to fail") }
+}
+
+func TestSignForDelivery(t *testing.T) {
+
+	with_receipt := func(l *test_ledger) { l.must_invoke("ibm", "update_receipt", "R-100", "AB1234567") }
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		function	string
+		args		[]string
+		ok			bool
+		check		func(pod Proof_Of_Delivery) bool
+	}{
+		{ "accept with a receipt",			with_receipt,	"ibm",		"accept_delivery",	[]string{ `{"quantity": 10, "condition": "good"}` },	true,
+			func(pod Proof_Of_Delivery) bool { return pod.Receipt == "R-100" && pod.QuantityReceived != nil && *pod.QuantityReceived == 10 && pod.Condition == CONDITION_GOOD } },
+		{ "accept without a receipt",		nil,			"ibm",		"accept_delivery",	[]string{ `{"quantity": 10, "condition": "good"}` },	true,
+			func(pod Proof_Of_Delivery) bool { return pod.Receipt == "UNDEFINED" && pod.QuantityReceived != nil && *pod.QuantityReceived == 10 } },
+		{ "finish with a receipt",			with_receipt,	"ibm",		"finish_delivery",	nil,												true,
+			func(pod Proof_Of_Delivery) bool { return pod.Receipt == "R-100" && pod.QuantitySent == 120 && pod.QuantityReceived == nil && pod.Condition == "UNDEFINED" && len(pod.Discrepancies) == 0 } },
+		{ "finish without a receipt",		nil,			"ibm",		"finish_delivery",	nil,												true,
+			func(pod Proof_Of_Delivery) bool { return pod.Receipt == "UNDEFINED" && pod.QuantityReceived == nil } },
+		{ "finish by the carrier",			with_receipt,	"shipper",	"finish_delivery",	nil,												false,	nil },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", STATE_PRODUCTION)
+			l.must_invoke("durhone", "update_quantity", "120", "AB1234567")
+			l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+			l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+			l.must_invoke("shipper", "delivery_to_delivered", "ibm", "AB1234567")
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, test.function, append(test.args, "AB1234567")...)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			c := l.chocolates("AB1234567")
+
+			if !test.ok {
+				if c.Delivered { t.Errorf("denied delivery changed the record: %+v", c) }
+				return
+			}
+
+			if !c.Delivered || c.Owner != "ibm" || len(c.Deliveries) != 1 || !test.check(c.Deliveries[0]) { t.Errorf("unexpected chocolates %+v", c) }
+
+			if l.stub.event_name != EVENT_DELIVERED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_DELIVERED) }
+		})
+	}
+}
+
+func TestDeliveryDiscrepancies(t *testing.T) {
+
+	tests := []struct {
+		sent		int
+		received	int
+		condition	string
+		want		[]string
+	}{
+		{ 100,	100,	CONDITION_GOOD,		[]string{} },
+		{ 100,	90,		CONDITION_GOOD,		[]string{ DISCREPANCY_SHORT } },
+		{ 100,	110,	CONDITION_DAMAGED,	[]string{ DISCREPANCY_OVER, DISCREPANCY_DAMAGED } },
+		{ 0,	90,		CONDITION_GOOD,		[]string{} },
+	}
+
+	for _, test := range tests {
+
+		got := []string{}
+
+		received := test.received
+
+		for _, d := range find_discrepancies(Proof_Of_Delivery{ QuantitySent: test.sent, QuantityReceived: &received, Condition: test.condition }) { got = append(got, d.Type) }
+
+		if len(got) != len(test.want) { t.Errorf("%+v: discrepancies = %v", test, got); continue }
+
+		for i := range got {
+			if got[i] != test.want[i] { t.Errorf("%+v: discrepancies = %v", test, got) }
+		}
+	}
+}
+
+func TestRejectDelivery(t *testing.T) {
+
+	l := new_shipment_ledger(t)
+	l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")
+	l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+	l.must_invoke("shipper", "handover_shipment", "AB1234567")
+	l.must_invoke("shipper2", "accept_handover", "AB1234567")
+	l.must_invoke("shipper2", "delivery_to_delivered", "ibm", "AB1234567")
+
+	if _, err := l.invoke("ibm", "reject_delivery", " ", "AB1234567"); err == nil { t.Error("expected rejection without a reason to fail") }
+	if _, err := l.invoke("shipper2", "reject_delivery", "Wrong address", "AB1234567"); err == nil { t.Error("expected rejection by the carrier to fail") }
+
+	l.must_invoke("ibm", "reject_delivery", "Seals broken", "AB1234567")
+
+	if l.stub.event_name != EVENT_TRANSFERRED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_TRANSFERRED) }
+
+	c := l.chocolates("AB1234567")
+
+	if c.Status != STATE_DELIVERY || c.Custodian != "shipper2" || c.Owner != "durhone" || c.Delivered || len(c.Deliveries) != 1 ||
+	   c.Deliveries[0].Outcome != DELIVERY_REJECTED || c.Deliveries[0].Reason != "Seals broken" || c.Deliveries[0].Carrier != "shipper2" {
+		t.Errorf("unexpected chocolates %+v", c)
+	}
+
+	var s Shipment
+	json.Unmarshal(l.must_query("shipper2", "get_shipment", "SH-1"), &s)
+
+	if s.Status != SHIPMENT_IN_TRANSIT || s.Legs[1].ActualArrival != "UNDEFINED" { t.Errorf("unexpected shipment %+v", s) }
+
+	l.must_invoke("shipper2", "delivery_to_production", "durhone", "RETURNED", "AB1234567")
+
+	if c := l.chocolates("AB1234567"); c.Status != STATE_PRODUCTION || c.Custodian != "durhone" { t.Errorf("unexpected chocolates after return %+v", c) }
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Dispute indexes - Disputes are stored under \x00dispute\x00<chocoID>\x00<number>, zero padded so they range over in
+//					   order. Each open dispute also has an entry under \x00open_dispute\x00<chocoID>\x00<number>, removed
+//					   when the dispute is resolved.
+//==============================================================================================================================
+const   INDEX_DISPUTE				= "dispute"
+const   INDEX_OPEN_DISPUTE			= "open_dispute"
+
+//==============================================================================================================================
+//	 Dispute arbiter - The participant type agreed by every party to settle disputes.
+//==============================================================================================================================
+const   DISPUTE_ARBITER				= ARBITER
+
+const   DISPUTE_OPEN				= "open"
+const   DISPUTE_RESPONDED			= "responded"
+const   DISPUTE_RESOLVED			= "resolved"
+
+const   OUTCOME_CREDIT				= "credit"
+const   OUTCOME_REDELIVER			= "redeliver"
+const   OUTCOME_WRITE_OFF			= "write_off"
+
+var dispute_outcomes = []string{ OUTCOME_CREDIT, OUTCOME_REDELIVER, OUTCOME_WRITE_OFF }
+
+//==============================================================================================================================
+//	 evidence_hash - Evidence is kept off the ledger and identified by the hex SHA-256 hash of its content.
+//==============================================================================================================================
+var evidence_hash = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+//==============================================================================================================================
+//	Dispute - Defines the structure of a dispute over a delivery of the chocolates. The carrier named is the one that
+//			  delivered them and can respond with its own statement and evidence before the arbiter sets the outcome.
+//			  JSON passed to open_dispute and respond_to_dispute {"statement": "Boxes crushed", "evidence":
+//			  [{"hash": "<sha256>", "description": "Photo of pallet"}]}
+//==============================================================================================================================
+type Dispute struct {
+	ChocoID			string					`json:"chocoID"`
+	Number			int						`json:"number"`
+	ShipmentID		string					`json:"shipmentID"`
+	Carrier			string					`json:"carrier"`
+	OpenedBy		string					`json:"openedBy"`
+	OpenedByRole	int						`json:"openedByRole"`
+	Reason			string					`json:"reason"`
+	Status			string					`json:"status"`
+	DateOpened		string					`json:"dateOpened"`
+	Evidence		[]Evidence				`json:"evidence"`
+	Responses		[]Dispute_Response		`json:"responses"`
+	Outcome			string					`json:"outcome"`
+	Resolution		string					`json:"resolution"`
+	ResolvedBy		string					`json:"resolvedBy"`
+	DateResolved	string					`json:"dateResolved"`
+}
+
+type Evidence struct {
+	Hash			string					`json:"hash"`
+	Description		string					`json:"description"`
+	SubmittedBy		string					`json:"submittedBy"`
+	Date			string					`json:"date"`
+}
+
+type Dispute_Response struct {
+	Username		string					`json:"username"`
+	Statement		string					`json:"statement"`
+	Date			string					`json:"date"`
+}
+
+//==============================================================================================================================
+//	 parse_statement - Validates the JSON statement and evidence passed, returning a Validation_Error listing every field
+//					   that is invalid. The evidence is recorded as submitted by the caller on the date passed.
+//==============================================================================================================================
+func parse_statement(value string, caller string, date string) (string, []Evidence, error) {
+
+	var raw struct {
+		Statement		string				`json:"statement"`
+		Evidence		[]Evidence			`json:"evidence"`
+	}
+
+	err := json.Unmarshal([]byte(value), &raw)
+															if err != nil { return "", nil, &Validation_Error{ []Field_Error{ { "dispute", "must be a JSON object" } } } }
+
+	invalid  := &Validation_Error{}
+	evidence := []Evidence{}
+
+	statement := strings.TrimSpace(raw.Statement)
+
+	if statement == ""							{ invalid.add("statement", "must not be empty") }
+	if len(raw.Evidence) > MAX_LIST_LENGTH		{ invalid.add("evidence", "must have at most " + strconv.Itoa(MAX_LIST_LENGTH) + " entries") }
+
+	for i, e := range raw.Evidence {
+
+		hash := strings.ToLower(strings.TrimSpace(e.Hash))
+
+		if !evidence_hash.MatchString(hash) { invalid.add(fmt.Sprintf("evidence[%d].hash", i), "must be a hex SHA-256 hash"); continue }
+
+		evidence = append(evidence, Evidence{ Hash: hash, Description: strings.TrimSpace(e.Description), SubmittedBy: caller, Date: date })
+	}
+
+	if len(invalid.Fields) > 0 { return "", nil, invalid }
+
+	return statement, evidence, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_dispute - Returns the chocolates' dispute with the number passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_dispute(stub Stub, chocoID string, number int) (Dispute, error) {
+
+	var d Dispute
+
+	key, err := create_index_key(INDEX_DISPUTE, chocoID, fmt.Sprintf("%04d", number))
+															if err != nil { return d, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return d, errors.New("Error retrieving dispute") }
+															if bytes == nil { return d, errors.New("Dispute " + strconv.Itoa(number) + " not found for " + chocoID) }
+
+	err = json.Unmarshal(bytes, &d)
+															if err != nil { return d, errors.New("Corrupt dispute") }
+
+	return d, nil
+}
+
+//==============================================================================================================================
+//	 save_dispute - Writes the dispute passed to the ledger, adding it to or removing it from the open disputes.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_dispute(stub Stub, d Dispute) error {
+
+	number := fmt.Sprintf("%04d", d.Number)
+
+	key, err := create_index_key(INDEX_DISPUTE, d.ChocoID, number)
+															if err != nil { return err }
+
+	open_key, err := create_index_key(INDEX_OPEN_DISPUTE, d.ChocoID, number)
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(d)
+															if err != nil { return errors.New("Error converting dispute") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_DISPUTE: Error storing dispute: %s", err); return errors.New("Error storing dispute") }
+
+	if d.Status == DISPUTE_RESOLVED {
+		err = stub.DelState(open_key)
+	} else {
+		err = stub.PutState(open_key, []byte(INDEX_VALUE))
+	}
+															if err != nil { fmt.Printf("SAVE_DISPUTE: Error updating open disputes: %s", err); return errors.New("Error updating open disputes") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 current_dispute - Returns the chocolates' latest dispute if it hasn't been resolved.
+//==============================================================================================================================
+func (t *SimpleChaincode) current_dispute(stub Stub, c Chocolates) (Dispute, error) {
+
+															if c.Dispute == 0 { return Dispute{}, errors.New("No dispute has been opened for " + c.ChocoID) }
+
+	d, err := t.retrieve_dispute(stub, c.ChocoID, c.Dispute)
+															if err != nil { return d, err }
+															if d.Status == DISPUTE_RESOLVED { return d, errors.New("Dispute " + strconv.Itoa(d.Number) + " has been resolved") }
+
+	return d, nil
+}
+
+//==============================================================================================================================
+//	 is_party - Returns true if the caller can see the dispute: the participant that opened it, the carrier it is against,
+//				Du Rhone and the arbiter.
+//==============================================================================================================================
+func is_party(d Dispute, caller string, caller_affiliation int) bool {
+
+	return d.OpenedBy == caller || d.Carrier == caller || caller_affiliation == DU_RHONE || caller_affiliation == DISPUTE_ARBITER
+}
+
+//=================================================================================================================================
+//	 open_dispute - Opens a dispute over the latest delivery of the chocolates, accepted or rejected, against the carrier
+//					that delivered them. IBM can dispute a delivery made to it and Du Rhone any delivery. Only one dispute
+//					can be open at a time. Returns the dispute number.
+//=================================================================================================================================
+func (t *SimpleChaincode) open_dispute(stub Stub, c Chocolates, caller string, caller_affiliation int, dispute_json string) ([]byte, error) {
+
+															if len(c.Deliveries) == 0 { return nil, errors.New("Chocolates have not been delivered") }
+
+	delivery := c.Deliveries[len(c.Deliveries) - 1]
+
+	if 		(caller_affiliation	!= IBM					||
+			 delivery.Recipient	!= caller)				&&
+			caller_affiliation	!= DU_RHONE				{
+															return nil, errors.New("Permission denied")
+	}
+
+	if c.Dispute > 0 {
+
+		if _, err := t.current_dispute(stub, c); err == nil { return nil, errors.New("Dispute " + strconv.Itoa(c.Dispute) + " is still open") }
+	}
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	reason, evidence, err := parse_statement(dispute_json, caller, date)
+															if err != nil { return nil, err }
+
+	d := Dispute{
+		ChocoID:		c.ChocoID,
+		Number:			c.Dispute + 1,
+		ShipmentID:		delivery.ShipmentID,
+		Carrier:		delivery.Carrier,
+		OpenedBy:		caller,
+		OpenedByRole:	caller_affiliation,
+		Reason:			reason,
+		Status:			DISPUTE_OPEN,
+		DateOpened:		date,
+		Evidence:		evidence,
+		Responses:		[]Dispute_Response{},
+		Outcome:		"UNDEFINED",
+		Resolution:		"UNDEFINED",
+		ResolvedBy:		"UNDEFINED",
+		DateResolved:	"UNDEFINED",
+	}
+
+	err = t.save_dispute(stub, d)
+															if err != nil { return nil, err }
+
+	c.Dispute       = d.Number
+	c.DisputeStatus = d.Status
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("OPEN_DISPUTE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return []byte(strconv.Itoa(d.Number)), nil
+}
+
+//=================================================================================================================================
+//	 respond_to_dispute - Adds the carrier's statement, and any evidence it submits, to the open dispute against it.
+//=================================================================================================================================
+func (t *SimpleChaincode) respond_to_dispute(stub Stub, c Chocolates, caller string, caller_affiliation int, response_json string) ([]byte, error) {
+
+	d, err := t.current_dispute(stub, c)
+															if err != nil { return nil, err }
+															if d.Carrier != caller || caller_affiliation != SHIPPING_CO { return nil, errors.New("Permission denied") }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	statement, evidence, err := parse_statement(response_json, caller, date)
+															if err != nil { return nil, err }
+
+	d.Status    = DISPUTE_RESPONDED
+	d.Evidence  = append(d.Evidence, evidence...)
+	d.Responses = append(d.Responses, Dispute_Response{ caller, statement, date })
+
+	err = t.save_dispute(stub, d)
+															if err != nil { return nil, err }
+
+	c.DisputeStatus = d.Status
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("RESPOND_TO_DISPUTE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 resolve_dispute - Settles the open dispute with one of the dispute outcomes. Only the arbiter, who the registry
+//					   administrator can't appoint, can resolve disputes and it is for the parties to act on the outcome.
+//					   JSON {"outcome": "credit", "resolution": "Carrier credits two boxes"}
+//=================================================================================================================================
+func (t *SimpleChaincode) resolve_dispute(stub Stub, c Chocolates, caller string, caller_affiliation int, resolution_json string) ([]byte, error) {
+
+															if caller_affiliation != DISPUTE_ARBITER { return nil, errors.New("Permission denied") }
+
+	d, err := t.current_dispute(stub, c)
+															if err != nil { return nil, err }
+
+	var raw struct {
+		Outcome			string				`json:"outcome"`
+		Resolution		string				`json:"resolution"`
+	}
+
+	err = json.Unmarshal([]byte(resolution_json), &raw)
+															if err != nil { return nil, &Validation_Error{ []Field_Error{ { "resolution", "must be a JSON object" } } } }
+
+	invalid := &Validation_Error{}
+	outcome := strings.ToLower(strings.TrimSpace(raw.Outcome))
+	known   := false
+
+	for _, o := range dispute_outcomes { if outcome == o { known = true } }
+
+	if !known									{ invalid.add("outcome", "must be one of " + strings.Join(dispute_outcomes, ", ")) }
+	if strings.TrimSpace(raw.Resolution) == ""	{ invalid.add("resolution", "must not be empty") }
+
+	if len(invalid.Fields) > 0 { return nil, invalid }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	d.Status       = DISPUTE_RESOLVED
+	d.Outcome      = outcome
+	d.Resolution   = strings.TrimSpace(raw.Resolution)
+	d.ResolvedBy   = caller
+	d.DateResolved = date
+
+	err = t.save_dispute(stub, d)
+															if err != nil { return nil, err }
+
+	c.DisputeStatus = d.Status
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("RESOLVE_DISPUTE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return json.Marshal(d)
+}
+
+//==============================================================================================================================
+//	 get_dispute - Returns the chocolates' dispute with the number passed, or the latest if none is passed, to its parties.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_dispute(stub Stub, caller string, caller_affiliation int, chocoID string, number_value string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	number := c.Dispute
+
+	if number_value != "" {
+		number, err = strconv.Atoi(number_value)
+															if err != nil || number < 1 || number > c.Dispute { return nil, errors.New("Invalid dispute " + number_value) }
+	}
+															if number == 0 { return nil, errors.New("No dispute has been opened for " + chocoID) }
+
+	d, err := t.retrieve_dispute(stub, chocoID, number)
+															if err != nil { return nil, err }
+															if !is_party(d, caller, caller_affiliation) { return nil, errors.New("Permission denied") }
+
+	return json.Marshal(d)
+}
+
+//==============================================================================================================================
+//	 get_open_disputes - Returns every dispute that hasn't been resolved which the caller is a party to, in chocoID order.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_open_disputes(stub Stub, caller string, caller_affiliation int) ([]byte, error) {
+
+	prefix, err := create_index_key(INDEX_OPEN_DISPUTE)
+															if err != nil { return nil, err }
+
+	iter, err := stub.RangeQueryState(prefix + KEY_SEPARATOR, prefix + KEY_SEPARATOR + KEY_MAX)
+															if err != nil { fmt.Printf("GET_OPEN_DISPUTES: Error querying disputes: %s", err); return nil, errors.New("Error querying open disputes") }
+	defer iter.Close()
+
+	var keys [][]string
+
+	for iter.HasNext() {
+
+		key, _, err := iter.Next()
+															if err != nil { fmt.Printf("GET_OPEN_DISPUTES: Error reading disputes: %s", err); return nil, errors.New("Error reading open disputes") }
+
+		if parts := split_index_key(key); len(parts) == 2 { keys = append(keys, parts) }
+	}
+
+	disputes := []Dispute{}
+
+	for _, parts := range keys {
+
+		number, err := strconv.Atoi(parts[1])
+															if err != nil { return nil, errors.New("Corrupt open dispute " + parts[1]) }
+
+		d, err := t.retrieve_dispute(stub, parts[0], number)
+															if err != nil { return nil, err }
+
+		if is_party(d, caller, caller_affiliation) { disputes = append(disputes, d) }
+	}
+
+	return json.Marshal(disputes)
+}
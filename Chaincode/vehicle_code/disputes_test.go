@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+const test_evidence_hash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+const test_dispute = `{"statement": "Two boxes crushed", "evidence": [{"hash": "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08", "description": "Photo of pallet"}]}`
+
+//==============================================================================================================================
+//	 new_dispute_ledger - Returns a ledger with chocolates IBM has accepted from the carrier of the final leg of shipment SH-1
+//						  and an arbiter registered when the chaincode was deployed.
+//==============================================================================================================================
+func new_dispute_ledger(t *testing.T) *test_ledger {
+
+	l := new_test_ledger(t, "", `[{"username": "arbiter", "role": 6}]`)
+	l.ecerts.register("shipper2", "shipper2\\group1\\4")
+	l.ecerts.register("arbiter",  "arbiter\\group1\\6")
+	l.advance("AB1234567", STATE_PRODUCTION)
+
+	l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")
+	l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+	l.must_invoke("shipper", "handover_shipment", "AB1234567")
+	l.must_invoke("shipper2", "accept_handover", "AB1234567")
+	l.must_invoke("shipper2", "delivery_to_delivered", "ibm", "AB1234567")
+	l.must_invoke("ibm", "update_receipt", "R-100", "AB1234567")
+	l.must_invoke("ibm", "accept_delivery", `{"quantity": 100, "condition": "damaged", "notes": "Two boxes crushed"}`, "AB1234567")
+
+	return l
+}
+
+func TestDisputes(t *testing.T) {
+
+	const response   = `{"statement": "Boxes left intact", "evidence": [{"hash": "` + test_evidence_hash + `", "description": "Signed manifest"}]}`
+	const resolution = `{"outcome": "Credit", "resolution": "Carrier credits two boxes"}`
+
+	opened := func(l *test_ledger) { l.must_invoke("ibm", "open_dispute", test_dispute, "AB1234567") }
+
+	responded := func(l *test_ledger) {
+		opened(l)
+		l.must_invoke("shipper2", "respond_to_dispute", response, "AB1234567")
+	}
+
+	resolved := func(l *test_ledger) {
+		responded(l)
+		l.must_invoke("arbiter", "resolve_dispute", resolution, "AB1234567")
+	}
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		function	string
+		args		[]string
+		ok			bool
+		check		func(c Chocolates, d Dispute) bool
+	}{
+		{ "open",									nil,		"ibm",		"open_dispute",			[]string{ test_dispute },	true,
+			func(c Chocolates, d Dispute) bool {
+				return c.Dispute == 1 && c.DisputeStatus == DISPUTE_OPEN && d.Carrier == "shipper2" && d.ShipmentID == "SH-1" && d.OpenedBy == "ibm" &&
+					   d.Reason == "Two boxes crushed" && len(d.Evidence) == 1 && d.Evidence[0].Hash == test_evidence_hash && d.Evidence[0].SubmittedBy == "ibm"
+			} },
+		{ "open by du rhone",						nil,		"durhone",	"open_dispute",			[]string{ test_dispute },	true,
+			func(c Chocolates, d Dispute) bool { return d.OpenedBy == "durhone" && d.OpenedByRole == DU_RHONE } },
+		{ "open by the carrier",					nil,		"shipper2",	"open_dispute",			[]string{ test_dispute },	false,	nil },
+		{ "open by ibm not signing for it",			func(l *test_ledger) { l.ecerts.register("ibm2", "ibm2\\group1\\5") },
+																"ibm2",		"open_dispute",			[]string{ test_dispute },	false,	nil },
+		{ "open while open",						opened,		"durhone",	"open_dispute",			[]string{ test_dispute },	false,	nil },
+		{ "respond",								opened,		"shipper2",	"respond_to_dispute",	[]string{ response },		true,
+			func(c Chocolates, d Dispute) bool { return c.DisputeStatus == DISPUTE_RESPONDED && len(d.Responses) == 1 && len(d.Evidence) == 2 } },
+		{ "respond by another carrier",				opened,		"shipper",	"respond_to_dispute",	[]string{ response },		false,	nil },
+		{ "respond without a dispute",				nil,		"shipper2",	"respond_to_dispute",	[]string{ response },		false,	nil },
+		{ "resolve",								responded,	"arbiter",	"resolve_dispute",		[]string{ resolution },		true,
+			func(c Chocolates, d Dispute) bool {
+				return c.DisputeStatus == DISPUTE_RESOLVED && d.Status == DISPUTE_RESOLVED && d.Outcome == OUTCOME_CREDIT && d.ResolvedBy == "arbiter" && len(d.Responses) == 1
+			} },
+		{ "resolve without a response",				opened,		"arbiter",	"resolve_dispute",		[]string{ resolution },		true,
+			func(c Chocolates, d Dispute) bool { return d.Status == DISPUTE_RESOLVED && len(d.Responses) == 0 } },
+		{ "resolve by du rhone",					responded,	"durhone",	"resolve_dispute",		[]string{ resolution },		false,	nil },
+		{ "resolve by the opener",					responded,	"ibm",		"resolve_dispute",		[]string{ resolution },		false,	nil },
+		{ "resolve by an arbiter the admin registered",	func(l *test_ledger) {
+			l.ecerts.register("durhone3", "durhone3\\group1\\1")
+			l.invoke("durhone", "register_participant", `{"username": "durhone3", "role": 6}`)
+			responded(l)
+		},														"durhone3",	"resolve_dispute",		[]string{ resolution },		false,	nil },
+		{ "resolve by the admin made arbiter",		func(l *test_ledger) {
+			l.invoke("durhone2", "change_role", "durhone", "ARBITER")
+			responded(l)
+		},														"durhone",	"resolve_dispute",		[]string{ resolution },		false,	nil },
+		{ "resolve after the arbiter was demoted",	func(l *test_ledger) {
+			l.invoke("durhone", "change_role", "arbiter", "DU_RHONE")
+			responded(l)
+		},														"arbiter",	"resolve_dispute",		[]string{ resolution },		true,	nil },
+		{ "resolve twice",							resolved,	"arbiter",	"resolve_dispute",		[]string{ resolution },		false,	nil },
+		{ "respond after resolution",				resolved,	"shipper2",	"respond_to_dispute",	[]string{ response },		false,	nil },
+		{ "open after resolution",					resolved,	"durhone",	"open_dispute",			[]string{ test_dispute },	true,
+			func(c Chocolates, d Dispute) bool { return c.Dispute == 2 && d.Number == 2 && d.Status == DISPUTE_OPEN } },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_dispute_ledger(t)
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, test.function, append(test.args, "AB1234567")...)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if test.check == nil { return }
+
+			c := l.chocolates("AB1234567")
+
+			d, err := l.cc.retrieve_dispute(l.stub, "AB1234567", c.Dispute)
+			if err != nil { t.Fatal(err) }
+
+			if !test.check(c, d) { t.Errorf("unexpected chocolates %+v and dispute %+v", c, d) }
+		})
+	}
+}
+
+func TestDisputeValidation(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_DELIVERED)
+
+	if _, err := l.invoke("ibm", "open_dispute", test_dispute, "AB1234567"); err == nil { t.Error("expected dispute before a delivery was signed for to fail") }
+
+	l = new_dispute_ledger(t)
+
+	tests := []struct {
+		user		string
+		function	string
+		value		string
+		want		[]Field_Error
+	}{
+		{ "ibm",		"open_dispute",		`"crushed"`,
+			[]Field_Error{ { "dispute", "must be a JSON object" } } },
+		{ "ibm",		"open_dispute",		`{"statement": " ", "evidence": [{"hash": "abc"}]}`,
+			[]Field_Error{ { "statement", "must not be empty" }, { "evidence[0].hash", "must be a hex SHA-256 hash" } } },
+		{ "ibm",		"open_dispute",		`{"statement": "Crushed", "evidence": [` + strings.Repeat(`{"hash": "` + test_evidence_hash + `"},`, MAX_LIST_LENGTH) + `{"hash": "` + test_evidence_hash + `"}]}`,
+			[]Field_Error{ { "evidence", "must have at most " + strconv.Itoa(MAX_LIST_LENGTH) + " entries" } } },
+		{ "arbiter",	"resolve_dispute",	`{"outcome": "refund"}`,
+			[]Field_Error{ { "outcome", "must be one of " + strings.Join(dispute_outcomes, ", ") }, { "resolution", "must not be empty" } } },
+		{ "arbiter",	"resolve_dispute",	`"credit"`,
+			[]Field_Error{ { "resolution", "must be a JSON object" } } },
+	}
+
+	for _, test := range tests {
+
+		if test.function == "resolve_dispute" && l.chocolates("AB1234567").Dispute == 0 { l.must_invoke("ibm", "open_dispute", test_dispute, "AB1234567") }
+
+		_, err := l.invoke(test.user, test.function, test.value, "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s %s: expected a validation error, got %v", test.function, test.value, err); continue }
+
+		got, _ := json.Marshal(invalid.Fields)
+		expected, _ := json.Marshal(test.want)
+
+		if string(got) != string(expected) { t.Errorf("%s %s:\n got %s\nwant %s", test.function, test.value, got, expected) }
+	}
+}
+
+func TestGetOpenDisputes(t *testing.T) {
+
+	l := new_dispute_ledger(t)
+	l.must_invoke("ibm", "open_dispute", test_dispute, "AB1234567")
+
+	l.advance("CD1234567", STATE_DELIVERED)
+	l.must_invoke("ibm", "reject_delivery", "Wrong order", "CD1234567")
+	l.must_invoke("durhone", "open_dispute", `{"statement": "Rejected without cause"}`, "CD1234567")
+
+	open_disputes := func(user string) []Dispute {
+
+		var disputes []Dispute
+		json.Unmarshal(l.must_query(user, "get_open_disputes"), &disputes)
+
+		return disputes
+	}
+
+	if disputes := open_disputes("arbiter"); len(disputes) != 2 || disputes[0].ChocoID != "AB1234567" || disputes[1].Carrier != "shipper" { t.Errorf("unexpected disputes %+v", disputes) }
+	if disputes := open_disputes("shipper2"); len(disputes) != 1 || disputes[0].ChocoID != "AB1234567" { t.Errorf("unexpected disputes %+v", disputes) }
+	if disputes := open_disputes("supplier"); len(disputes) != 0 { t.Errorf("unexpected disputes %+v", disputes) }
+
+	l.must_invoke("arbiter", "resolve_dispute", `{"outcome": "write_off", "resolution": "Batch written off"}`, "AB1234567")
+
+	if disputes := open_disputes("durhone"); len(disputes) != 1 || disputes[0].ChocoID != "CD1234567" { t.Errorf("unexpected disputes %+v", disputes) }
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Event names - Every successful invoke that changes a chocolates record emits one of the events below. The catalogue
+//				   of events and their payloads is in Documentation/Chaincode Events.md.
+//==============================================================================================================================
+const   EVENT_CREATED				= "chocolate_created"
+const   EVENT_TRANSFERRED			= "chocolate_transferred"
+const   EVENT_UPDATED				= "chocolate_updated"
+const   EVENT_DELIVERED				= "chocolate_delivered"
+const   EVENT_TERMINATED			= "chocolate_terminated"
+const   EVENT_CHANGED				= "chocolate_changed"
+const   EVENT_RECALLED				= "chocolate_recalled"
+
+//==============================================================================================================================
+//	Choco_Event - Defines the payload of every chocolate event. JSON on the right is what listeners receive.
+//==============================================================================================================================
+type Choco_Event struct {
+	ChocoID			string			`json:"chocoID"`
+	TxID			string			`json:"txID"`
+	Function		string			`json:"function"`
+	FromStatus		int				`json:"fromStatus"`
+	ToStatus		int				`json:"toStatus"`
+	OldOwner		string			`json:"oldOwner"`
+	NewOwner		string			`json:"newOwner"`
+	OldCustodian	string			`json:"oldCustodian"`
+	NewCustodian	string			`json:"newCustodian"`
+	ChangedFields	[]string		`json:"changedFields"`
+}
+
+//==============================================================================================================================
+//	 event_name - Returns the name of the event emitted by the invoke function named.
+//==============================================================================================================================
+func (t *SimpleChaincode) event_name(function string) string {
+
+	if _, ok := t.get_transition(function); ok	{ return EVENT_TRANSFERRED }
+	if _, ok := t.get_termination(function); ok	{ return EVENT_TERMINATED }
+
+	if function == "create_shipment"			{ return EVENT_UPDATED }
+	if function == "accept_handover"			{ return EVENT_TRANSFERRED }
+	if function == "handover_shipment"			{ return EVENT_UPDATED }
+	if function == "record_readings"			{ return EVENT_UPDATED }
+	if function == "open_dispute"				{ return EVENT_UPDATED }
+	if function == "respond_to_dispute"			{ return EVENT_UPDATED }
+	if function == "resolve_dispute"			{ return EVENT_UPDATED }
+	if function == "record_recall_outcome"		{ return EVENT_UPDATED }
+
+	if strings.HasPrefix(function, "create_")	{ return EVENT_CREATED }
+	if function == "accept_delivery"			{ return EVENT_DELIVERED }
+	if function == "finish_delivery"			{ return EVENT_DELIVERED }
+	if function == "reject_delivery"			{ return EVENT_TRANSFERRED }
+	if strings.HasPrefix(function, "update_")	{ return EVENT_UPDATED }
+	if function == "use_ingredient_lot"			{ return EVENT_UPDATED }
+	if function == "revise_recipe"				{ return EVENT_UPDATED }
+	if function == "open_tasting_session"		{ return EVENT_UPDATED }
+	if function == "submit_tasting_score"		{ return EVENT_UPDATED }
+	if function == "close_tasting_session"		{ return EVENT_UPDATED }
+	if function == "propose_transition"			{ return EVENT_UPDATED }
+	if function == "sign_proposal"				{ return EVENT_UPDATED }
+	if function == "withdraw_proposal"			{ return EVENT_UPDATED }
+	if function == "place_hold"					{ return EVENT_UPDATED }
+	if function == "release_hold"				{ return EVENT_UPDATED }
+
+	return EVENT_CHANGED
+}
+
+//==============================================================================================================================
+//	 emit_event - Sets the event for the current transaction describing the invoke that has just been made. previous is nil
+//				  for a create, in which case the from status is -1 and the old owner and custodian empty.
+//==============================================================================================================================
+func (t *SimpleChaincode) emit_event(stub Stub, function string, previous *Chocolates, c Chocolates, changes []Field_Change) error {
+
+	event := Choco_Event{
+		ChocoID:		c.ChocoID,
+		TxID:			stub.GetTxID(),
+		Function:		function,
+		FromStatus:		-1,
+		ToStatus:		c.Status,
+		NewOwner:		c.Owner,
+		NewCustodian:	c.Custodian,
+		ChangedFields:	[]string{},
+	}
+
+	if previous != nil {
+		event.FromStatus = previous.Status
+		event.OldOwner     = previous.Owner
+		event.OldCustodian = previous.Custodian
+	}
+
+	for _, change := range changes { event.ChangedFields = append(event.ChangedFields, change.Field) }
+
+	bytes, err := json.Marshal(event)
+															if err != nil { return errors.New("Error creating event") }
+
+	name := t.event_name(function)
+
+	if function == "sign_proposal" && event.FromStatus != event.ToStatus { name = EVENT_TRANSFERRED }		// The last signature executes the proposed transition
+
+	err = stub.SetEvent(name, bytes)
+															if err != nil { fmt.Printf("EMIT_EVENT: Error setting event: %s", err); return errors.New("Error setting event") }
+
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 History index - History entries are stored under \x00history\x00<chocoID>\x00<timestamp>\x00<txID>. The timestamp is
+//					 zero padded nanoseconds so that a range query over one chocoID returns its entries in the order they
+//					 were made.
+//==============================================================================================================================
+const   INDEX_HISTORY				= "history"
+
+//==============================================================================================================================
+//	History_Entry - Defines the structure for one entry in the history of a chocolates record. One is written for every
+//					invoke that changes the record and is never modified afterwards.
+//==============================================================================================================================
+type History_Entry struct {
+	TxID			string			`json:"txID"`
+	Timestamp		string			`json:"timestamp"`
+	Caller			string			`json:"caller"`
+	Affiliation		int				`json:"affiliation"`
+	Function		string			`json:"function"`
+	Changes			[]Field_Change	`json:"changes"`
+}
+
+//==============================================================================================================================
+//	Field_Change - Records the value of a field of the chocolates, by its JSON name, before and after an invoke. Old is
+//				   null when the chocolates were created by the invoke.
+//==============================================================================================================================
+type Field_Change struct {
+	Field			string			`json:"field"`
+	Old				interface{}		`json:"old"`
+	New				interface{}		`json:"new"`
+}
+
+//==============================================================================================================================
+//	 to_fields - Converts the chocolates passed into a map of their JSON field names to values so they can be compared.
+//==============================================================================================================================
+func to_fields(c Chocolates) (map[string]interface{}, error) {
+
+	var fields map[string]interface{}
+
+	bytes, err := json.Marshal(c)
+															if err != nil { return nil, err }
+
+	err = json.Unmarshal(bytes, &fields)
+															if err != nil { return nil, err }
+
+	return fields, nil
+}
+
+//==============================================================================================================================
+//	 diff_chocolates - Returns the fields that differ between the two versions of the chocolates passed, sorted by name.
+//					   Every field is returned if previous is nil.
+//==============================================================================================================================
+func diff_chocolates(previous *Chocolates, c Chocolates) ([]Field_Change, error) {
+
+	changes := []Field_Change{}
+
+	after, err := to_fields(c)
+															if err != nil { return nil, err }
+
+	before := map[string]interface{}{}
+
+	if previous != nil {
+
+		before, err = to_fields(*previous)
+															if err != nil { return nil, err }
+	}
+
+	var fields []string
+
+	for field := range after { fields = append(fields, field) }
+
+	sort.Strings(fields)
+
+	for _, field := range fields {
+
+		if old, ok := before[field]; ok && reflect.DeepEqual(old, after[field]) { continue }
+
+		changes = append(changes, Field_Change{ Field: field, Old: before[field], New: after[field] })
+	}
+
+	return changes, nil
+}
+
+//==============================================================================================================================
+//	 record_history - Appends an entry to the history of chocoID describing the invoke that has just been made and the
+//					  changes it made to the record.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_history(stub Stub, function string, caller string, caller_affiliation int, chocoID string, changes []Field_Change) error {
+
+	timestamp, err := t.get_tx_time(stub)
+															if err != nil { return err }
+
+	key, err := create_index_key(INDEX_HISTORY, chocoID, fmt.Sprintf("%020d", timestamp.UnixNano()), stub.GetTxID())
+															if err != nil { return err }
+
+	existing, err := stub.GetState(key)
+															if err != nil || existing != nil { return errors.New("History entry already exists for this transaction") }	// Entries are immutable
+
+	entry := History_Entry{
+		TxID:			stub.GetTxID(),
+		Timestamp:		timestamp.Format(TIME_FORMAT),
+		Caller:			caller,
+		Affiliation:	caller_affiliation,
+		Function:		function,
+		Changes:		changes,
+	}
+
+	bytes, err := json.Marshal(entry)
+															if err != nil { return errors.New("Error creating history entry") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("RECORD_HISTORY: Error storing history entry: %s", err); return errors.New("Error storing history entry") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 get_chocolate_history - Returns the history of the chocolates with the chocoID passed as a JSON array, oldest entry
+//							 first. The caller must be allowed to see the chocolates themselves.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_chocolate_history(stub Stub, caller string, caller_affiliation int, chocoID string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, errors.New("GET_CHOCOLATE_HISTORY: Error retrieving chocoID " + err.Error()) }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	prefix, err := create_index_key(INDEX_HISTORY, chocoID)
+															if err != nil { return nil, err }
+
+	iter, err := stub.RangeQueryState(prefix + KEY_SEPARATOR, prefix + KEY_SEPARATOR + KEY_MAX)
+															if err != nil { fmt.Printf("GET_CHOCOLATE_HISTORY: Error querying history: %s", err); return nil, errors.New("Error querying history") }
+	defer iter.Close()
+
+	history := []History_Entry{}
+
+	for iter.HasNext() {
+
+		_, value, err := iter.Next()
+															if err != nil { return nil, errors.New("Error reading history") }
+
+		var entry History_Entry
+
+		err = json.Unmarshal(value, &entry)
+															if err != nil { return nil, errors.New("Corrupt history entry") }
+
+		history = append(history, entry)
+	}
+
+	bytes, err := json.Marshal(history)
+															if err != nil { return nil, errors.New("Error creating history") }
+
+	return bytes, nil
+}
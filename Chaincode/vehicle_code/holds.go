@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//==============================================================================================================================
+//	Termination - Defines a way of taking chocolates out of the lifecycle for good. A Function invoked by a Caller affiliate
+//				  that owns chocolates in one of the From states moves them to the terminal state To. Effect, if set, ends
+//				  the records kept outside the chocolates, as it does for a Transition.
+//==============================================================================================================================
+type Termination struct {
+	Function		string
+	From			[]int
+	To				int
+	Caller			int
+	Effect			func(t *SimpleChaincode, stub Stub, c *Chocolates, caller string, recipient_name string) error
+}
+
+//==============================================================================================================================
+//	Hold - Records one time a quality hold was placed on or released from the chocolates.
+//==============================================================================================================================
+type Hold struct {
+	Action			string					`json:"action"`			// One of "placed" or "released"
+	Reason			string					`json:"reason"`
+	Caller			string					`json:"caller"`
+	Date			string					`json:"date"`
+}
+
+//==============================================================================================================================
+//	 Hold roles - The participant types that can place a quality hold and the one that can release it. IBM can only hold
+//				  chocolates it owns or holds.
+//==============================================================================================================================
+var hold_roles = []int{ DU_RHONE, IBM }
+
+const   HOLD_RELEASER				= DU_RHONE
+
+//==============================================================================================================================
+//	 terminations - Chocolates that haven't gone into production are cancelled; those that have are discontinued, along
+//					with any shipment planned for them or under way.
+//==============================================================================================================================
+var terminations = []Termination{
+	{	Function: "cancel_chocolates",		From: []int{ STATE_CONCEPTING, STATE_PRINTING, STATE_SUPPLYING, STATE_TESTING },	To: STATE_CANCELLED,		Caller: DU_RHONE	},
+	{	Function: "discontinue_chocolates",	From: []int{ STATE_PRODUCTION, STATE_DELIVERY },									To: STATE_DISCONTINUED,	Caller: DU_RHONE,
+		Effect: (*SimpleChaincode).cancel_shipment,
+	},
+}
+
+//==============================================================================================================================
+//	 get_termination - Returns the entry in the terminations table for the function named, or false if there is none.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_termination(function string) (Termination, bool) {
+
+	for _, termination := range terminations {
+		if termination.Function == function { return termination, true }
+	}
+
+	return Termination{}, false
+}
+
+//==============================================================================================================================
+//	 is_terminal - Returns true for the states that chocolates can't leave.
+//==============================================================================================================================
+func is_terminal(status int) bool {
+
+	return status == STATE_CANCELLED || status == STATE_DISCONTINUED
+}
+
+//==============================================================================================================================
+//	 check_frozen - Returns an error if the invoke named can't be made on the chocolates because they have been cancelled or
+//					discontinued, or are on hold, or if it would transfer recalled chocolates other than back to Du Rhone.
+//					Every transfer and update is checked here before it is made. A hold can still be released, held
+//					chocolates can still be cancelled or discontinued and the readings and recall outcomes of held
+//					chocolates are still recorded. Recall outcomes are also recorded for chocolates that have left the
+//					lifecycle, as recalled stock still has to be returned or destroyed.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_frozen(c Chocolates, function string) error {
+
+	if is_terminal(c.Status) && function != "record_recall_outcome" { return errors.New("Chocolates have been " + status_name(c.Status) + ": " + c.ClosedReason) }
+
+	if c.OnHold {
+
+		_, terminating := t.get_termination(function)
+
+		if !terminating && function != "release_hold" && function != "record_readings" && function != "record_recall_outcome" { return errors.New("Chocolates are on quality hold: " + c.HoldReason) }
+	}
+
+	if is_defined(c.Recall) && t.is_transfer(function) { return errors.New("Chocolates have been recalled: " + c.Recall) }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 status_name - Returns the name of the terminal state passed, for error messages.
+//==============================================================================================================================
+func status_name(status int) string {
+
+	if status == STATE_CANCELLED { return "cancelled" }
+
+	return "discontinued"
+}
+
+//=================================================================================================================================
+//	 terminate - Moves the chocolates to the termination's terminal state, recording the reason given. Only the owner, with
+//				 the termination's affiliation, can end the life of the chocolates.
+//=================================================================================================================================
+func (t *SimpleChaincode) terminate(stub Stub, termination Termination, c Chocolates, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+	reason = strings.TrimSpace(reason)
+															if reason == "" { return nil, errors.New("Invalid value passed for reason") }
+
+	from := false
+
+	for _, status := range termination.From { if c.Status == status { from = true } }
+
+	if 		!from									||
+			c.Owner				!= caller			||
+			caller_affiliation	!= termination.Caller	||
+			c.Delivered			== true				{
+															return nil, errors.New("Permission denied")
+	}
+
+	if termination.Effect != nil {
+
+		err := termination.Effect(t, stub, &c, caller, "")
+															if err != nil { return nil, err }
+	}
+
+	c.Status       = termination.To
+	c.ClosedReason = reason
+
+	_, err := t.save_changes(stub, c)
+															if err != nil { fmt.Printf("%s: Error saving changes: %s", strings.ToUpper(termination.Function), err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 place_hold - Puts the chocolates on quality hold, freezing every transfer and update until the hold is released.
+//=================================================================================================================================
+func (t *SimpleChaincode) place_hold(stub Stub, c Chocolates, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+	permitted := false
+
+	for _, role := range hold_roles { if caller_affiliation == role { permitted = true } }
+
+															if !permitted || c.Delivered { return nil, errors.New("Permission denied") }
+															if caller_affiliation == IBM && c.Owner != caller && c.Custodian != caller { return nil, errors.New("Permission denied") }
+															if c.OnHold { return nil, errors.New("Chocolates are already on hold") }
+
+	return t.record_hold(stub, c, caller, true, reason)
+}
+
+//=================================================================================================================================
+//	 release_hold - Takes the chocolates off quality hold.
+//=================================================================================================================================
+func (t *SimpleChaincode) release_hold(stub Stub, c Chocolates, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+															if caller_affiliation != HOLD_RELEASER { return nil, errors.New("Permission denied") }
+															if !c.OnHold { return nil, errors.New("Chocolates are not on hold") }
+
+	return t.record_hold(stub, c, caller, false, reason)
+}
+
+//==============================================================================================================================
+//	 record_hold - Places or releases a hold on the chocolates and adds it to their holds, with the reason given.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_hold(stub Stub, c Chocolates, caller string, on_hold bool, reason string) ([]byte, error) {
+
+	reason = strings.TrimSpace(reason)
+															if reason == "" { return nil, errors.New("Invalid value passed for reason") }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	action := "released"
+
+	c.OnHold     = on_hold
+	c.HoldReason = "UNDEFINED"
+
+	if on_hold { action = "placed"; c.HoldReason = reason }
+
+	c.Holds = append(c.Holds, Hold{ action, reason, caller, date })
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("RECORD_HOLD: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
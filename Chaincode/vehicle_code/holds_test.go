@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+//==============================================================================================================================
+//	 frozen_invokes - One invoke of every kind that changes chocolates, each of which a hold or a terminal state must stop.
+//==============================================================================================================================
+var frozen_invokes = [][]string{
+	{ "durhone",	"update_ingredients",		`["cocoa"]` },
+	{ "durhone",	"update_test",				"Passed" },
+	{ "durhone",	"revise_recipe",			test_recipe,	"Reason" },
+	{ "durhone",	"open_tasting_session" },
+	{ "durhone",	"testing_to_produciton",	"durhone" },
+	{ "durhone",	"testing_to_concepting",	"durhone",		"TASTING_FAILED" },
+	{ "durhone",	"propose_transition",		"testing_to_produciton",	"durhone" },
+	{ "durhone",	"place_hold",				"Again" },
+}
+
+func TestQualityHold(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_TESTING)
+	l.must_invoke("durhone", "update_testers", `["durhone"]`, "AB1234567")
+
+	if _, err := l.invoke("printer", "place_hold", "Mould found", "AB1234567"); err == nil { t.Error("expected hold by printer to fail") }
+	if _, err := l.invoke("durhone", "place_hold", " ", "AB1234567"); err == nil { t.Error("expected hold without a reason to fail") }
+
+	l.must_invoke("durhone2", "place_hold", "Mould found", "AB1234567")
+
+	if c := l.chocolates("AB1234567"); !c.OnHold || c.HoldReason != "Mould found" { t.Errorf("unexpected chocolates %+v", c) }
+
+	for _, invoke := range frozen_invokes {
+
+		_, err := l.invoke(invoke[0], invoke[1], append(invoke[2:], "AB1234567")...)
+
+		if err == nil || !strings.Contains(err.Error(), "quality hold") { t.Errorf("%s: expected hold to stop the invoke, got %v", invoke[1], err) }
+	}
+
+	if _, err := l.invoke("ibm", "release_hold", "Cleaned", "AB1234567"); err == nil { t.Error("expected release by ibm to fail") }
+
+	l.must_invoke("durhone", "release_hold", "Line cleaned and retested", "AB1234567")
+
+	c := l.chocolates("AB1234567")
+
+	if c.OnHold || len(c.Holds) != 2 || c.Holds[0].Caller != "durhone2" || c.Holds[1].Action != "released" || c.Holds[1].Reason != "Line cleaned and retested" {
+		t.Errorf("unexpected holds %+v", c.Holds)
+	}
+
+	if _, err := l.invoke("durhone", "release_hold", "Twice", "AB1234567"); err == nil { t.Error("expected release without a hold to fail") }
+
+	l.must_invoke("durhone", "open_tasting_session", "AB1234567")
+}
+
+func TestHoldPermissions(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		prepare		func(l *test_ledger)
+		user		string
+		ok			bool
+	}{
+		{ "du rhone in testing",					STATE_TESTING,		nil,	"durhone2",	true },
+		{ "du rhone in transit",					STATE_DELIVERY,		nil,	"durhone2",	true },
+		{ "printer",								STATE_PRINTING,		nil,	"printer",	false },
+		{ "ibm in testing",							STATE_TESTING,		nil,	"ibm",		false },
+		{ "ibm in transit",							STATE_DELIVERY,		nil,	"ibm",		false },
+		{ "ibm holding the delivery",				STATE_DELIVERED,	nil,	"ibm",		true },
+		{ "ibm after accepting the delivery",		STATE_DELIVERED,	func(l *test_ledger) { l.must_invoke("ibm", "finish_delivery", "AB1234567") },	"ibm",	false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, "place_hold", "Mould found", "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if c := l.chocolates("AB1234567"); c.OnHold != test.ok { t.Errorf("on hold = %v, want %v", c.OnHold, test.ok) }
+		})
+	}
+}
+
+func TestTerminations(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		user		string
+		function	string
+		ok			bool
+		want_status	int
+	}{
+		{ "cancel in concepting",			STATE_CONCEPTING,	"durhone",	"cancel_chocolates",		true,	STATE_CANCELLED },
+		{ "cancel in testing",				STATE_TESTING,		"durhone",	"cancel_chocolates",		true,	STATE_CANCELLED },
+		{ "cancel in production",			STATE_PRODUCTION,	"durhone",	"cancel_chocolates",		false,	0 },
+		{ "discontinue in delivery",		STATE_DELIVERY,		"durhone",	"discontinue_chocolates",	true,	STATE_DISCONTINUED },
+		{ "discontinue in supplying",		STATE_SUPPLYING,	"durhone",	"discontinue_chocolates",	false,	0 },
+		{ "discontinue after delivery",		STATE_DELIVERED,	"ibm",		"discontinue_chocolates",	false,	0 },
+		{ "cancel by another du rhone",		STATE_PRINTING,		"durhone2",	"cancel_chocolates",		false,	0 },
+		{ "cancel by the custodian",		STATE_PRINTING,		"printer",	"cancel_chocolates",		false,	0 },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			_, err := l.invoke(test.user, test.function, "Order withdrawn", "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			c := l.chocolates("AB1234567")
+
+			if !test.ok {
+				if c.Status != test.state { t.Errorf("denied termination changed the status to %d", c.Status) }
+				return
+			}
+
+			if c.Status != test.want_status || c.ClosedReason != "Order withdrawn" { t.Errorf("unexpected chocolates %+v", c) }
+
+			if l.stub.event_name != EVENT_TERMINATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_TERMINATED) }
+
+			for _, invoke := range append(frozen_invokes, []string{ "durhone", "cancel_chocolates", "Again" }, []string{ "durhone", "release_hold", "Again" }) {
+
+				if _, err := l.invoke(invoke[0], invoke[1], append(invoke[2:], "AB1234567")...); err == nil { t.Errorf("%s: expected terminated chocolates to refuse the invoke", invoke[1]) }
+			}
+		})
+	}
+}
+
+func TestTerminateOnHold(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_PRODUCTION)
+
+	l.must_invoke("durhone", "place_hold", "Contaminated batch", "AB1234567")
+
+	if _, err := l.invoke("durhone", "cancel_chocolates", " ", "AB1234567"); err == nil { t.Error("expected termination without a reason to fail") }
+
+	l.must_invoke("durhone", "discontinue_chocolates", "Batch destroyed", "AB1234567")
+
+	if c := l.chocolates("AB1234567"); c.Status != STATE_DISCONTINUED { t.Errorf("status = %d, want %d", c.Status, STATE_DISCONTINUED) }
+}
+
+func TestTerminatedRecords(t *testing.T) {
+
+	shipped := func(l *test_ledger) {
+		l.ecerts.register("shipper2", "shipper2\\group1\\4")
+		l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")
+	}
+
+	recalled := func(l *test_ledger) {
+		l.must_invoke("durhone", "initiate_recall", `{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"chocoIDs": ["AB1234567"]}}`)
+	}
+
+	shipment_status := func(l *test_ledger) string {
+		s, err := l.cc.retrieve_shipment(l.stub, "SH-1")
+		if err != nil { l.t.Fatal(err) }
+		return s.Status
+	}
+
+	tests := []struct {
+		name		string
+		state		int
+		prepare		func(l *test_ledger)
+		function	string
+		after		[]string
+		check		func(l *test_ledger) bool
+	}{
+		{ "discontinue with a planned shipment",		STATE_PRODUCTION,	shipped,	"discontinue_chocolates",	nil,
+			func(l *test_ledger) bool { return shipment_status(l) == SHIPMENT_CANCELLED } },
+		{ "discontinue with a shipment in transit",		STATE_PRODUCTION,	func(l *test_ledger) {
+			shipped(l)
+			l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567")
+		},																	"discontinue_chocolates",	nil,
+			func(l *test_ledger) bool { return shipment_status(l) == SHIPMENT_CANCELLED && l.chocolates("AB1234567").ShipmentID == "SH-1" } },
+		{ "recall outcome after discontinuing",			STATE_DELIVERY,		recalled,	"discontinue_chocolates",	[]string{ "record_recall_outcome", "destroyed" },
+			func(l *test_ledger) bool { return l.chocolates("AB1234567").RecallStatus == RECALL_DESTROYED } },
+		{ "recall outcome after cancelling",			STATE_TESTING,		recalled,	"cancel_chocolates",		[]string{ "record_recall_outcome", "returned" },
+			func(l *test_ledger) bool { c := l.chocolates("AB1234567"); return c.RecallStatus == RECALL_RETURNED && c.Status == STATE_CANCELLED } },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			test.prepare(l)
+
+			l.must_invoke("durhone", test.function, "Order withdrawn", "AB1234567")
+
+			if test.after != nil { l.must_invoke("durhone", test.after[0], append(test.after[1:], "AB1234567")...) }
+
+			if !test.check(l) { t.Errorf("unexpected chocolates %+v", l.chocolates("AB1234567")) }
+		})
+	}
+}
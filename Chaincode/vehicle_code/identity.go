@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+//==============================================================================================================================
+//	 Resolver names - Passed to Init to choose how the chaincode finds out a participant's affiliation. The choice is stored
+//					  in the world state under RESOLVER_KEY.
+//==============================================================================================================================
+const   RESOLVER_CERTIFICATE		= "certificate"		// Read from the caller's certificate, recipients from the registry
+const   RESOLVER_REGISTRY			= "registry"		// Read from the on-ledger participant registry
+const   RESOLVER_REST				= "rest"			// Look up ecerts through the HyperLedger REST API
+
+const   RESOLVER_KEY				= "Identity_Resolver"
+
+//==============================================================================================================================
+//	 REST lookup limits - Calls to the REST API give up after ECERT_TIMEOUT and ecerts retrieved are cached for ECERT_CACHE_TTL
+//==============================================================================================================================
+const   ECERT_TIMEOUT				= 5 * time.Second
+const   ECERT_CACHE_TTL				= 5 * time.Minute
+
+//==============================================================================================================================
+//	 Role attribute - The certificate attribute that holds the participant's role when it is not in the common name
+//==============================================================================================================================
+const   ROLE_ATTRIBUTE				= "role"
+
+//==============================================================================================================================
+//	Identity_Resolver - Finds out who the caller is and the affiliation of the participants named in an invoke.
+//==============================================================================================================================
+type Identity_Resolver interface {
+	get_caller(stub Stub) (string, int, error)
+	get_affiliation(stub Stub, name string) (int, error)
+}
+
+//==============================================================================================================================
+//	 get_resolver - Returns the Identity_Resolver chosen at Init. A resolver set on the chaincode itself takes precedence.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_resolver(stub Stub) (Identity_Resolver, error) {
+
+	if t.resolver != nil { return t.resolver, nil }
+
+	name, err := stub.GetState(RESOLVER_KEY)
+															if err != nil { return nil, errors.New("Error retrieving identity resolver") }
+
+	return t.new_resolver(string(name))
+}
+
+//==============================================================================================================================
+//	 new_resolver - Returns the Identity_Resolver with the name passed. Ledgers deployed before resolvers were selectable have
+//					no name stored and keep using the REST API.
+//==============================================================================================================================
+func (t *SimpleChaincode) new_resolver(name string) (Identity_Resolver, error) {
+
+	switch name {
+		case RESOLVER_CERTIFICATE:		return Certificate_Resolver{ recipients: Registry_Resolver{} }, nil
+		case RESOLVER_REGISTRY:			return Registry_Resolver{}, nil
+		case RESOLVER_REST, "":			return Rest_Resolver{ t: t }, nil
+	}
+
+	return nil, errors.New("Unknown identity resolver " + name)
+}
+
+//==============================================================================================================================
+//	Rest_Resolver - Looks up the ecert of each participant through the chaincode's ECert_Source and reads the affiliation
+//					from its common name. This is how the chaincode has always resolved identities.
+//==============================================================================================================================
+type Rest_Resolver struct {
+	t				*SimpleChaincode
+}
+
+func (r Rest_Resolver) get_caller(stub Stub) (string, int, error) {
+
+	user, err := r.t.get_username(stub)
+															if err != nil { return "", -1, err }
+
+	affiliation, err := r.get_affiliation(stub, user)
+															if err != nil { return "", -1, err }
+
+	return user, affiliation, nil
+}
+
+func (r Rest_Resolver) get_affiliation(stub Stub, name string) (int, error) {
+
+	ecert, err := r.t.get_ecert(stub, name)
+															if err != nil { return -1, err }
+
+	return r.t.check_affiliation(stub, string(ecert))
+}
+
+//==============================================================================================================================
+//	Certificate_Resolver - Reads the caller's affiliation straight from the certificate they signed the transaction with,
+//						   from the legacy name\group\affiliation common name, the role extension or the role attribute. Other
+//						   participants' certificates aren't available to the chaincode so recipients are resolved by
+//						   the recipients resolver.
+//==============================================================================================================================
+type Certificate_Resolver struct {
+	recipients		Identity_Resolver
+}
+
+func (r Certificate_Resolver) get_caller(stub Stub) (string, int, error) {
+
+	bytes, err := stub.GetCallerCertificate()
+															if err != nil { return "", -1, errors.New("Couldn't retrieve caller certificate") }
+
+	cert, err := parse_certificate(bytes)
+															if err != nil { return "", -1, err }
+
+	user, affiliation, err := certificate_identity(cert)
+
+	if _, missing := err.(*Missing_Attribute_Error); missing { affiliation, err = attribute_role(stub) }	// Transaction certificates carry the role as an attribute
+
+															if err != nil { return "", -1, err }
+
+	return user, affiliation, nil
+}
+
+func (r Certificate_Resolver) get_affiliation(stub Stub, name string) (int, error) {
+
+	return r.recipients.get_affiliation(stub, name)
+}
+
+//==============================================================================================================================
+//	Registry_Resolver - Reads affiliations from the participants registered on the ledger. The caller is identified by the
+//						common name of their certificate.
+//==============================================================================================================================
+type Registry_Resolver struct {
+}
+
+func (r Registry_Resolver) get_caller(stub Stub) (string, int, error) {
+
+	bytes, err := stub.GetCallerCertificate()
+															if err != nil { return "", -1, errors.New("Couldn't retrieve caller certificate") }
+
+	cert, err := parse_certificate(bytes)
+															if err != nil { return "", -1, err }
+
+	user := cert.Subject.CommonName
+
+	affiliation, err := r.get_affiliation(stub, user)
+															if err != nil { return "", -1, err }
+
+	return user, affiliation, nil
+}
+
+func (r Registry_Resolver) get_affiliation(stub Stub, name string) (int, error) {
+
+	p, err := retrieve_participant(stub, name)
+															if err != nil { return -1, err }
+
+	return p.Role, nil
+}
+
+//==============================================================================================================================
+//	Http_ECerts - Retrieves ecerts from the HyperLedger REST API at the peer address stored at Init. Calls time out after
+//				  timeout and successful lookups are cached for ttl so a slow or unavailable API doesn't hold up every
+//				  invoke.
+//==============================================================================================================================
+type Http_ECerts struct {
+	client			*http.Client
+	ttl				time.Duration
+	mutex			sync.Mutex
+	cache			map[string]cached_ecert
+}
+
+type cached_ecert struct {
+	ecert			[]byte
+	expires			time.Time
+}
+
+var default_ecerts = new_http_ecerts(ECERT_TIMEOUT, ECERT_CACHE_TTL)
+
+func new_http_ecerts(timeout time.Duration, ttl time.Duration) *Http_ECerts {
+
+	return &Http_ECerts{ client: &http.Client{ Timeout: timeout }, ttl: ttl, cache: map[string]cached_ecert{} }
+}
+
+func (h *Http_ECerts) get_ecert(stub Stub, name string) ([]byte, error) {
+
+	h.mutex.Lock()
+	cached, ok := h.cache[name]
+	h.mutex.Unlock()
+
+	if ok && time.Now().Before(cached.expires) { return cached.ecert, nil }
+
+	var cert ECertResponse
+
+	peer_address, err := stub.GetState("Peer_Address")
+															if err != nil { return nil, errors.New("Error retrieving peer address") }
+
+	response, err := h.client.Get("http://"+string(peer_address)+"/registrar/"+name+"/ecert") 	// Calls out to the HyperLedger REST API to get the ecert of the user with that name
+
+															if err != nil { fmt.Printf("GET_ECERT: Error calling ecert API: %s", err); return nil, errors.New("Error calling ecert API") }
+
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)					// Read the response from the http callout into the variable contents
+
+															if err != nil { return nil, errors.New("Could not read body") }
+
+	err = json.Unmarshal(contents, &cert)
+
+															if err != nil { return nil, errors.New("Could not retrieve ecert for user: "+name) }
+
+															if cert.Error != "" { fmt.Println("GET ECERT ERRORED: ", cert.Error); return nil, errors.New(cert.Error)}
+
+	h.mutex.Lock()
+	h.cache[name] = cached_ecert{ ecert: []byte(cert.OK), expires: time.Now().Add(h.ttl) }
+	h.mutex.Unlock()
+
+	return []byte(cert.OK), nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"encoding/json"
+	"testing"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+const test_participants = `[{"username": "durhone", "role": 1}, {"username": "printer", "role": 2}]`
+
+func TestInitResolver(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	if string(l.stub.state[RESOLVER_KEY]) != RESOLVER_REST { t.Errorf("default resolver = %s, want %s", l.stub.state[RESOLVER_KEY], RESOLVER_REST) }
+
+	l.stub.begin(nil)
+
+	if _, err := l.cc.init_chaincode(l.stub, "init", []string{ "localhost:5000", "carrier-pigeon" }); err == nil { t.Error("expected unknown resolver to fail") }
+	if _, err := l.cc.init_chaincode(l.stub, "init", []string{ "localhost:5000", RESOLVER_REGISTRY, "{" }); err == nil { t.Error("expected invalid participants to fail") }
+	if _, err := l.cc.init_chaincode(l.stub, "init", []string{ "localhost:5000", RESOLVER_REGISTRY, `[{"username": "x", "role": 9}]` }); err == nil { t.Error("expected unknown role to fail") }
+	if _, err := l.cc.init_chaincode(l.stub, "init", []string{}); err == nil { t.Error("expected missing peer address to fail") }
+}
+
+func TestRegistryResolver(t *testing.T) {
+
+	l := new_test_ledger(t, RESOLVER_REGISTRY, test_participants)
+
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+	l.must_invoke("durhone", "update_ingredients",  `["cocoa"]`, "AB1234567")
+	l.must_invoke("durhone", "update_contributers", `["Chef Watson"]`, "AB1234567")
+	l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")
+
+	if _, err := l.invoke("printer", "printing_to_supplying", "supplier", "AB1234567"); err == nil { t.Error("expected unregistered recipient to fail") }
+	if _, err := l.invoke("supplier", "create_chocolates", "AB7654321"); err == nil { t.Error("expected unregistered caller to fail") }
+}
+
+func TestParticipantRegistry(t *testing.T) {
+
+	l := new_test_ledger(t, RESOLVER_REGISTRY, test_participants)
+
+	var p Participant
+
+	json.Unmarshal(l.must_query("durhone", "get_participant", "durhone"), &p)
+
+	if !p.Active || p.RegistrationDate != "2016-08-01" { t.Errorf("seeded participant = %+v", p) }
+
+	supplier := `{"username": "supplier", "displayName": "Cocoa Supplies", "organisation": "Cocoa Supplies Ltd", "role": 3}`
+
+	if _, err := l.invoke("printer", "register_participant", supplier); err == nil { t.Error("expected non-admin register to fail") }
+
+	l.must_invoke("durhone", "register_participant", supplier)
+
+	if _, err := l.invoke("durhone", "register_participant", supplier); err == nil { t.Error("expected duplicate register to fail") }
+	if _, err := l.invoke("durhone", "register_participant", `{"username": "nobody", "role": 0}`); err == nil { t.Error("expected unknown role to fail") }
+	if _, err := l.invoke("durhone", "register_participant", `{"role": 2}`); err == nil { t.Error("expected missing username to fail") }
+	if _, err := l.invoke("durhone", "register_participant", `{"username": "judge", "role": 6}`); err == nil { t.Error("expected arbiter register to fail") }
+
+	json.Unmarshal(l.must_query("durhone", "get_participant", "supplier"), &p)
+
+	if p.DisplayName != "Cocoa Supplies" || p.Organisation != "Cocoa Supplies Ltd" || p.Role != SUPPLIER || !p.Active { t.Errorf("registered participant = %+v", p) }
+
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+	l.must_invoke("durhone", "update_ingredients",  `["cocoa"]`, "AB1234567")
+	l.must_invoke("durhone", "update_contributers", `["Chef Watson"]`, "AB1234567")
+	l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")
+	l.must_invoke("printer", "printing_to_supplying", "supplier", "AB1234567")
+
+	t.Run("change_role", func(t *testing.T) {
+
+		if _, err := l.invoke("durhone", "change_role", "supplier", "ROASTER"); err == nil { t.Error("expected unknown role to fail") }
+		if _, err := l.invoke("supplier", "change_role", "supplier", "DU_RHONE"); err == nil { t.Error("expected non-admin change to fail") }
+		if _, err := l.invoke("durhone", "change_role", "durhone", "ARBITER"); err == nil { t.Error("expected arbiter appointment to fail") }
+
+		l.must_invoke("durhone", "change_role", "supplier", "shipping_co")
+
+		if _, err := l.invoke("supplier", "update_ingredOrigin", "Ghana", "AB1234567"); err == nil { t.Error("expected old role to be refused") }
+
+		l.must_invoke("durhone", "change_role", "supplier", "3")
+		l.must_invoke("supplier", "update_ingredOrigin", "Ghana", "AB1234567")
+	})
+
+	t.Run("deactivate_participant", func(t *testing.T) {
+
+		if _, err := l.invoke("durhone", "deactivate_participant", "durhone"); err == nil { t.Error("expected self deactivation to fail") }
+
+		l.must_invoke("durhone", "deactivate_participant", "supplier")
+
+		if _, err := l.invoke("supplier", "update_ingredOrigin", "Ivory Coast", "AB1234567"); err == nil { t.Error("expected deactivated caller to fail") }
+		if _, err := l.invoke("durhone", "deactivate_participant", "supplier"); err == nil { t.Error("expected second deactivation to fail") }
+		if _, err := l.invoke("durhone", "register_participant", supplier); err == nil { t.Error("expected re-register to fail") }
+
+		var participants []Participant
+
+		json.Unmarshal(l.must_query("printer", "get_participants"), &participants)
+
+		if len(participants) != 3 || participants[2].Username != "supplier" || participants[2].Active { t.Errorf("get_participants = %+v", participants) }
+	})
+}
+
+func TestArbiterDeactivation(t *testing.T) {
+
+	l := new_test_ledger(t, "", `[{"username": "arbiter", "role": 6}]`)
+
+	if _, err := l.invoke("durhone", "deactivate_participant", "arbiter"); err == nil || err.Error() != "The arbiter can only be appointed when the chaincode is deployed" {
+		t.Errorf("expected arbiter deactivation to fail, got %v", err)
+	}
+
+	var p Participant
+
+	json.Unmarshal(l.must_query("durhone", "get_participant", "arbiter"), &p)
+
+	if !p.Active || p.Role != DISPUTE_ARBITER { t.Errorf("arbiter = %+v", p) }
+}
+
+func TestRegistryOverridesCertificates(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	l.must_invoke("durhone", "register_participant", `{"username": "shipper", "role": 4}`)
+	l.must_invoke("durhone", "deactivate_participant", "shipper")
+
+	l.advance("AB1234567", STATE_PRODUCTION)
+
+	if _, err := l.invoke("durhone", "production_to_delivery", "shipper", "AB1234567"); err == nil { t.Error("expected deactivated recipient to fail") }
+
+	l.must_invoke("durhone", "register_participant", `{"username": "printer", "role": 5}`)
+
+	if _, err := l.query("printer", "get_chocos"); err != nil { t.Fatal(err) }
+	if _, err := l.invoke("durhone", "production_to_delivery", "printer", "AB1234567"); err == nil { t.Error("expected registered role to replace certificate affiliation") }
+}
+
+func TestCertificateResolver(t *testing.T) {
+
+	l := new_test_ledger(t, RESOLVER_CERTIFICATE, test_participants)
+
+	l.ecerts.callers["durhone"] = create_certificate("durhone\\group1\\1")			// Legacy common name
+	l.ecerts.callers["printer"] = create_certificate("printer")						// Role held in an attribute
+
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+	l.must_invoke("durhone", "update_ingredients",  `["cocoa"]`, "AB1234567")
+	l.must_invoke("durhone", "update_contributers", `["Chef Watson"]`, "AB1234567")
+	l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")
+
+	if _, err := l.query("printer", "get_chocolate_details", "AB1234567"); err == nil { t.Error("expected caller without role attribute to fail") }
+
+	l.stub.attributes = map[string]string{ ROLE_ATTRIBUTE: "2" }
+
+	if _, err := l.query("printer", "get_chocolate_details", "AB1234567"); err != nil { t.Errorf("role attribute not used: %s", err) }
+
+	l.stub.attributes = map[string]string{ ROLE_ATTRIBUTE: "printer" }
+
+	if _, err := l.query("printer", "get_chocolate_details", "AB1234567"); err != nil { t.Errorf("role name not accepted: %s", err) }
+
+	l.stub.attributes = map[string]string{ ROLE_ATTRIBUTE: "taster" }
+
+	if _, err := l.query("printer", "get_chocolate_details", "AB1234567"); err == nil { t.Error("expected invalid role attribute to fail") }
+
+	l.stub.attributes = nil
+	l.ecerts.callers["printer"] = create_certificate_with("printer", role_extension(`{"attrs": {"role": "PRINTER"}}`))
+
+	if _, err := l.query("printer", "get_chocolate_details", "AB1234567"); err != nil { t.Errorf("role extension not used: %s", err) }
+}
+
+func TestHttpECerts(t *testing.T) {
+
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch r.URL.Path {
+			case "/registrar/alice/ecert":	fmt.Fprint(w, `{"OK": "alice-ecert"}`)
+			case "/registrar/slow/ecert":	time.Sleep(200 * time.Millisecond); fmt.Fprint(w, `{"OK": "slow-ecert"}`)
+			default:						fmt.Fprint(w, `{"Error": "user not found"}`)
+		}
+	}))
+	defer server.Close()
+
+	stub := new_mock_stub()
+	stub.PutState("Peer_Address", []byte(strings.TrimPrefix(server.URL, "http://")))
+
+	ecerts := new_http_ecerts(50 * time.Millisecond, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		ecert, err := ecerts.get_ecert(stub, "alice")
+		if err != nil || string(ecert) != "alice-ecert" { t.Fatalf("get_ecert = %s, %v", ecert, err) }
+	}
+
+	if calls != 1 { t.Errorf("REST API called %d times, want 1", calls) }
+
+	if _, err := ecerts.get_ecert(stub, "bob"); err == nil || err.Error() != "user not found" { t.Errorf("expected API error, got %v", err) }
+	if _, err := ecerts.get_ecert(stub, "slow"); err == nil { t.Error("expected slow API to time out") }
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+)
+
+//==============================================================================================================================
+//	 ID policy names - Passed to Init to choose the format of chocoIDs. The choice is stored in the world state under
+//					   ID_POLICY_KEY; ledgers deployed before the policy was configurable use the legacy format.
+//==============================================================================================================================
+const   ID_POLICY_LEGACY			= "legacy"			// Two letters followed by seven digits e.g. AB1234567
+const   ID_POLICY_GTIN				= "gtin"			// GS1 GTIN-13 or GTIN-14 e.g. 9506000134352
+const   ID_POLICY_SGTIN				= "sgtin"			// GS1 element string of a GTIN-14 and serial e.g. 010950600013435221ABC123
+const   ID_POLICY_TXID				= "txid"			// Generated by the chaincode from the transaction ID e.g. CH3F8A1C0D92B4E7F1
+
+const   ID_POLICY_KEY				= "ID_Policy"
+
+//==============================================================================================================================
+//	 SGTIN application identifiers - An SGTIN is the GTIN application identifier, 01, and a GTIN-14 followed by the serial
+//									 number application identifier, 21, and a serial of up to 20 characters.
+//==============================================================================================================================
+const   AI_GTIN						= "01"
+const   AI_SERIAL					= "21"
+
+//==============================================================================================================================
+//	 Generated IDs - IDs generated from a transaction ID are GENERATED_ID_PREFIX followed by the first GENERATED_ID_LENGTH
+//					 hex digits of the SHA-256 hash of the transaction ID.
+//==============================================================================================================================
+const   GENERATED_ID_PREFIX			= "CH"
+const   GENERATED_ID_LENGTH			= 16
+
+//==============================================================================================================================
+//	 ID sequences - Under the legacy policy create_chocolates_auto numbers chocolates from a sequence per chocolatier prefix,
+//					held under \x00sequence\x00<prefix>. MAX_SEQUENCE is the highest number that fits in seven digits.
+//					Every auto-create for a chocolatier writes the same sequence key, so creates for it submitted at the
+//					same time conflict and all but one fail validation; ledgers that create chocolates concurrently
+//					should choose a generated policy at Init instead.
+//==============================================================================================================================
+const   INDEX_SEQUENCE				= "sequence"
+const   MAX_SEQUENCE				= 9999999
+
+//==============================================================================================================================
+//	ID_Policy - Defines a format of chocoID. Validate returns true for IDs in the format. IDs for a Generated policy are
+//				created by the chaincode and clients must not pass one.
+//==============================================================================================================================
+type ID_Policy struct {
+	Name			string
+	Validate		func(chocoID string) bool
+	Generated		bool
+}
+
+var legacy_id     = regexp.MustCompile(`^[A-Za-z]{2}[0-9]{7}$`)
+var gtin_id       = regexp.MustCompile(`^([0-9]{13}|[0-9]{14})$`)
+var sgtin_id      = regexp.MustCompile(`^` + AI_GTIN + `([0-9]{14})` + AI_SERIAL + `([!"%&'()*+,\-./0-9:;<=>?A-Z_a-z]{1,20})$`)
+var generated_id  = regexp.MustCompile(`^` + GENERATED_ID_PREFIX + `[0-9A-F]{` + strconv.Itoa(GENERATED_ID_LENGTH) + `}$`)
+
+//==============================================================================================================================
+//	 id_policies - The chocoID formats that can be chosen at Init.
+//==============================================================================================================================
+var id_policies = []ID_Policy{
+	{	Name: ID_POLICY_LEGACY,		Validate: func(id string) bool { return legacy_id.MatchString(id) }							},
+	{	Name: ID_POLICY_GTIN,		Validate: func(id string) bool { return gtin_id.MatchString(id) && check_digit_valid(id) }	},
+	{	Name: ID_POLICY_SGTIN,		Validate: func(id string) bool {
+										parts := sgtin_id.FindStringSubmatch(id)
+										return parts != nil && check_digit_valid(parts[1])
+									}																								},
+	{	Name: ID_POLICY_TXID,		Validate: func(id string) bool { return generated_id.MatchString(id) },	Generated: true		},
+}
+
+//==============================================================================================================================
+//	 find_id_policy - Returns the ID policy with the name passed. An empty name is the legacy policy.
+//==============================================================================================================================
+func find_id_policy(name string) (ID_Policy, error) {
+
+	if name == "" { name = ID_POLICY_LEGACY }
+
+	for _, policy := range id_policies {
+		if policy.Name == name { return policy, nil }
+	}
+
+	return ID_Policy{}, errors.New("Unknown ID policy " + name)
+}
+
+//==============================================================================================================================
+//	 get_id_policy - Returns the ID policy chosen at Init.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_id_policy(stub Stub) (ID_Policy, error) {
+
+	name, err := stub.GetState(ID_POLICY_KEY)
+															if err != nil { return ID_Policy{}, errors.New("Error retrieving ID policy") }
+
+	return find_id_policy(string(name))
+}
+
+//==============================================================================================================================
+//	 check_digit_valid - Returns true if the last digit of the GS1 identifier passed is its check digit. Working from the
+//						 right, the digits before it are weighted 3, 1, 3, ... and the check digit brings the sum up to a
+//						 multiple of ten.
+//==============================================================================================================================
+func check_digit_valid(digits string) bool {
+
+	if len(digits) < 2 { return false }
+
+	sum := 0
+	weight := 3
+
+	for i := len(digits) - 2; i >= 0; i-- {
+
+		if digits[i] < '0' || digits[i] > '9' { return false }
+
+		sum += int(digits[i] - '0') * weight
+		weight = 4 - weight									// Alternate between 3 and 1
+	}
+
+	return int(digits[len(digits)-1] - '0') == (10 - sum % 10) % 10
+}
+
+//==============================================================================================================================
+//	 generate_id - Returns the chocoID for chocolates created by the current transaction under a generated policy. Every
+//				   peer derives the same ID and no two transactions share one.
+//==============================================================================================================================
+func generate_id(stub Stub) string {
+
+	hash := sha256.Sum256([]byte(stub.GetTxID()))
+
+	return GENERATED_ID_PREFIX + strings.ToUpper(hex.EncodeToString(hash[:]))[:GENERATED_ID_LENGTH]
+}
+
+//==============================================================================================================================
+//	 assign_id - Checks the chocoID passed against the policy chosen at Init and returns the ID the chocolates will be saved
+//				 under, generating one if the policy requires it.
+//==============================================================================================================================
+func (t *SimpleChaincode) assign_id(stub Stub, chocoID string) (string, error) {
+
+	policy, err := t.get_id_policy(stub)
+															if err != nil { return "", err }
+
+	if policy.Generated {
+															if chocoID != "" { return "", errors.New("Invalid chocoID provided: IDs are generated by the chaincode under the " + policy.Name + " policy") }
+
+		chocoID = generate_id(stub)
+	}
+															if !policy.Validate(chocoID) { return "", errors.New("Invalid chocoID provided: IDs must follow the " + policy.Name + " policy") }
+
+	return chocoID, nil
+}
+
+//==============================================================================================================================
+//	 chocolatier_prefix - Returns the two letter prefix for the chocolatier named, the first two letters of its name in
+//						  upper case padded with X e.g. DU for Du Rhone-IBM.
+//==============================================================================================================================
+func chocolatier_prefix(chocolatier string) string {
+
+	prefix := ""
+
+	for _, r := range strings.ToUpper(chocolatier) {
+		if r >= 'A' && r <= 'Z' && len(prefix) < 2 { prefix += string(r) }
+	}
+
+	for len(prefix) < 2 { prefix += "X" }
+
+	return prefix
+}
+
+//==============================================================================================================================
+//	 derive_id - Returns an unused chocoID for chocolates made by the chocolatier named. Generated policies use the ID derived
+//				 from the transaction; under the legacy policy the next number in the chocolatier's sequence is taken,
+//				 skipping numbers already used by IDs chosen by clients, which serialises auto-creates per chocolatier.
+//				 GS1 identifiers are allocated outside the ledger so can't be derived.
+//==============================================================================================================================
+func (t *SimpleChaincode) derive_id(stub Stub, chocolatier string) (string, error) {
+
+	policy, err := t.get_id_policy(stub)
+															if err != nil { return "", err }
+
+	if policy.Generated { return generate_id(stub), nil }
+
+															if policy.Name != ID_POLICY_LEGACY { return "", errors.New("IDs can't be derived under the " + policy.Name + " policy") }
+
+	prefix := chocolatier_prefix(chocolatier)
+
+	key, err := create_index_key(INDEX_SEQUENCE, prefix)
+															if err != nil { return "", err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return "", errors.New("Error retrieving ID sequence") }
+
+	sequence := 0
+
+	if bytes != nil {
+		sequence, err = strconv.Atoi(string(bytes))
+															if err != nil { return "", errors.New("Corrupt ID sequence for " + prefix) }
+	}
+
+	for {
+		sequence++
+															if sequence > MAX_SEQUENCE { return "", errors.New("No IDs left for prefix " + prefix) }
+
+		chocoID := fmt.Sprintf("%s%07d", prefix, sequence)
+
+		existing, err := stub.GetState(chocoID)
+															if err != nil { return "", errors.New("Error checking chocoID") }
+
+		if existing != nil { continue }
+
+		err = stub.PutState(key, []byte(strconv.Itoa(sequence)))
+															if err != nil { return "", errors.New("Error storing ID sequence") }
+
+		return chocoID, nil
+	}
+}
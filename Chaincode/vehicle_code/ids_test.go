@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIDPolicies(t *testing.T) {
+
+	tests := []struct {
+		policy		string
+		chocoID		string
+		ok			bool
+	}{
+		{ ID_POLICY_LEGACY,	"AB1234567",					true	},
+		{ ID_POLICY_LEGACY,	"ab1234567",					true	},
+		{ ID_POLICY_LEGACY,	"A_1234567",					false	},		// [A-z] used to admit punctuation
+		{ ID_POLICY_LEGACY,	"AB12345678",					false	},		// and the end wasn't anchored
+		{ ID_POLICY_LEGACY,	"AB123456",						false	},
+		{ ID_POLICY_GTIN,	"9506000134352",				true	},		// GTIN-13
+		{ ID_POLICY_GTIN,	"09506000134352",				true	},		// GTIN-14
+		{ ID_POLICY_GTIN,	"9506000134353",				false	},		// Wrong check digit
+		{ ID_POLICY_GTIN,	"950600013435",					false	},
+		{ ID_POLICY_GTIN,	"AB1234567",					false	},
+		{ ID_POLICY_SGTIN,	"010950600013435221ABC-123",	true	},
+		{ ID_POLICY_SGTIN,	"010950600013435321ABC-123",	false	},		// Wrong check digit
+		{ ID_POLICY_SGTIN,	"0109506000134352",				false	},		// No serial
+		{ ID_POLICY_SGTIN,	"010950600013435221" + "123456789012345678901",	false	},		// Serial too long
+		{ ID_POLICY_SGTIN,	"010950600013435221ABC 123",	false	},		// Space isn't in the GS1 character set
+		{ ID_POLICY_TXID,	"CH3F8A1C0D92B4E7F1",			true	},
+		{ ID_POLICY_TXID,	"CH3f8a1c0d92b4e7f1",			false	},
+	}
+
+	for _, test := range tests {
+
+		policy, err := find_id_policy(test.policy)
+		if err != nil { t.Fatal(err) }
+
+		if policy.Validate(test.chocoID) != test.ok { t.Errorf("%s policy, %s: expected ok=%v", test.policy, test.chocoID, test.ok) }
+	}
+
+	if _, err := find_id_policy("isbn"); err == nil { t.Error("expected unknown policy to fail") }
+	if policy, _ := find_id_policy(""); policy.Name != ID_POLICY_LEGACY { t.Errorf("default policy = %s", policy.Name) }
+}
+
+func TestCreateUnderIDPolicy(t *testing.T) {
+
+	t.Run("gtin", func(t *testing.T) {
+
+		l := new_test_ledger(t, "", "", ID_POLICY_GTIN)
+
+		if _, err := l.invoke("durhone", "create_chocolates", "AB1234567"); err == nil { t.Error("expected legacy ID to fail") }
+
+		if _, err := l.invoke("printer", "create_chocolates", "AB1234567"); err == nil || err.Error() != "Permission Denied" { t.Errorf("expected create by printer to be denied before the ID is checked, got %v", err) }
+
+		if id := string(l.must_invoke("durhone", "create_chocolates", "9506000134352")); id != "9506000134352" { t.Errorf("returned ID = %s", id) }
+	})
+
+	t.Run("txid", func(t *testing.T) {
+
+		l := new_test_ledger(t, "", "", ID_POLICY_TXID)
+
+		if _, err := l.invoke("durhone", "create_chocolates", "AB1234567"); err == nil { t.Error("expected client ID to fail") }
+
+		first  := string(l.must_invoke("durhone", "create_chocolates", ""))
+		second := string(l.must_invoke("durhone", "create_chocolates", "", `{"method": "Conched"}`))
+
+		if first == second || !generated_id.MatchString(first) || !generated_id.MatchString(second) { t.Fatalf("generated IDs %s, %s", first, second) }
+
+		if c := l.chocolates(second); c.ChocoID != second || c.Method != "Conched" { t.Errorf("unexpected record %+v", c) }
+		if history, err := l.query("durhone", "get_chocolate_history", first); err != nil || len(history) == 0 { t.Errorf("no history for %s: %v", first, err) }
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.stub.begin(nil)
+
+		if _, err := l.cc.init_chaincode(l.stub, "init", []string{ "localhost:5000", "", "", "isbn" }); err == nil { t.Error("expected unknown policy to fail") }
+	})
+}
+
+func TestCreateChocolatesAuto(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	l.must_invoke("durhone", "create_chocolates", "DU0000002")							// Taken by a client before the sequence reaches it
+
+	ids := []string{
+		string(l.must_invoke("durhone", "create_chocolates_auto")),
+		string(l.must_invoke("durhone2", "create_chocolates_auto", `{"ingredients": ["cocoa"]}`)),
+		string(l.must_invoke("durhone", "create_chocolates_auto", `{"chocolatier": "Maison Cailler"}`)),
+		string(l.must_invoke("durhone", "create_chocolates_auto", `{"chocolatier": "7"}`)),
+	}
+
+	want := []string{ "DU0000001", "DU0000003", "MA0000001", "XX0000001" }
+
+	for i := range want {
+		if ids[i] != want[i] { t.Errorf("ID %d = %s, want %s", i, ids[i], want[i]) }
+	}
+
+	if c := l.chocolates("DU0000003"); c.Owner != "durhone2" || len(c.Ingredients) != 1 { t.Errorf("unexpected record %+v", c) }
+	if l.stub.event_name != EVENT_CREATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_CREATED) }
+
+	if _, err := l.invoke("printer", "create_chocolates_auto"); err == nil { t.Error("expected create by printer to fail") }
+	if _, err := l.invoke("durhone", "create_chocolates_auto", `{"chocolatier": ""}`); err == nil { t.Error("expected invalid attributes to fail") }
+	if _, err := l.invoke("durhone", "create_chocolates_auto", "{}", "{}"); err == nil { t.Error("expected extra argument to fail") }
+
+	if id := string(l.must_invoke("durhone", "create_chocolates_auto")); id != "DU0000004" { t.Errorf("failed creates advanced the sequence, got %s", id) }
+
+	t.Run("txid", func(t *testing.T) {
+
+		l := new_test_ledger(t, "", "", ID_POLICY_TXID)
+
+		if id := string(l.must_invoke("durhone", "create_chocolates_auto")); !generated_id.MatchString(id) { t.Errorf("generated ID = %s", id) }
+	})
+
+	t.Run("gtin", func(t *testing.T) {
+
+		l := new_test_ledger(t, "", "", ID_POLICY_GTIN)
+
+		if _, err := l.invoke("durhone", "create_chocolates_auto"); err == nil { t.Error("expected derived GTIN to fail") }
+	})
+}
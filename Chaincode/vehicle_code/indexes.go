@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Index names - Each chocolates record is indexed by the values below. An index entry is a key of its own in the world
+//				   state so that creating or updating one record never contends with another.
+//==============================================================================================================================
+const   INDEX_STATUS				= "status"
+const   INDEX_OWNER					= "owner"
+const   INDEX_CUSTODIAN				= "custodian"
+const   INDEX_CHOCOLATIER			= "chocolatier"
+
+//==============================================================================================================================
+//	 Key separators - Index keys are made up of the index name and its attributes each preceded by KEY_SEPARATOR. No printable
+//					  character sorts below it so a range query on a prefix can't pick up keys from a neighbouring value.
+//					  KEY_MAX sorts above every valid key and closes off a range.
+//==============================================================================================================================
+const   KEY_SEPARATOR				= "\x00"
+const   KEY_MAX						= "\U0010FFFF"
+
+const   INDEX_VALUE					= "\x00"		// Index entries carry no data, but an empty value would delete the key
+
+//==============================================================================================================================
+//	 create_index_key - Builds the key for an entry in the index named from the attributes passed e.g. the status index
+//						entry for chocoID AB1234567 in state 2 is \x00status\x002\x00AB1234567.
+//==============================================================================================================================
+func create_index_key(index string, attributes ...string) (string, error) {
+
+	key := KEY_SEPARATOR + index
+
+	for _, attribute := range attributes {
+															if strings.Contains(attribute, KEY_SEPARATOR) { return "", errors.New("Index attribute contains an invalid character") }
+		key += KEY_SEPARATOR + attribute
+	}
+
+	return key, nil
+}
+
+//==============================================================================================================================
+//	 split_index_key - Returns the attributes that make up the index key passed, minus the index name.
+//==============================================================================================================================
+func split_index_key(key string) []string {
+
+	parts := strings.Split(key, KEY_SEPARATOR)
+
+	if len(parts) < 2 { return nil }
+
+	return parts[2:]
+}
+
+//==============================================================================================================================
+//	 index_entries - Returns the keys of every index entry for the chocolates passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) index_entries(c Chocolates) ([]string, error) {
+
+	var keys []string
+
+	entries := [][]string{
+		{ INDEX_STATUS,			strconv.Itoa(c.Status),		c.ChocoID },
+		{ INDEX_OWNER,			c.Owner,					c.ChocoID },
+		{ INDEX_CUSTODIAN,		c.Custodian,				c.ChocoID },
+		{ INDEX_CHOCOLATIER,	c.Chocolatier,				c.ChocoID },
+	}
+
+	for _, usage := range c.Lots { entries = append(entries, []string{ INDEX_LOT, usage.LotID, c.ChocoID }) }
+
+	for _, entry := range entries {
+
+		key, err := create_index_key(entry[0], entry[1:]...)
+															if err != nil { return nil, err }
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+//==============================================================================================================================
+//	 update_indexes - Brings the index entries in line with the new state of the chocolates. Entries belonging to the
+//					  previous state that no longer apply are deleted. previous is nil for newly created chocolates.
+//==============================================================================================================================
+func (t *SimpleChaincode) update_indexes(stub Stub, previous *Chocolates, c Chocolates) error {
+
+	keys, err := t.index_entries(c)
+															if err != nil { return err }
+
+	current := map[string]bool{}
+
+	for _, key := range keys { current[key] = true }
+
+	if previous != nil {
+
+		old_keys, err := t.index_entries(*previous)
+															if err != nil { return err }
+
+		for _, key := range old_keys {
+
+			if current[key] { continue }
+
+			err = stub.DelState(key)
+															if err != nil { fmt.Printf("UPDATE_INDEXES: Error removing index entry: %s", err); return errors.New("Error removing index entry") }
+		}
+	}
+
+	for _, key := range keys {
+
+		err = stub.PutState(key, []byte(INDEX_VALUE))
+															if err != nil { fmt.Printf("UPDATE_INDEXES: Error storing index entry: %s", err); return errors.New("Error storing index entry") }
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 get_indexed_ids - Returns the chocoIDs held in the index named under the attributes passed, in key order. Passing fewer
+//					   attributes widens the search e.g. the status index with no attributes returns every chocoID.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_indexed_ids(stub Stub, index string, attributes ...string) ([]string, error) {
+
+	prefix, err := create_index_key(index, attributes...)
+															if err != nil { return nil, err }
+
+	iter, err := stub.RangeQueryState(prefix + KEY_SEPARATOR, prefix + KEY_SEPARATOR + KEY_MAX)
+															if err != nil { fmt.Printf("GET_INDEXED_IDS: Error querying index: %s", err); return nil, errors.New("Error querying index " + index) }
+	defer iter.Close()
+
+	var ids []string
+
+	for iter.HasNext() {
+
+		key, _, err := iter.Next()
+															if err != nil { fmt.Printf("GET_INDEXED_IDS: Error reading index: %s", err); return nil, errors.New("Error reading index " + index) }
+
+		parts := split_index_key(key)
+
+		if len(parts) == 0 { continue }
+
+		ids = append(ids, parts[len(parts)-1])		// The chocoID is always the last attribute of an index entry
+	}
+
+	return ids, nil
+}
+
+//==============================================================================================================================
+//	 migrate_chocoIDs - Converts the chocoIDs array written by earlier versions of the chaincode into index entries. At most
+//						batch_size IDs are migrated per invoke so large arrays can be converted over several transactions;
+//						the IDs left over are written back and the array is deleted once it is empty. Returns the number of
+//						IDs still to be migrated.
+//==============================================================================================================================
+func (t *SimpleChaincode) migrate_chocoIDs(stub Stub, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if caller_affiliation != DU_RHONE {
+															return nil, errors.New("Permission Denied")
+	}
+
+	batch_size := 0												// 0 means migrate everything in one go
+
+	if len(args) > 0 {
+
+		size, err := strconv.Atoi(args[0])
+															if err != nil || size < 0 { return nil, errors.New("Invalid batch size") }
+		batch_size = size
+	}
+
+	bytes, err := stub.GetState("chocoIDs")
+															if err != nil { return nil, errors.New("Unable to get chocoIDs") }
+
+	if bytes == nil { return []byte("0"), nil }					// Nothing left to migrate
+
+	var chocoIDs Choco_Holder
+
+	err = json.Unmarshal(bytes, &chocoIDs)
+															if err != nil { return nil, errors.New("Corrupt Choco_Holder record") }
+
+	batch := chocoIDs.ChocoIDs
+
+	if batch_size > 0 && batch_size < len(batch) { batch = batch[:batch_size] }
+
+	for _, chocoID := range batch {
+
+		c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { fmt.Printf("MIGRATE_CHOCOIDS: Error retrieving %s: %s", chocoID, err); return nil, errors.New("Error retrieving chocoID " + chocoID) }
+
+		err = t.update_indexes(stub, nil, c)
+															if err != nil { return nil, err }
+	}
+
+	chocoIDs.ChocoIDs = chocoIDs.ChocoIDs[len(batch):]
+
+	if len(chocoIDs.ChocoIDs) == 0 {
+
+		err = stub.DelState("chocoIDs")
+															if err != nil { return nil, errors.New("Unable to remove chocoIDs") }
+	} else {
+
+		bytes, err = json.Marshal(chocoIDs)
+															if err != nil { return nil, errors.New("Error creating Choco_Holder record") }
+
+		err = stub.PutState("chocoIDs", bytes)
+															if err != nil { return nil, errors.New("Unable to put the state") }
+	}
+
+	return []byte(strconv.Itoa(len(chocoIDs.ChocoIDs))), nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"regexp"
+)
+
+//==============================================================================================================================
+//	 Lot keys - Ingredient lots are stored under \x00ingredient_lot\x00<lotID>. The lot index, \x00lot\x00<lotID>\x00<chocoID>,
+//				records the chocolates each lot was used in.
+//==============================================================================================================================
+const   INDEX_INGREDIENT_LOT		= "ingredient_lot"
+const   INDEX_LOT					= "lot"
+
+var lot_id = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._\-]{0,63}$`)
+
+//==============================================================================================================================
+//	Ingredient_Lot - Defines the structure for a lot of a single ingredient delivered by a supplier. Quantity is what was
+//					 harvested in Unit and Remaining what has not yet been used in chocolates.
+//==============================================================================================================================
+type Ingredient_Lot struct {
+	LotID			string				`json:"lotID"`
+	Ingredient		string				`json:"ingredient"`
+	OriginCountry	string				`json:"originCountry"`
+	OriginFarm		string				`json:"originFarm"`
+	Supplier		string				`json:"supplier"`
+	HarvestDate		string				`json:"harvestDate"`
+	Quantity		int					`json:"quantity"`
+	Remaining		int					`json:"remaining"`
+	Unit			string				`json:"unit"`
+	Certificates	[]Lot_Certificate	`json:"certificates"`
+	DateCreated		string				`json:"dateCreated"`
+}
+
+//==============================================================================================================================
+//	Lot_Certificate - A certificate covering a lot e.g. {"type": "Fairtrade", "issuer": "FLOCERT", "reference": "FT-1234"}
+//==============================================================================================================================
+type Lot_Certificate struct {
+	Type			string				`json:"type"`
+	Issuer			string				`json:"issuer"`
+	Reference		string				`json:"reference"`
+}
+
+//==============================================================================================================================
+//	Lot_Usage - Records the quantity of a lot, in the lot's unit, that went into a chocolates record.
+//==============================================================================================================================
+type Lot_Usage struct {
+	LotID			string				`json:"lotID"`
+	Quantity		int					`json:"quantity"`
+}
+
+//==============================================================================================================================
+//	Provenance - Defines the structure returned by get_provenance: every lot used in the chocolates and how much of it.
+//==============================================================================================================================
+type Provenance struct {
+	ChocoID			string				`json:"chocoID"`
+	Lots			[]Provenance_Lot	`json:"lots"`
+}
+
+type Provenance_Lot struct {
+	Lot				Ingredient_Lot		`json:"lot"`
+	Quantity		int					`json:"quantity"`
+}
+
+//==============================================================================================================================
+//	 lot_schema - The fields accepted by create_ingredient_lot, keyed by JSON name, and whether each is required.
+//==============================================================================================================================
+var lot_schema = map[string]struct {
+	Required		bool
+	Parse			func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string
+}{
+	"lotID":			{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_lot_id(raw, &lot.LotID) } },
+	"ingredient":		{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_text(raw, &lot.Ingredient) } },
+	"originCountry":	{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_text(raw, &lot.OriginCountry) } },
+	"originFarm":		{ false,	func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_text(raw, &lot.OriginFarm) } },
+	"harvestDate":		{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return t.parse_date(raw, &lot.HarvestDate) } },
+	"quantity":			{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_quantity(raw, &lot.Quantity) } },
+	"unit":				{ true,		func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_text(raw, &lot.Unit) } },
+	"certificates":		{ false,	func(t *SimpleChaincode, raw json.RawMessage, lot *Ingredient_Lot) string { return parse_certificates(raw, &lot.Certificates) } },
+}
+
+//==============================================================================================================================
+//	 parse_lot - Validates the JSON object passed against the lot schema, returning a Validation_Error listing every field
+//				 that is invalid or missing.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_lot(value string) (Ingredient_Lot, error) {
+
+	lot := Ingredient_Lot{ Certificates: []Lot_Certificate{} }
+
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(value), &fields)
+															if err != nil || fields == nil { return lot, &Validation_Error{ []Field_Error{ { "lot", "must be a JSON object" } } } }
+
+	names := []string{}
+
+	for name := range fields		{ names = append(names, name) }
+	for name := range lot_schema	{ if _, ok := fields[name]; !ok { names = append(names, name) } }
+
+	sort.Strings(names)
+
+	invalid := &Validation_Error{}
+
+	for _, name := range names {
+
+		field, known := lot_schema[name]
+		raw, passed  := fields[name]
+
+		if !known					{ invalid.add(name, "unknown field"); continue }
+		if !passed					{ if field.Required { invalid.add(name, "is required") }; continue }
+
+		if message := field.Parse(t, raw, &lot); message != "" { invalid.add(name, message) }
+	}
+
+	if len(invalid.Fields) > 0 { return lot, invalid }
+
+	return lot, nil
+}
+
+//==============================================================================================================================
+//	 parse_lot_id - Reads a lot ID of letters, digits, dots, dashes and underscores.
+//==============================================================================================================================
+func parse_lot_id(raw json.RawMessage, value *string) string {
+
+	if message := parse_text(raw, value); message != "" { return message }
+
+	if !lot_id.MatchString(*value) { return "must be up to 64 letters, digits, dots, dashes or underscores" }
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 parse_quantity - Reads a whole quantity greater than zero.
+//==============================================================================================================================
+func parse_quantity(raw json.RawMessage, value *int) string {
+
+	err := json.Unmarshal(raw, value)
+															if err != nil || *value <= 0 { return "must be a whole number greater than zero" }
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 parse_certificates - Reads a list of certificates, each of which must name its type, issuer and reference.
+//==============================================================================================================================
+func parse_certificates(raw json.RawMessage, certificates *[]Lot_Certificate) string {
+
+	err := json.Unmarshal(raw, certificates)
+															if err != nil || *certificates == nil { return "must be an array of certificates" }
+															if len(*certificates) > MAX_LIST_LENGTH { return "must have at most " + strconv.Itoa(MAX_LIST_LENGTH) + " entries" }
+
+	for _, certificate := range *certificates {
+
+		if strings.TrimSpace(certificate.Type)      == "" ||
+		   strings.TrimSpace(certificate.Issuer)    == "" ||
+		   strings.TrimSpace(certificate.Reference) == "" {
+															return "entries must have a type, issuer and reference"
+		}
+	}
+
+	return ""
+}
+
+//==============================================================================================================================
+//	 retrieve_lot - Returns the ingredient lot with the ID passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_lot(stub Stub, lotID string) (Ingredient_Lot, error) {
+
+	var lot Ingredient_Lot
+
+	key, err := create_index_key(INDEX_INGREDIENT_LOT, lotID)
+															if err != nil { return lot, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return lot, errors.New("Error retrieving ingredient lot " + lotID) }
+															if bytes == nil { return lot, errors.New("Ingredient lot not found: " + lotID) }
+
+	err = json.Unmarshal(bytes, &lot)
+															if err != nil { return lot, errors.New("Corrupt ingredient lot " + lotID) }
+
+	return lot, nil
+}
+
+//==============================================================================================================================
+//	 save_lot - Writes the ingredient lot passed to the world state.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_lot(stub Stub, lot Ingredient_Lot) error {
+
+	key, err := create_index_key(INDEX_INGREDIENT_LOT, lot.LotID)
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(lot)
+															if err != nil { return errors.New("Error converting ingredient lot") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_LOT: Error storing ingredient lot: %s", err); return errors.New("Error storing ingredient lot") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 create_ingredient_lot - Records a new lot delivered by the calling supplier. Lot IDs must be unique.
+//==============================================================================================================================
+func (t *SimpleChaincode) create_ingredient_lot(stub Stub, caller string, caller_affiliation int, lot_json string) ([]byte, error) {
+
+															if caller_affiliation != SUPPLIER { return nil, errors.New("Permission denied") }
+
+	lot, err := t.parse_lot(lot_json)
+															if err != nil { return nil, err }
+
+	key, err := create_index_key(INDEX_INGREDIENT_LOT, lot.LotID)
+															if err != nil { return nil, err }
+
+	existing, err := stub.GetState(key)
+															if err != nil { return nil, errors.New("Error checking lot ID") }
+															if existing != nil { return nil, errors.New("Ingredient lot already exists: " + lot.LotID) }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, err }
+
+	lot.Supplier    = caller
+	lot.Remaining   = lot.Quantity
+	lot.DateCreated = date
+
+	err = t.save_lot(stub, lot)
+															if err != nil { return nil, err }
+
+	return []byte(lot.LotID), nil
+}
+
+//=================================================================================================================================
+//	 use_ingredient_lot - Records that a quantity of one of the supplier's lots has gone into the chocolates. The quantity
+//						  is taken off what remains of the lot. A lot used more than once is recorded once with the total.
+//=================================================================================================================================
+func (t *SimpleChaincode) use_ingredient_lot(stub Stub, c Chocolates, caller string, caller_affiliation int, lotID string, quantity_value string) ([]byte, error) {
+
+	quantity, err := strconv.Atoi(quantity_value)
+															if err != nil || quantity <= 0 { return nil, errors.New("Invalid value passed for quantity") }
+
+	lot, err := t.retrieve_lot(stub, lotID)
+															if err != nil { return nil, err }
+
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			lot.Supplier		== caller				&&
+			c.Delivered			== false				{
+
+															if quantity > lot.Remaining { return nil, errors.New("Not enough of lot " + lotID + " remaining, " + strconv.Itoa(lot.Remaining) + " " + lot.Unit) }
+
+					lot.Remaining -= quantity
+	} else {
+
+															return nil, errors.New("Permission denied")
+	}
+
+	used := false
+
+	for i := range c.Lots {
+		if c.Lots[i].LotID == lotID { c.Lots[i].Quantity += quantity; used = true }
+	}
+
+	if !used { c.Lots = append(c.Lots, Lot_Usage{ LotID: lotID, Quantity: quantity }) }
+
+	err = t.save_lot(stub, lot)
+															if err != nil { return nil, err }
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("USE_INGREDIENT_LOT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 get_ingredient_lot - Returns the ingredient lot with the ID passed. Lots are visible to every participant.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_ingredient_lot(stub Stub, lotID string) ([]byte, error) {
+
+	lot, err := t.retrieve_lot(stub, lotID)
+															if err != nil { return nil, err }
+
+	return json.Marshal(lot)
+}
+
+//==============================================================================================================================
+//	 get_provenance - Walks from the chocolates back to every lot that went into them. Visible to those who can see the
+//					  chocolates' details.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_provenance(stub Stub, caller string, caller_affiliation int, chocoID string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	provenance := Provenance{ ChocoID: c.ChocoID, Lots: []Provenance_Lot{} }
+
+	for _, usage := range c.Lots {
+
+		lot, err := t.retrieve_lot(stub, usage.LotID)
+															if err != nil { return nil, err }
+
+		provenance.Lots = append(provenance.Lots, Provenance_Lot{ Lot: lot, Quantity: usage.Quantity })
+	}
+
+	return json.Marshal(provenance)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const test_lot = `{"lotID": "GH-2016-001", "ingredient": "cocoa", "originCountry": "Ghana", "originFarm": "Asante Cooperative",
+	"harvestDate": "2016-03-14", "quantity": 1000, "unit": "kg", "certificates": [{"type": "Fairtrade", "issuer": "FLOCERT", "reference": "FT-1234"}]}`
+
+func TestCreateIngredientLot(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	if _, err := l.invoke("durhone", "create_ingredient_lot", test_lot); err == nil { t.Error("expected create by du rhone to fail") }
+
+	if id := string(l.must_invoke("supplier", "create_ingredient_lot", test_lot)); id != "GH-2016-001" { t.Errorf("returned ID = %s", id) }
+
+	if _, err := l.invoke("supplier", "create_ingredient_lot", test_lot); err == nil { t.Error("expected duplicate lot to fail") }
+
+	var lot Ingredient_Lot
+	json.Unmarshal(l.must_query("ibm", "get_ingredient_lot", "GH-2016-001"), &lot)
+
+	if lot.Supplier != "supplier" || lot.Remaining != 1000 || lot.DateCreated == "" || len(lot.Certificates) != 1 || lot.OriginFarm != "Asante Cooperative" {
+		t.Errorf("unexpected lot %+v", lot)
+	}
+
+	tests := map[string][]Field_Error{
+		`"lot"`:	{ { "lot", "must be a JSON object" } },
+		`{"lotID": "HZ 1", "ingredient": "hazelnut", "originCountry": "Turkey", "harvestDate": "2016-09-01", "quantity": 0, "unit": "kg", "colour": "brown"}`:
+					{ { "colour", "unknown field" }, { "lotID", "must be up to 64 letters, digits, dots, dashes or underscores" }, { "quantity", "must be a whole number greater than zero" } },
+		`{"lotID": "HZ-1", "ingredient": "hazelnut"}`:
+					{ { "harvestDate", "is required" }, { "originCountry", "is required" }, { "quantity", "is required" }, { "unit", "is required" } },
+		`{"lotID": "HZ-1", "ingredient": "hazelnut", "originCountry": "Turkey", "harvestDate": "2016-09-01", "quantity": 5, "unit": "kg", "certificates": [{"type": "Organic"}]}`:
+					{ { "certificates", "entries must have a type, issuer and reference" } },
+	}
+
+	for lot_json, want := range tests {
+
+		_, err := l.invoke("supplier", "create_ingredient_lot", lot_json)
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected Validation_Error, got %v", lot_json, err); continue }
+
+		got, _    := json.Marshal(invalid.Fields)
+		wanted, _ := json.Marshal(want)
+
+		if string(got) != string(wanted) { t.Errorf("%s: fields = %s, want %s", lot_json, got, wanted) }
+	}
+
+	if _, err := l.query("ibm", "get_ingredient_lot", "HZ-1"); err == nil { t.Error("expected missing lot to fail") }
+}
+
+func TestUseIngredientLot(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.ecerts.register("supplier2", "supplier2\\group1\\3")
+
+	l.must_invoke("supplier", "create_ingredient_lot", test_lot)
+	l.must_invoke("supplier2", "create_ingredient_lot", `{"lotID": "TR-7", "ingredient": "hazelnut", "originCountry": "Turkey", "harvestDate": "2016-09-01", "quantity": 50, "unit": "kg"}`)
+
+	l.must_invoke("durhone", "create_chocolates", "AA0000001")
+
+	if _, err := l.invoke("supplier", "use_ingredient_lot", "GH-2016-001", "10", "AA0000001"); err == nil { t.Error("expected use before supplying to fail") }
+
+	l.advance("AB1234567", STATE_SUPPLYING)
+
+	l.must_invoke("supplier", "use_ingredient_lot", "GH-2016-001", "300", "AB1234567")
+	l.must_invoke("supplier", "use_ingredient_lot", "GH-2016-001", "200", "AB1234567")
+
+	if l.stub.event_name != EVENT_UPDATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_UPDATED) }
+
+	invalid := [][]string{
+		{ "supplier",	"GH-2016-001",	"501",	"AB1234567" },		// More than remains
+		{ "supplier",	"GH-2016-001",	"-1",	"AB1234567" },
+		{ "supplier",	"GH-2016-001",	"ten",	"AB1234567" },
+		{ "supplier",	"TR-7",			"5",	"AB1234567" },		// Another supplier's lot
+		{ "supplier",	"XX-1",			"5",	"AB1234567" },
+		{ "durhone",	"GH-2016-001",	"5",	"AB1234567" },
+	}
+
+	for _, args := range invalid {
+		if _, err := l.invoke(args[0], "use_ingredient_lot", args[1:]...); err == nil { t.Errorf("expected %v to fail", args) }
+	}
+
+	if c := l.chocolates("AB1234567"); len(c.Lots) != 1 || c.Lots[0].Quantity != 500 { t.Errorf("lots = %+v", c.Lots) }
+
+	var lot Ingredient_Lot
+	json.Unmarshal(l.must_query("supplier", "get_ingredient_lot", "GH-2016-001"), &lot)
+
+	if lot.Remaining != 500 { t.Errorf("remaining = %d, want 500", lot.Remaining) }
+
+	var provenance Provenance
+	json.Unmarshal(l.must_query("durhone", "get_provenance", "AB1234567"), &provenance)
+
+	if len(provenance.Lots) != 1 || provenance.Lots[0].Quantity != 500 || provenance.Lots[0].Lot.OriginFarm != "Asante Cooperative" {
+		t.Errorf("unexpected provenance %+v", provenance)
+	}
+
+	if _, err := l.query("printer", "get_provenance", "AB1234567"); err == nil { t.Error("expected provenance query by printer to fail") }
+
+	var used []Chocolates
+	json.Unmarshal(l.must_query("durhone", "get_chocos_by", INDEX_LOT, "GH-2016-001"), &used)
+
+	if len(used) != 1 || used[0].ChocoID != "AB1234567" { t.Errorf("chocolates by lot = %+v", used) }
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+)
+
+//==============================================================================================================================
+//	Mock_Stub - An in-memory implementation of Stub. Each call to begin starts a new transaction with its own ID, timestamp
+//				and caller; rollback discards every write made since, as the peer does when an invoke fails.
+//==============================================================================================================================
+type Mock_Stub struct {
+	state			map[string][]byte
+	snapshot		map[string][]byte
+	caller			[]byte
+	attributes		map[string]string
+	tx_count		int
+	tx_time			time.Time
+	event_name		string
+	event_payload	[]byte
+}
+
+func new_mock_stub() *Mock_Stub {
+
+	return &Mock_Stub{
+		state:		map[string][]byte{},
+		tx_time:	time.Date(2016, time.August, 1, 9, 0, 0, 0, time.UTC),
+	}
+}
+
+func (s *Mock_Stub) begin(caller []byte) {
+
+	s.tx_count++
+	s.tx_time = s.tx_time.Add(time.Hour)
+	s.caller = caller
+	s.event_name = ""
+	s.event_payload = nil
+
+	s.snapshot = map[string][]byte{}
+	for key, value := range s.state { s.snapshot[key] = value }
+}
+
+func (s *Mock_Stub) rollback() {
+
+	s.state = s.snapshot
+	s.event_name = ""
+	s.event_payload = nil
+}
+
+func (s *Mock_Stub) GetState(key string) ([]byte, error) {
+
+	value, ok := s.state[key]
+
+	if !ok { return nil, nil }
+
+	return append([]byte(nil), value...), nil
+}
+
+func (s *Mock_Stub) PutState(key string, value []byte) error {
+
+	if len(value) == 0 { return errors.New("Empty value for key " + key) }
+
+	s.state[key] = append([]byte(nil), value...)
+
+	return nil
+}
+
+func (s *Mock_Stub) DelState(key string) error {
+
+	delete(s.state, key)
+
+	return nil
+}
+
+func (s *Mock_Stub) RangeQueryState(startKey string, endKey string) (State_Iterator, error) {
+
+	iter := &Mock_Iterator{}
+
+	for key := range s.state {
+		if key >= startKey && key <= endKey { iter.keys = append(iter.keys, key) }
+	}
+
+	sort.Strings(iter.keys)
+
+	for _, key := range iter.keys { iter.values = append(iter.values, s.state[key]) }
+
+	return iter, nil
+}
+
+func (s *Mock_Stub) GetCallerCertificate() ([]byte, error) {
+
+	if s.caller == nil { return nil, errors.New("No caller certificate") }
+
+	return s.caller, nil
+}
+
+func (s *Mock_Stub) ReadCertAttribute(attributeName string) ([]byte, error) {
+
+	value, ok := s.attributes[attributeName]
+
+	if !ok { return nil, errors.New("Attribute not found: " + attributeName) }
+
+	return []byte(value), nil
+}
+
+func (s *Mock_Stub) GetTxID() string {
+
+	return fmt.Sprintf("tx-%06d", s.tx_count)
+}
+
+func (s *Mock_Stub) GetTxTime() (time.Time, error) {
+
+	return s.tx_time, nil
+}
+
+func (s *Mock_Stub) SetEvent(name string, payload []byte) error {
+
+	s.event_name = name
+	s.event_payload = payload
+
+	return nil
+}
+
+//==============================================================================================================================
+//	Mock_Iterator - Iterates over a copy of the keys matched by Mock_Stub.RangeQueryState.
+//==============================================================================================================================
+type Mock_Iterator struct {
+	keys			[]string
+	values			[][]byte
+	position		int
+}
+
+func (i *Mock_Iterator) HasNext() bool { return i.position < len(i.keys) }
+
+func (i *Mock_Iterator) Next() (string, []byte, error) {
+
+	if !i.HasNext() { return "", nil, errors.New("No more keys") }
+
+	i.position++
+
+	return i.keys[i.position-1], i.values[i.position-1], nil
+}
+
+func (i *Mock_Iterator) Close() error { return nil }
+
+//==============================================================================================================================
+//	Mock_ECerts - A fake ECert_Source. Users are registered with an affiliation and are given a self-signed certificate
+//				  following the name\group\affiliation common name convention of the membership service.
+//==============================================================================================================================
+type Mock_ECerts struct {
+	certs			map[string][]byte
+	callers			map[string][]byte
+}
+
+func new_mock_ecerts() *Mock_ECerts {
+
+	return &Mock_ECerts{ certs: map[string][]byte{}, callers: map[string][]byte{} }
+}
+
+func (m *Mock_ECerts) register(name string, common_name string) {
+
+	m.certs[name]   = create_certificate(common_name)
+	m.callers[name] = create_certificate(name)
+}
+
+func (m *Mock_ECerts) get_ecert(stub Stub, name string) ([]byte, error) {
+
+	der, ok := m.certs[name]
+
+	if !ok { return nil, errors.New("Could not retrieve ecert for user: " + name) }
+
+	encoded := pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der })
+
+	return []byte(url.QueryEscape(string(encoded))), nil		// The REST API returns the ecert url encoded
+}
+
+//==============================================================================================================================
+//	 create_certificate - Returns a DER encoded self-signed certificate with the common name passed.
+//==============================================================================================================================
+func create_certificate(common_name string) []byte {
+
+	return create_certificate_with(common_name, nil)
+}
+
+func create_certificate_with(common_name string, extensions []pkix.Extension) []byte {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil { panic(err) }
+
+	template := x509.Certificate{
+		SerialNumber:	big.NewInt(1),
+		Subject:		pkix.Name{ CommonName: common_name },
+		NotBefore:		time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:		time.Date(2036, time.January, 1, 0, 0, 0, 0, time.UTC),
+		ExtraExtensions:	extensions,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil { panic(err) }
+
+	return der
+}
+
+//==============================================================================================================================
+//	 role_extension - Returns a role extension holding the attributes JSON passed.
+//==============================================================================================================================
+func role_extension(attributes string) []pkix.Extension {
+
+	return []pkix.Extension{ { Id: ROLE_EXTENSION_OID, Value: []byte(attributes) } }
+}
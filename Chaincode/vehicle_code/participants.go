@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Registry index - Participants are stored under \x00participant\x00<username>
+//==============================================================================================================================
+const   INDEX_PARTICIPANT			= "participant"
+
+//==============================================================================================================================
+//	 Registry administrator - Participants with this role can register, deactivate and change the role of other participants
+//							  but not appoint or remove the dispute arbiter, who is agreed by every party and registered
+//							  when the chaincode is deployed.
+//==============================================================================================================================
+const   REGISTRY_ADMIN				= DU_RHONE
+
+//==============================================================================================================================
+//	 role_names - The names that can be used in place of a participant type's number when registering a participant or
+//				  changing their role.
+//==============================================================================================================================
+var role_names = map[string]int{
+	"DU_RHONE":		DU_RHONE,
+	"PRINTER":		PRINTER,
+	"SUPPLIER":		SUPPLIER,
+	"SHIPPING_CO":	SHIPPING_CO,
+	"IBM":			IBM,
+	"ARBITER":		ARBITER,
+	"REGULATOR":	REGULATOR,
+}
+
+//==============================================================================================================================
+//	Participant - Defines the structure for a participant held in the on-ledger registry. Role is one of the participant
+//				  types and takes precedence over the affiliation the Identity_Resolver finds for the participant.
+//==============================================================================================================================
+type Participant struct {
+	Username			string			`json:"username"`
+	DisplayName			string			`json:"displayName"`
+	Organisation		string			`json:"organisation"`
+	Role				int				`json:"role"`
+	Active				bool			`json:"active"`
+	RegistrationDate	string			`json:"registrationDate"`
+}
+
+//==============================================================================================================================
+//	 parse_role - Converts a participant type passed as a number or by name into its number.
+//==============================================================================================================================
+func parse_role(value string) (int, error) {
+
+	role, ok := role_names[strings.ToUpper(strings.TrimSpace(value))]
+
+	if !ok {
+		var err error
+
+		role, err = strconv.Atoi(strings.TrimSpace(value))
+															if err != nil { return -1, &Unknown_Role_Error{ value } }
+	}
+
+	if !is_role(role) { return -1, &Unknown_Role_Error{ value } }
+
+	return role, nil
+}
+
+//==============================================================================================================================
+//	 is_role - Returns true if the value passed is one of the participant types.
+//==============================================================================================================================
+func is_role(role int) bool {
+
+	for _, r := range role_names {
+		if r == role { return true }
+	}
+
+	return false
+}
+
+//==============================================================================================================================
+//	 find_participant - Returns the participant registered with the username passed and whether they were found.
+//==============================================================================================================================
+func find_participant(stub Stub, username string) (Participant, bool, error) {
+
+	var p Participant
+
+	key, err := create_index_key(INDEX_PARTICIPANT, username)
+															if err != nil { return p, false, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return p, false, errors.New("Error retrieving participant " + username) }
+															if bytes == nil { return p, false, nil }
+
+	err = json.Unmarshal(bytes, &p)
+															if err != nil { return p, false, errors.New("Corrupt participant record " + username) }
+
+	return p, true, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_participant - Returns the active participant registered with the username passed.
+//==============================================================================================================================
+func retrieve_participant(stub Stub, username string) (Participant, error) {
+
+	p, found, err := find_participant(stub, username)
+															if err != nil { return p, err }
+															if !found { return p, errors.New("Participant not registered: " + username) }
+															if !p.Active { return p, errors.New("Participant deactivated: " + username) }
+
+	return p, nil
+}
+
+//==============================================================================================================================
+//	 save_participant - Writes the participant passed to the registry.
+//==============================================================================================================================
+func save_participant(stub Stub, p Participant) error {
+
+	key, err := create_index_key(INDEX_PARTICIPANT, p.Username)
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(p)
+															if err != nil { return errors.New("Error converting participant record") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_PARTICIPANT: Error storing participant: %s", err); return errors.New("Error storing participant record") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 apply_registry - Checks the affiliation an Identity_Resolver found for a participant against the registry. Registered
+//					  participants must be active and have the role recorded for them; participants that were never
+//					  registered keep the affiliation that was found.
+//==============================================================================================================================
+func apply_registry(stub Stub, username string, affiliation int) (int, error) {
+
+	p, found, err := find_participant(stub, username)
+															if err != nil { return -1, err }
+															if !found { return affiliation, nil }
+															if !p.Active { return -1, errors.New("Participant deactivated: " + username) }
+
+	return p.Role, nil
+}
+
+//==============================================================================================================================
+//	 register_participant - Adds the participant passed as JSON to the registry. Only the registry administrator can
+//							register participants, a username can only be registered once and the arbiter can only be
+//							registered when the chaincode is deployed.
+//==============================================================================================================================
+func (t *SimpleChaincode) register_participant(stub Stub, caller string, caller_affiliation int, participant_json string) ([]byte, error) {
+
+															if caller_affiliation != REGISTRY_ADMIN { return nil, errors.New("Permission denied") }
+
+	var p Participant
+
+	err := json.Unmarshal([]byte(participant_json), &p)
+															if err != nil { return nil, errors.New("Invalid participant") }
+
+	p.Username = strings.TrimSpace(p.Username)
+															if p.Username == "" { return nil, errors.New("Invalid participant: username is required") }
+															if !is_role(p.Role) { return nil, errors.New("Invalid participant: unknown role " + strconv.Itoa(p.Role)) }
+															if p.Role == DISPUTE_ARBITER { return nil, errors.New("Invalid participant: the arbiter can only be registered when the chaincode is deployed") }
+
+	_, found, err := find_participant(stub, p.Username)
+															if err != nil { return nil, err }
+															if found { return nil, errors.New("Participant already registered: " + p.Username) }
+
+	return nil, t.enrol_participant(stub, p)
+}
+
+//==============================================================================================================================
+//	 enrol_participant - Marks the participant passed as active from the transaction's date and saves them.
+//==============================================================================================================================
+func (t *SimpleChaincode) enrol_participant(stub Stub, p Participant) error {
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return err }
+
+	p.Active           = true
+	p.RegistrationDate = date
+
+	return save_participant(stub, p)
+}
+
+//==============================================================================================================================
+//	 deactivate_participant - Stops the participant named from taking part. Their record is kept so the participant still
+//							  shows in the registry and can't be registered again under the same username. The arbiter
+//							  can't be deactivated, as no other participant could be appointed in their place.
+//==============================================================================================================================
+func (t *SimpleChaincode) deactivate_participant(stub Stub, caller string, caller_affiliation int, username string) ([]byte, error) {
+
+															if caller_affiliation != REGISTRY_ADMIN { return nil, errors.New("Permission denied") }
+															if username == caller { return nil, errors.New("Participants can't deactivate themselves") }
+
+	p, err := retrieve_participant(stub, username)
+															if err != nil { return nil, err }
+															if p.Role == DISPUTE_ARBITER { return nil, errors.New("The arbiter can only be appointed when the chaincode is deployed") }
+
+	p.Active = false
+
+	return nil, save_participant(stub, p)
+}
+
+//==============================================================================================================================
+//	 change_role - Gives the participant named a new role, passed as a number or by name. No participant can be made the
+//				   arbiter or stop being it.
+//==============================================================================================================================
+func (t *SimpleChaincode) change_role(stub Stub, caller string, caller_affiliation int, username string, role_value string) ([]byte, error) {
+
+															if caller_affiliation != REGISTRY_ADMIN { return nil, errors.New("Permission denied") }
+
+	role, err := parse_role(role_value)
+															if err != nil { return nil, err }
+
+	p, err := retrieve_participant(stub, username)
+															if err != nil { return nil, err }
+															if role == DISPUTE_ARBITER || p.Role == DISPUTE_ARBITER { return nil, errors.New("The arbiter can only be appointed when the chaincode is deployed") }
+
+	p.Role = role
+
+	return nil, save_participant(stub, p)
+}
+
+//==============================================================================================================================
+//	 get_participants - Returns every participant in the registry, active or not, in username order.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_participants(stub Stub) ([]byte, error) {
+
+	prefix, err := create_index_key(INDEX_PARTICIPANT)
+															if err != nil { return nil, err }
+
+	iter, err := stub.RangeQueryState(prefix + KEY_SEPARATOR, prefix + KEY_SEPARATOR + KEY_MAX)
+															if err != nil { return nil, errors.New("Error reading participant registry") }
+	defer iter.Close()
+
+	participants := []Participant{}
+
+	for iter.HasNext() {
+
+		_, bytes, err := iter.Next()
+															if err != nil { return nil, errors.New("Error reading participant registry") }
+
+		var p Participant
+
+		err = json.Unmarshal(bytes, &p)
+															if err != nil { return nil, errors.New("Corrupt participant record") }
+
+		participants = append(participants, p)
+	}
+
+	return json.Marshal(participants)
+}
+
+//==============================================================================================================================
+//	 get_participant - Returns the registry record of the participant named, active or not.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_participant(stub Stub, username string) ([]byte, error) {
+
+	p, found, err := find_participant(stub, username)
+															if err != nil { return nil, err }
+															if !found { return nil, errors.New("Participant not registered: " + username) }
+
+	return json.Marshal(p)
+}
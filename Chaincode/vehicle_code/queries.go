@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"encoding/base64"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Page sizes - get_chocos_page returns DEFAULT_PAGE_SIZE records when no size is passed and never more than MAX_PAGE_SIZE
+//==============================================================================================================================
+const   DEFAULT_PAGE_SIZE			= 20
+const   MAX_PAGE_SIZE				= 100
+
+//==============================================================================================================================
+//	Choco_Filter - Defines the filter passed to get_chocos_page. Every field is optional; a record must match all of the
+//				   fields that are set. JSON {"status": 4, "dates": [{"field": "dateProduced", "from": "2016-08-01"}]}
+//==============================================================================================================================
+type Choco_Filter struct {
+	Status			*int			`json:"status"`
+	Owner			string			`json:"owner"`
+	Custodian		string			`json:"custodian"`
+	Delivered		*bool			`json:"delivered"`
+	Dates			[]Date_Range	`json:"dates"`
+}
+
+//==============================================================================================================================
+//	Date_Range - Restricts a date field of the chocolates, named by its JSON name, to fall between From and To inclusive.
+//				 Either end may be left empty to leave the range open. Records where the field is undefined never match.
+//==============================================================================================================================
+type Date_Range struct {
+	Field			string			`json:"field"`
+	From			string			`json:"from"`
+	To				string			`json:"to"`
+}
+
+//==============================================================================================================================
+//	Choco_Page - Defines the structure returned by get_chocos_page. Bookmark is passed back to fetch the next page and is
+//				 empty when there are no more results.
+//==============================================================================================================================
+type Choco_Page struct {
+	Results			[]Chocolates	`json:"results"`
+	Count			int				`json:"count"`
+	Bookmark		string			`json:"bookmark"`
+}
+
+//==============================================================================================================================
+//	 date_fields - The date fields of the chocolates that can be filtered on, keyed by their JSON name.
+//==============================================================================================================================
+var date_fields = map[string]func(c Chocolates) string{
+	"establishDate":	func(c Chocolates) string { return c.EstablishDate },
+	"boxOrderDate":		func(c Chocolates) string { return c.BoxOrderDate },
+	"boxDelvDate":		func(c Chocolates) string { return c.BoxDelvDate },
+	"ingredOrderDate":	func(c Chocolates) string { return c.IngredOrderDate },
+	"ingredDelvDate":	func(c Chocolates) string { return c.IngredDelvDate },
+	"testDate":			func(c Chocolates) string { return c.TestDate },
+	"dateFinalized":	func(c Chocolates) string { return c.DateFinalized },
+	"dateProduced":		func(c Chocolates) string { return c.DateProduced },
+	"datePackaged":		func(c Chocolates) string { return c.DatePackaged },
+	"dateArrived":		func(c Chocolates) string { return c.DateArrived },
+}
+
+//==============================================================================================================================
+//	 parse_filter - Converts the JSON filter passed into a Choco_Filter and checks every date range is valid. An empty
+//					string is treated as no filter.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_filter(value string) (Choco_Filter, error) {
+
+	var filter Choco_Filter
+
+	if strings.TrimSpace(value) == "" { return filter, nil }
+
+	err := json.Unmarshal([]byte(value), &filter)
+															if err != nil { return filter, errors.New("Invalid filter") }
+
+	for _, dates := range filter.Dates {
+
+		if _, ok := date_fields[dates.Field]; !ok {		return filter, errors.New("Invalid filter: cannot filter on " + dates.Field) }
+
+		if dates.From != "" && t.check_date(dates.From) == false {	return filter, errors.New("Invalid filter: from date for " + dates.Field) }
+		if dates.To   != "" && t.check_date(dates.To)   == false {	return filter, errors.New("Invalid filter: to date for " + dates.Field) }
+	}
+
+	return filter, nil
+}
+
+//==============================================================================================================================
+//	 matches - Returns true if the chocolates passed satisfy every part of the filter that has been set.
+//==============================================================================================================================
+func (filter Choco_Filter) matches(c Chocolates) bool {
+
+	if filter.Status    != nil && c.Status    != *filter.Status    { return false }
+	if filter.Owner     != ""  && c.Owner     != filter.Owner      { return false }
+	if filter.Custodian != ""  && c.Custodian != filter.Custodian  { return false }
+	if filter.Delivered != nil && c.Delivered != *filter.Delivered { return false }
+
+	for _, dates := range filter.Dates {
+
+		value := date_fields[dates.Field](c)
+
+		if is_defined(value) == false				{ return false }
+		if dates.From != "" && value < dates.From	{ return false }		// Dates are held as YYYY-MM-DD so compare as strings
+		if dates.To   != "" && value > dates.To		{ return false }
+	}
+
+	return true
+}
+
+//==============================================================================================================================
+//	 index_prefix - Returns the narrowest index key prefix covering every record the filter can match, using the status
+//					index if a status is set, then the owner and custodian indexes, otherwise the whole status index.
+//==============================================================================================================================
+func (filter Choco_Filter) index_prefix() (string, error) {
+
+	if filter.Status != nil { return create_index_key(INDEX_STATUS, strconv.Itoa(*filter.Status)) }
+	if filter.Owner  != ""  { return create_index_key(INDEX_OWNER, filter.Owner) }
+	if filter.Custodian != "" { return create_index_key(INDEX_CUSTODIAN, filter.Custodian) }
+
+	return create_index_key(INDEX_STATUS)
+}
+
+//==============================================================================================================================
+//	 get_chocos_page - Returns a page of the chocolates the caller is allowed to see that match the filter passed. The
+//					   bookmark is the index key of the last record examined, base64 encoded so that clients treat it as
+//					   opaque, and the next page starts immediately after it.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_chocos_page(stub Stub, caller string, caller_affiliation int, filter_json string, size string, bookmark string) ([]byte, error) {
+
+	filter, err := t.parse_filter(filter_json)
+															if err != nil { return nil, err }
+
+	page_size := DEFAULT_PAGE_SIZE
+
+	if size != "" {
+
+		page_size, err = strconv.Atoi(size)
+															if err != nil || page_size < 1 || page_size > MAX_PAGE_SIZE { return nil, errors.New("Invalid page size, must be between 1 and " + strconv.Itoa(MAX_PAGE_SIZE)) }
+	}
+
+	prefix, err := filter.index_prefix()
+															if err != nil { return nil, err }
+
+	start := prefix + KEY_SEPARATOR
+	end   := prefix + KEY_SEPARATOR + KEY_MAX
+
+	if bookmark != "" {
+
+		last, err := base64.URLEncoding.DecodeString(bookmark)
+															if err != nil || strings.HasPrefix(string(last), start) == false { return nil, errors.New("Invalid bookmark") }	// A bookmark from a different filter would skip records
+
+		start = string(last) + KEY_SEPARATOR				// The smallest key that sorts after the bookmark
+	}
+
+	iter, err := stub.RangeQueryState(start, end)
+															if err != nil { fmt.Printf("GET_CHOCOS_PAGE: Error querying index: %s", err); return nil, errors.New("Error querying index") }
+	defer iter.Close()
+
+	page := Choco_Page{ Results: []Chocolates{} }
+
+	for iter.HasNext() {
+
+		if len(page.Results) == page_size {					// The page is full and there is at least one more key to look at
+			page.Bookmark = base64.URLEncoding.EncodeToString([]byte(bookmark))
+			break
+		}
+
+		key, _, err := iter.Next()
+															if err != nil { fmt.Printf("GET_CHOCOS_PAGE: Error reading index: %s", err); return nil, errors.New("Error reading index") }
+
+		bookmark = key
+
+		parts := split_index_key(key)
+
+		if len(parts) == 0 { continue }
+
+		c, err := t.retrieve_chocoID(stub, parts[len(parts)-1])
+															if err != nil { return nil, errors.New("Failed to retrieve chocoID") }
+
+		if filter.matches(c) == false { continue }
+
+		_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+
+		if err == nil { page.Results = append(page.Results, c) }
+	}
+
+	page.Count = len(page.Results)
+
+	bytes, err := json.Marshal(page)
+															if err != nil { return nil, errors.New("Error creating page") }
+
+	return bytes, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Recall index - Recalls are stored under \x00recall\x00<recallID>. Recall IDs follow the same format as lot IDs.
+//==============================================================================================================================
+const   INDEX_RECALL				= "recall"
+
+const   RECALL_RECALLED				= "recalled"
+const   RECALL_RETURNED				= "returned"
+const   RECALL_DESTROYED			= "destroyed"
+
+const   MAX_RECALL_IDS				= 500			// The most chocoIDs a recall can list
+
+//==============================================================================================================================
+//	 Recall roles - The participant types that can initiate a recall and see its progress.
+//==============================================================================================================================
+var recall_roles = []int{ DU_RHONE, REGULATOR }
+
+//==============================================================================================================================
+//	 transfer_functions - The invokes other than the lifecycle transitions that pass the chocolates to someone else. None
+//						  of them, nor any transition other than a rework returning the chocolates to Du Rhone, can be
+//						  made on chocolates that are being recalled.
+//==============================================================================================================================
+var transfer_functions = []string{ "propose_transition", "sign_proposal", "handover_shipment", "accept_handover", "accept_delivery", "finish_delivery", "reject_delivery" }
+
+//==============================================================================================================================
+//	Recall - Defines the structure of a product recall. The chocolates recalled are those matching every criterion given.
+//			 JSON passed to initiate_recall {"recallID": "RC-1", "reason": "Salmonella in cocoa", "criteria": {"ingredOrigin":
+//			 "Ghana", "lotID": "GH-2016-001", "producedFrom": "2016-08-01", "producedTo": "2016-08-31", "chocoIDs": []}}
+//==============================================================================================================================
+type Recall struct {
+	RecallID		string					`json:"recallID"`
+	Reason			string					`json:"reason"`
+	Criteria		Recall_Criteria			`json:"criteria"`
+	InitiatedBy		string					`json:"initiatedBy"`
+	InitiatorRole	int						`json:"initiatorRole"`
+	DateInitiated	string					`json:"dateInitiated"`
+	ChocoIDs		[]string				`json:"chocoIDs"`
+}
+
+type Recall_Criteria struct {
+	IngredOrigin	string					`json:"ingredOrigin"`
+	LotID			string					`json:"lotID"`
+	ProducedFrom	string					`json:"producedFrom"`
+	ProducedTo		string					`json:"producedTo"`
+	ChocoIDs		[]string				`json:"chocoIDs"`
+}
+
+//==============================================================================================================================
+//	Recall_Event - Defines the payload of the chocolate_recalled event. A recall marks many chocolates records in one
+//				   transaction, so a single event lists them all rather than carrying the usual Choco_Event.
+//==============================================================================================================================
+type Recall_Event struct {
+	RecallID		string					`json:"recallID"`
+	TxID			string					`json:"txID"`
+	Reason			string					`json:"reason"`
+	ChocoIDs		[]string				`json:"chocoIDs"`
+}
+
+//==============================================================================================================================
+//	Recall_Status - Reports the progress of a recall, with where each recalled item is now.
+//==============================================================================================================================
+type Recall_Status struct {
+	Recall			Recall					`json:"recall"`
+	Outstanding		int						`json:"outstanding"`
+	Returned		int						`json:"returned"`
+	Destroyed		int						`json:"destroyed"`
+	Items			[]Recall_Item			`json:"items"`
+}
+
+type Recall_Item struct {
+	ChocoID			string					`json:"chocoID"`
+	Status			int						`json:"status"`
+	Custodian		string					`json:"custodian"`
+	RecallStatus	string					`json:"recallStatus"`
+}
+
+//==============================================================================================================================
+//	 is_recall_role - Returns true if participants of the type passed can initiate recalls.
+//==============================================================================================================================
+func is_recall_role(affiliation int) bool {
+
+	for _, role := range recall_roles { if affiliation == role { return true } }
+
+	return false
+}
+
+//==============================================================================================================================
+//	 is_transfer - Returns true if the invoke named passes the chocolates to someone else. Rework transitions sending the
+//				   chocolates back to Du Rhone are not counted, so recalled stock can still be returned.
+//==============================================================================================================================
+func (t *SimpleChaincode) is_transfer(function string) bool {
+
+	if transition, ok := t.get_transition(function); ok { return !transition.Rework || transition.Recipient != DU_RHONE }
+
+	for _, f := range transfer_functions { if function == f { return true } }
+
+	return false
+}
+
+//==============================================================================================================================
+//	 parse_recall - Validates the JSON recall passed, returning a Validation_Error listing every field that is invalid. At
+//					least one criterion must be given.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_recall(value string) (Recall, error) {
+
+	var r Recall
+
+	err := json.Unmarshal([]byte(value), &r)
+															if err != nil { return r, &Validation_Error{ []Field_Error{ { "recall", "must be a JSON object" } } } }
+
+	invalid := &Validation_Error{}
+	c       := &r.Criteria
+
+	r.RecallID     = strings.TrimSpace(r.RecallID)
+	r.Reason       = strings.TrimSpace(r.Reason)
+	c.IngredOrigin = strings.TrimSpace(c.IngredOrigin)
+	c.LotID        = strings.TrimSpace(c.LotID)
+
+	if !lot_id.MatchString(r.RecallID)		{ invalid.add("recallID", "must be up to 64 letters, digits, dots, dashes or underscores") }
+	if r.Reason == ""						{ invalid.add("reason", "must not be empty") }
+
+	if c.IngredOrigin == "" && c.LotID == "" && c.ProducedFrom == "" && c.ProducedTo == "" && len(c.ChocoIDs) == 0 {
+		invalid.add("criteria", "must give an ingredient origin, lot, production dates or chocoIDs")
+	}
+
+	if c.LotID != "" && !lot_id.MatchString(c.LotID)		{ invalid.add("criteria.lotID", "must be up to 64 letters, digits, dots, dashes or underscores") }
+
+	for _, field := range []struct{ name string; value string }{ { "criteria.producedFrom", c.ProducedFrom }, { "criteria.producedTo", c.ProducedTo } } {
+		if field.value != "" && !t.check_date(field.value) { invalid.add(field.name, "must be a date in the format YYYY-MM-DD") }
+	}
+
+	if c.ProducedFrom != "" && c.ProducedTo != "" && c.ProducedTo < c.ProducedFrom { invalid.add("criteria.producedTo", "must not be before producedFrom") }
+
+	if len(c.ChocoIDs) > MAX_RECALL_IDS		{ invalid.add("criteria.chocoIDs", "must have at most " + strconv.Itoa(MAX_RECALL_IDS) + " chocoIDs") }
+
+	if len(invalid.Fields) > 0 { return r, invalid }
+
+	return r, nil
+}
+
+//==============================================================================================================================
+//	 matches_recall - Returns true if the chocolates meet every criterion of the recall. Chocolates match an ingredient
+//					  origin given for them or for any of the ingredient lots that went into them, whose origins are
+//					  passed. Chocolates are only recalled by a production date once they have been produced.
+//==============================================================================================================================
+func matches_recall(c Chocolates, lot_origins []string, criteria Recall_Criteria) bool {
+
+	if criteria.IngredOrigin != "" {
+
+		from := strings.EqualFold(c.IngredOrigin, criteria.IngredOrigin)
+
+		for _, origin := range lot_origins { if strings.EqualFold(origin, criteria.IngredOrigin) { from = true } }
+
+		if !from { return false }
+	}
+
+	if criteria.LotID != "" {
+
+		used := false
+
+		for _, usage := range c.Lots { if usage.LotID == criteria.LotID { used = true } }
+
+		if !used { return false }
+	}
+
+	if criteria.ProducedFrom != "" || criteria.ProducedTo != "" {
+
+		if !is_defined(c.DateProduced) { return false }
+
+		if criteria.ProducedFrom != "" && c.DateProduced < criteria.ProducedFrom	{ return false }
+		if criteria.ProducedTo   != "" && c.DateProduced > criteria.ProducedTo		{ return false }
+	}
+
+	if len(criteria.ChocoIDs) > 0 {
+
+		listed := false
+
+		for _, chocoID := range criteria.ChocoIDs { if chocoID == c.ChocoID { listed = true } }
+
+		if !listed { return false }
+	}
+
+	return true
+}
+
+//==============================================================================================================================
+//	 get_lot_origins - Returns the origin country of each ingredient lot that went into the chocolates. Origins already
+//					   looked up are taken from the map passed, which is filled in with the lots retrieved.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_lot_origins(stub Stub, c Chocolates, origins map[string]string) ([]string, error) {
+
+	lot_origins := []string{}
+
+	for _, usage := range c.Lots {
+
+		origin, ok := origins[usage.LotID]
+
+		if !ok {
+			lot, err := t.retrieve_lot(stub, usage.LotID)
+															if err != nil { return nil, err }
+
+			origin = lot.OriginCountry
+			origins[usage.LotID] = origin
+		}
+
+		lot_origins = append(lot_origins, origin)
+	}
+
+	return lot_origins, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_recall - Returns the recall with the ID passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_recall(stub Stub, recallID string) (Recall, error) {
+
+	var r Recall
+
+	key, err := create_index_key(INDEX_RECALL, recallID)
+															if err != nil { return r, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return r, errors.New("Error retrieving recall") }
+															if bytes == nil { return r, errors.New("Recall not found: " + recallID) }
+
+	err = json.Unmarshal(bytes, &r)
+															if err != nil { return r, errors.New("Corrupt recall " + recallID) }
+
+	return r, nil
+}
+
+//=================================================================================================================================
+//	 initiate_recall - Recalls every chocolates record matching the recall's criteria. The candidates are narrowed by the lot
+//					   index or the chocoIDs listed where given. Chocolates already being recalled are left alone, but
+//					   those that have been cancelled or discontinued are recalled too, as their stock still has to be
+//					   accounted for. Each record recalled is marked and can't be transferred again other than back to
+//					   Du Rhone; its history records the recall and a single event lists every record recalled. Returns
+//					   the recall.
+//=================================================================================================================================
+func (t *SimpleChaincode) initiate_recall(stub Stub, caller string, caller_affiliation int, recall_json string) ([]byte, error) {
+
+															if !is_recall_role(caller_affiliation) { return nil, errors.New("Permission denied") }
+
+	r, err := t.parse_recall(recall_json)
+															if err != nil { return nil, err }
+
+	if _, err := t.retrieve_recall(stub, r.RecallID); err == nil { return nil, errors.New("Recall already exists: " + r.RecallID) }
+
+	var candidates []string
+
+	if len(r.Criteria.ChocoIDs) > 0 {
+		candidates = r.Criteria.ChocoIDs
+	} else if r.Criteria.LotID != "" {
+		candidates, err = t.get_indexed_ids(stub, INDEX_LOT, r.Criteria.LotID)
+	} else {
+		candidates, err = t.get_indexed_ids(stub, INDEX_STATUS)
+	}
+															if err != nil { return nil, err }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	r.InitiatedBy   = caller
+	r.InitiatorRole = caller_affiliation
+	r.DateInitiated = date
+	r.ChocoIDs      = []string{}
+
+	origins := map[string]string{}
+
+	for _, chocoID := range candidates {
+
+		c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, errors.New("Error retrieving chocoID " + chocoID) }
+
+		var lot_origins []string
+
+		if r.Criteria.IngredOrigin != "" {
+			lot_origins, err = t.get_lot_origins(stub, c, origins)
+															if err != nil { return nil, err }
+		}
+
+		if is_defined(c.Recall) || !matches_recall(c, lot_origins, r.Criteria) { continue }
+
+		previous := c
+
+		c.Recall       = r.RecallID
+		c.RecallStatus = RECALL_RECALLED
+
+		_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("INITIATE_RECALL: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+		changes, err := diff_chocolates(&previous, c)
+															if err != nil { return nil, errors.New("Error comparing chocolates records") }
+
+		err = t.record_history(stub, "initiate_recall", caller, caller_affiliation, c.ChocoID, changes)
+															if err != nil { return nil, err }
+
+		r.ChocoIDs = append(r.ChocoIDs, c.ChocoID)
+	}
+
+															if len(r.ChocoIDs) == 0 { return nil, errors.New("No chocolates match the recall") }
+
+	sort.Strings(r.ChocoIDs)
+
+	key, err := create_index_key(INDEX_RECALL, r.RecallID)
+															if err != nil { return nil, err }
+
+	bytes, err := json.Marshal(r)
+															if err != nil { return nil, errors.New("Error converting recall") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("INITIATE_RECALL: Error storing recall: %s", err); return nil, errors.New("Error storing recall") }
+
+	event, err := json.Marshal(Recall_Event{ r.RecallID, stub.GetTxID(), r.Reason, r.ChocoIDs })
+															if err != nil { return nil, errors.New("Error creating event") }
+
+	err = stub.SetEvent(EVENT_RECALLED, event)
+															if err != nil { fmt.Printf("INITIATE_RECALL: Error setting event: %s", err); return nil, errors.New("Error setting event") }
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 record_recall_outcome - Records that recalled chocolates have been returned or destroyed. Either the participant
+//							 holding them or Du Rhone can record the outcome, and returned chocolates can later be
+//							 destroyed.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_recall_outcome(stub Stub, c Chocolates, caller string, caller_affiliation int, outcome string) ([]byte, error) {
+
+	outcome = strings.ToLower(strings.TrimSpace(outcome))
+															if outcome != RECALL_RETURNED && outcome != RECALL_DESTROYED { return nil, errors.New("Invalid value passed for recall outcome") }
+
+	if 		!is_defined(c.Recall)						||
+			(c.Custodian		!= caller				&&
+			 caller_affiliation	!= DU_RHONE)			{
+															return nil, errors.New("Permission denied")
+	}
+
+															if c.RecallStatus == RECALL_DESTROYED || c.RecallStatus == outcome { return nil, errors.New("Chocolates have already been " + c.RecallStatus) }
+
+	c.RecallStatus = outcome
+
+	_, err := t.save_changes(stub, c)
+															if err != nil { fmt.Printf("RECORD_RECALL_OUTCOME: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 get_recall_status - Returns the recall with the ID passed and where each of the chocolates it recalled is now. Only
+//						 the recall roles can follow a recall.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_recall_status(stub Stub, caller string, caller_affiliation int, recallID string) ([]byte, error) {
+
+															if !is_recall_role(caller_affiliation) { return nil, errors.New("Permission denied") }
+
+	r, err := t.retrieve_recall(stub, recallID)
+															if err != nil { return nil, err }
+
+	status := Recall_Status{ Recall: r, Items: []Recall_Item{} }
+
+	for _, chocoID := range r.ChocoIDs {
+
+		c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, errors.New("Error retrieving chocoID " + chocoID) }
+
+		switch c.RecallStatus {
+			case RECALL_RETURNED:	status.Returned++
+			case RECALL_DESTROYED:	status.Destroyed++
+			default:				status.Outstanding++
+		}
+
+		status.Items = append(status.Items, Recall_Item{ c.ChocoID, c.Status, c.Custodian, c.RecallStatus })
+	}
+
+	return json.Marshal(status)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+const test_sugar_lot = `{"lotID": "CI-2016-001", "ingredient": "sugar", "originCountry": "Ivory Coast", "originFarm": "Bouake Estate",
+	"harvestDate": "2016-04-02", "quantity": 500, "unit": "kg", "certificates": []}`
+
+//==============================================================================================================================
+//	 new_recall_ledger - Returns a ledger with a regulator registered and chocolates at different points of their lifecycle:
+//						 AB1234567 made with lots GH-2016-001 from Ghana and CI-2016-001 from the Ivory Coast, CD1234567
+//						 with its ingredients sourced from Ghana, EF1234567 produced and out for delivery and GH1234567
+//						 still being designed.
+//==============================================================================================================================
+func new_recall_ledger(t *testing.T) *test_ledger {
+
+	l := new_test_ledger(t)
+	l.ecerts.register("regulator", "regulator\\group1\\7")
+
+	l.must_invoke("supplier", "create_ingredient_lot", test_lot)
+	l.must_invoke("supplier", "create_ingredient_lot", test_sugar_lot)
+
+	l.advance("AB1234567", STATE_SUPPLYING)
+	l.must_invoke("supplier", "use_ingredient_lot", "GH-2016-001", "300", "AB1234567")
+	l.must_invoke("supplier", "use_ingredient_lot", "CI-2016-001", "50",  "AB1234567")
+
+	l.advance("CD1234567", STATE_TESTING)
+	l.advance("EF1234567", STATE_DELIVERY)
+	l.advance("GH1234567", STATE_CONCEPTING)
+
+	return l
+}
+
+func TestInitiateRecall(t *testing.T) {
+
+	recalled     := func(l *test_ledger) { l.must_invoke("regulator", "initiate_recall", `{"recallID": "RC-1", "reason": "Salmonella in cocoa", "criteria": {"lotID": "GH-2016-001"}}`) }
+	discontinued := func(l *test_ledger) { l.must_invoke("durhone", "discontinue_chocolates", "Recipe withdrawn", "EF1234567") }
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		recall		string
+		ok			bool
+		want		[]string
+	}{
+		{ "by lot",							nil,		"regulator",	`{"recallID": "RC-1", "reason": "Salmonella in cocoa", "criteria": {"lotID": "GH-2016-001"}}`,	true,
+			[]string{ "AB1234567" } },
+		{ "by production date",				nil,		"durhone",		`{"recallID": "RC-2", "reason": "Mislabelled", "criteria": {"producedFrom": "2016-08-01"}}`,	true,
+			[]string{ "EF1234567" } },
+		{ "by ingredient origin",			nil,		"regulator",	`{"recallID": "RC-3", "reason": "Aflatoxin", "criteria": {"ingredOrigin": "ghana"}}`,			true,
+			[]string{ "AB1234567", "CD1234567", "EF1234567" } },
+		{ "by the origin of a lot",			nil,		"regulator",	`{"recallID": "RC-3", "reason": "Aflatoxin", "criteria": {"ingredOrigin": "Ivory Coast"}}`,		true,
+			[]string{ "AB1234567" } },
+		{ "by lot and origin",				nil,		"regulator",	`{"recallID": "RC-3", "reason": "Aflatoxin", "criteria": {"lotID": "GH-2016-001", "ingredOrigin": "Ivory Coast"}}`,	true,
+			[]string{ "AB1234567" } },
+		{ "by chocoIDs",					nil,		"durhone",		`{"recallID": "RC-4", "reason": "Wrong recipe", "criteria": {"chocoIDs": ["GH1234567"]}}`,		true,
+			[]string{ "GH1234567" } },
+		{ "by printer",						nil,		"printer",		`{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"lotID": "GH-2016-001"}}`,			false,	nil },
+		{ "matching no chocolates",			nil,		"regulator",	`{"recallID": "RC-5", "reason": "Aflatoxin", "criteria": {"ingredOrigin": "Peru"}}`,			false,	nil },
+		{ "duplicate",						recalled,	"regulator",	`{"recallID": "RC-1", "reason": "Again", "criteria": {"chocoIDs": ["CD1234567"]}}`,				false,	nil },
+		{ "matching recalled chocolates",	recalled,	"regulator",	`{"recallID": "RC-5", "reason": "Again", "criteria": {"ingredOrigin": "Ivory Coast"}}`,			false,	nil },
+		{ "skipping recalled chocolates",	recalled,	"regulator",	`{"recallID": "RC-5", "reason": "Again", "criteria": {"ingredOrigin": "Ghana"}}`,				true,
+			[]string{ "CD1234567", "EF1234567" } },
+		{ "discontinued chocolates",		discontinued,	"durhone",	`{"recallID": "RC-2", "reason": "Mislabelled", "criteria": {"producedFrom": "2016-08-01"}}`,	true,
+			[]string{ "EF1234567" } },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_recall_ledger(t)
+
+			if test.prepare != nil { test.prepare(l) }
+
+			result, err := l.invoke(test.user, "initiate_recall", test.recall)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if !test.ok { return }
+
+			var r Recall
+			json.Unmarshal(result, &r)
+
+			if strings.Join(r.ChocoIDs, ",") != strings.Join(test.want, ",") || r.InitiatedBy != test.user { t.Errorf("unexpected recall %+v", r) }
+
+			if l.stub.event_name != EVENT_RECALLED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_RECALLED) }
+
+			for _, chocoID := range test.want {
+				if c := l.chocolates(chocoID); c.Recall != r.RecallID || c.RecallStatus != RECALL_RECALLED { t.Errorf("%s not recalled: %+v", chocoID, c) }
+			}
+
+			var history []History_Entry
+			json.Unmarshal(l.must_query("durhone", "get_chocolate_history", test.want[0]), &history)
+
+			if entry := history[len(history) - 1]; entry.Function != "initiate_recall" || entry.Caller != test.user { t.Errorf("recall not recorded in history: %+v", entry) }
+		})
+	}
+}
+
+func TestRecallValidation(t *testing.T) {
+
+	l := new_recall_ledger(t)
+
+	too_many := `["` + strings.Repeat(`AB1234567", "`, MAX_RECALL_IDS) + `CD1234567"]`
+
+	tests := map[string][]Field_Error{
+		`"recall"`:											{ { "recall", "must be a JSON object" } },
+		`{"recallID": "RC 1", "reason": " ", "criteria": {}}`:
+															{ { "recallID", "must be up to 64 letters, digits, dots, dashes or underscores" }, { "reason", "must not be empty" },
+															  { "criteria", "must give an ingredient origin, lot, production dates or chocoIDs" } },
+		`{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"lotID": "GH 1", "producedFrom": "2016-13-01", "producedTo": "2016-07-01"}}`:
+															{ { "criteria.lotID", "must be up to 64 letters, digits, dots, dashes or underscores" },
+															  { "criteria.producedFrom", "must be a date in the format YYYY-MM-DD" }, { "criteria.producedTo", "must not be before producedFrom" } },
+		`{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"chocoIDs": ` + too_many + `}}`:
+															{ { "criteria.chocoIDs", "must have at most " + strconv.Itoa(MAX_RECALL_IDS) + " chocoIDs" } },
+	}
+
+	for recall_json, want := range tests {
+
+		_, err := l.invoke("regulator", "initiate_recall", recall_json)
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%.80s: expected a validation error, got %v", recall_json, err); continue }
+
+		got, _ := json.Marshal(invalid.Fields)
+		expected, _ := json.Marshal(want)
+
+		if string(got) != string(expected) { t.Errorf("%.80s:\n got %s\nwant %s", recall_json, got, expected) }
+	}
+}
+
+func TestRecallBlocksTransfers(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		user		string
+		function	string
+		args		[]string
+		ok			bool
+	}{
+		{ "transition",					STATE_PRODUCTION,	"durhone",	"production_to_delivery",	[]string{ "shipper" },								false },
+		{ "proposal",					STATE_PRODUCTION,	"durhone",	"propose_transition",		[]string{ "production_to_delivery", "shipper" },	false },
+		{ "update",						STATE_PRODUCTION,	"durhone",	"update_quantity",			[]string{ "120" },									true },
+		{ "return to du rhone",			STATE_DELIVERY,		"shipper",	"delivery_to_production",	[]string{ "durhone", REWORK_RETURNED },				true },
+		{ "rework away from du rhone",	STATE_SUPPLYING,	"supplier",	"supplying_to_printing",	[]string{ "printer", REWORK_PRINT_DEFECT },			false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			if test.state == STATE_PRODUCTION { l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567") }
+
+			l.must_invoke("durhone", "initiate_recall", `{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"chocoIDs": ["AB1234567"]}}`)
+
+			_, err := l.invoke(test.user, test.function, append(test.args, "AB1234567")...)
+
+			if test.ok != (err == nil) { t.Errorf("expected ok=%v, got %v", test.ok, err) }
+		})
+	}
+}
+
+func TestRecallOutcomes(t *testing.T) {
+
+	returned  := func(l *test_ledger) { l.must_invoke("shipper", "record_recall_outcome", "returned", "CD1234567") }
+	destroyed := func(l *test_ledger) { l.must_invoke("durhone", "record_recall_outcome", "destroyed", "CD1234567") }
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		chocoID		string
+		outcome		string
+		ok			bool
+		want		string
+	}{
+		{ "returned by the custodian",		nil,		"shipper",	"CD1234567",	"Returned",		true,	RECALL_RETURNED },
+		{ "destroyed by du rhone",			nil,		"durhone",	"CD1234567",	"destroyed",	true,	RECALL_DESTROYED },
+		{ "destroyed after return",			returned,	"durhone",	"CD1234567",	"destroyed",	true,	RECALL_DESTROYED },
+		{ "by printer",						nil,		"printer",	"CD1234567",	"returned",		false,	RECALL_RECALLED },
+		{ "unknown outcome",				nil,		"shipper",	"CD1234567",	"lost",			false,	RECALL_RECALLED },
+		{ "returned twice",					returned,	"shipper",	"CD1234567",	"returned",		false,	RECALL_RETURNED },
+		{ "returned after destruction",		destroyed,	"durhone",	"CD1234567",	"returned",		false,	RECALL_DESTROYED },
+		{ "chocolates not recalled",		nil,		"durhone",	"EF1234567",	"returned",		false,	"" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.ecerts.register("regulator", "regulator\\group1\\7")
+
+			l.advance("AB1234567", STATE_PRODUCTION)
+			l.advance("CD1234567", STATE_DELIVERY)
+			l.advance("EF1234567", STATE_PRODUCTION)
+			l.must_invoke("regulator", "initiate_recall", `{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"chocoIDs": ["AB1234567", "CD1234567"]}}`)
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, "record_recall_outcome", test.outcome, test.chocoID)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if c := l.chocolates(test.chocoID); c.RecallStatus != test.want && is_defined(test.want) { t.Errorf("recall status = %s, want %s", c.RecallStatus, test.want) }
+
+			if test.ok && l.stub.event_name != EVENT_UPDATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_UPDATED) }
+		})
+	}
+}
+
+func TestRecallStatus(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.ecerts.register("regulator", "regulator\\group1\\7")
+
+	l.advance("AB1234567", STATE_PRODUCTION)
+	l.advance("CD1234567", STATE_DELIVERY)
+	l.must_invoke("regulator", "initiate_recall", `{"recallID": "RC-1", "reason": "Salmonella", "criteria": {"chocoIDs": ["AB1234567", "CD1234567"]}}`)
+	l.must_invoke("durhone", "record_recall_outcome", "destroyed", "CD1234567")
+
+	if _, err := l.query("ibm", "get_recall", "RC-1"); err == nil { t.Error("expected recall status query by ibm to fail") }
+
+	var status Recall_Status
+	json.Unmarshal(l.must_query("regulator", "get_recall", "RC-1"), &status)
+
+	if status.Recall.Reason != "Salmonella" || status.Outstanding != 1 || status.Returned != 0 || status.Destroyed != 1 || len(status.Items) != 2 ||
+	   status.Items[1] != (Recall_Item{ "CD1234567", STATE_DELIVERY, "shipper", RECALL_DESTROYED }) {
+		t.Errorf("unexpected recall status %+v", status)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Recipe index - Recipe versions are stored under \x00recipe\x00<chocoID>\x00<version>. The version is zero padded so a
+//					range query over one chocoID returns its versions in order.
+//==============================================================================================================================
+const   INDEX_RECIPE				= "recipe"
+
+//==============================================================================================================================
+//	Recipe - Defines the structure of a recipe. JSON {"ingredients": [{"name": "cocoa", "quantity": 70, "unit": "%"}],
+//			 "steps": ["Temper at 31C"], "contributors": [{"name": "Chef Watson", "role": "concept"}]}
+//==============================================================================================================================
+type Recipe struct {
+	Ingredients		[]Recipe_Ingredient		`json:"ingredients"`
+	Steps			[]string				`json:"steps"`
+	Contributors	[]Recipe_Contributor	`json:"contributors"`
+}
+
+type Recipe_Ingredient struct {
+	Name			string					`json:"name"`
+	Quantity		float64					`json:"quantity"`
+	Unit			string					`json:"unit"`
+}
+
+type Recipe_Contributor struct {
+	Name			string					`json:"name"`
+	Role			string					`json:"role"`
+}
+
+//==============================================================================================================================
+//	Recipe_Version - Defines the structure for one version of the recipe of a chocolates record. Versions are numbered from
+//					 1 and are never modified once written.
+//==============================================================================================================================
+type Recipe_Version struct {
+	ChocoID			string					`json:"chocoID"`
+	Version			int						`json:"version"`
+	Author			string					`json:"author"`
+	Timestamp		string					`json:"timestamp"`
+	TxID			string					`json:"txID"`
+	Reason			string					`json:"reason"`
+	Recipe			Recipe					`json:"recipe"`
+}
+
+//==============================================================================================================================
+//	Recipe_Diff - Defines the structure returned by diff_recipe_versions. Ingredients and contributors are matched by name;
+//				  steps are compared in order and listed as kept, added or removed.
+//==============================================================================================================================
+type Recipe_Diff struct {
+	ChocoID				string					`json:"chocoID"`
+	From				int						`json:"from"`
+	To					int						`json:"to"`
+	Reasons				[]string				`json:"reasons"`
+	AddedIngredients	[]Recipe_Ingredient		`json:"addedIngredients"`
+	RemovedIngredients	[]Recipe_Ingredient		`json:"removedIngredients"`
+	ChangedIngredients	[]Ingredient_Change		`json:"changedIngredients"`
+	Steps				[]Step_Change			`json:"steps"`
+	AddedContributors	[]Recipe_Contributor	`json:"addedContributors"`
+	RemovedContributors	[]Recipe_Contributor	`json:"removedContributors"`
+	ChangedContributors	[]Contributor_Change	`json:"changedContributors"`
+}
+
+type Ingredient_Change struct {
+	Name			string					`json:"name"`
+	Old				Recipe_Ingredient		`json:"old"`
+	New				Recipe_Ingredient		`json:"new"`
+}
+
+type Contributor_Change struct {
+	Name			string					`json:"name"`
+	OldRole			string					`json:"oldRole"`
+	NewRole			string					`json:"newRole"`
+}
+
+type Step_Change struct {
+	Change			string					`json:"change"`			// One of "kept", "added" or "removed"
+	Step			string					`json:"step"`
+}
+
+//==============================================================================================================================
+//	 parse_recipe - Converts the JSON recipe passed into a Recipe, returning a Validation_Error naming every line that is
+//					invalid e.g. ingredients[1].unit.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_recipe(value string) (Recipe, error) {
+
+	var recipe Recipe
+
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(value), &fields)
+															if err != nil || fields == nil { return recipe, &Validation_Error{ []Field_Error{ { "recipe", "must be a JSON object" } } } }
+
+	names := []string{}
+
+	for name := range fields { names = append(names, name) }
+
+	sort.Strings(names)
+
+	invalid := &Validation_Error{}
+
+	for _, name := range names {
+		if name != "ingredients" && name != "steps" && name != "contributors" { invalid.add(name, "unknown field") }
+	}
+
+	check_lines := func(field string, target interface{}, count func() int) bool {
+
+		raw, ok := fields[field]
+		if !ok { invalid.add(field, "is required"); return false }
+
+		if err := json.Unmarshal(raw, target); err != nil { invalid.add(field, "must be an array of " + field); return false }
+
+		if count() == 0					{ invalid.add(field, "must not be empty") }
+		if count() > MAX_LIST_LENGTH	{ invalid.add(field, "must have at most " + strconv.Itoa(MAX_LIST_LENGTH) + " entries") }
+
+		return true
+	}
+
+	check_text := func(field string, value *string) {
+
+		*value = strings.TrimSpace(*value)
+
+		if *value == ""							{ invalid.add(field, "must not be empty") }
+		if len([]rune(*value)) > MAX_TEXT_LENGTH	{ invalid.add(field, "must be at most " + strconv.Itoa(MAX_TEXT_LENGTH) + " characters") }
+	}
+
+	if check_lines("ingredients", &recipe.Ingredients, func() int { return len(recipe.Ingredients) }) {
+
+		seen := map[string]bool{}
+
+		for i := range recipe.Ingredients {
+
+			line  := &recipe.Ingredients[i]
+			field := fmt.Sprintf("ingredients[%d]", i)
+
+			check_text(field + ".name", &line.Name)
+			check_text(field + ".unit", &line.Unit)
+
+			if seen[line.Name]		{ invalid.add(field + ".name", "appears more than once") }
+			if line.Quantity <= 0	{ invalid.add(field + ".quantity", "must be greater than zero") }
+
+			seen[line.Name] = true
+		}
+	}
+
+	if check_lines("steps", &recipe.Steps, func() int { return len(recipe.Steps) }) {
+
+		for i := range recipe.Steps { check_text(fmt.Sprintf("steps[%d]", i), &recipe.Steps[i]) }
+	}
+
+	if check_lines("contributors", &recipe.Contributors, func() int { return len(recipe.Contributors) }) {
+
+		seen := map[string]bool{}
+
+		for i := range recipe.Contributors {
+
+			contributor := &recipe.Contributors[i]
+			field       := fmt.Sprintf("contributors[%d]", i)
+
+			check_text(field + ".name", &contributor.Name)
+			check_text(field + ".role", &contributor.Role)
+
+			if seen[contributor.Name] { invalid.add(field + ".name", "appears more than once") }
+
+			seen[contributor.Name] = true
+		}
+	}
+
+	if len(invalid.Fields) > 0 { return recipe, invalid }
+
+	return recipe, nil
+}
+
+//==============================================================================================================================
+//	 recipe_key - Returns the key of the version of the recipe for chocoID passed.
+//==============================================================================================================================
+func recipe_key(chocoID string, version int) (string, error) {
+
+	return create_index_key(INDEX_RECIPE, chocoID, fmt.Sprintf("%06d", version))
+}
+
+//==============================================================================================================================
+//	 retrieve_recipe_version - Returns the version of the recipe for chocoID passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_recipe_version(stub Stub, chocoID string, version int) (Recipe_Version, error) {
+
+	var v Recipe_Version
+
+	key, err := recipe_key(chocoID, version)
+															if err != nil { return v, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return v, errors.New("Error retrieving recipe version") }
+															if bytes == nil { return v, errors.New("Recipe version " + strconv.Itoa(version) + " not found for " + chocoID) }
+
+	err = json.Unmarshal(bytes, &v)
+															if err != nil { return v, errors.New("Corrupt recipe version") }
+
+	return v, nil
+}
+
+//=================================================================================================================================
+//	 revise_recipe - Stores the recipe passed as the next version of the chocolates' recipe, with the reason for the change.
+//					 The recipe can be revised by Du Rhone while it is being conceived or tested, up until it is finalized.
+//					 The ingredients, contributers, method and revisions of the chocolates are kept as a summary of the
+//					 current version for clients that read them. As with update_ingredients, any tasting approval is
+//					 withdrawn and the recipe can't be revised while a tasting session is open.
+//=================================================================================================================================
+func (t *SimpleChaincode) revise_recipe(stub Stub, c Chocolates, caller string, caller_affiliation int, recipe_json string, reason string) ([]byte, error) {
+
+	reason = strings.TrimSpace(reason)
+															if reason == "" { return nil, errors.New("Invalid value passed for reason") }
+
+	if 		(c.Status != STATE_CONCEPTING && c.Status != STATE_TESTING)		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= DU_RHONE				||
+			is_defined(c.DateFinalized)	== true				||			// Can't revise a recipe that has been finalized
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+	if c.TastingSession > 0 {
+
+		s, err := t.retrieve_tasting_session(stub, c.ChocoID, c.TastingSession)
+															if err != nil { return nil, err }
+															if s.Status == SESSION_OPEN { return nil, errors.New("Recipe can't be revised while tasting session " + strconv.Itoa(s.Session) + " is open") }
+	}
+
+	recipe, err := t.parse_recipe(recipe_json)
+															if err != nil { return nil, err }
+
+	timestamp, err := t.get_tx_time(stub)
+															if err != nil { return nil, err }
+
+	version := Recipe_Version{
+		ChocoID:		c.ChocoID,
+		Version:		c.RecipeVersion + 1,
+		Author:			caller,
+		Timestamp:		timestamp.Format(TIME_FORMAT),
+		TxID:			stub.GetTxID(),
+		Reason:			reason,
+		Recipe:			recipe,
+	}
+
+	key, err := recipe_key(c.ChocoID, version.Version)
+															if err != nil { return nil, err }
+
+	existing, err := stub.GetState(key)
+															if err != nil || existing != nil { return nil, errors.New("Recipe version already exists") }	// Versions are immutable
+
+	bytes, err := json.Marshal(version)
+															if err != nil { return nil, errors.New("Error converting recipe version") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("REVISE_RECIPE: Error storing recipe version: %s", err); return nil, errors.New("Error storing recipe version") }
+
+	c.RecipeVersion   = version.Version
+	c.Ingredients     = []string{}
+	c.Contributers    = []string{}
+	c.TastingApproved = false									// A changed recipe has to be tasted again
+
+	for _, line := range recipe.Ingredients			{ c.Ingredients  = append(c.Ingredients, line.Name) }
+	for _, contributor := range recipe.Contributors	{ c.Contributers = append(c.Contributers, contributor.Name) }
+
+	c.Method = strings.Join(recipe.Steps, "; ")
+
+	if version.Version > 1 { c.Revisions = append(c.Revisions, reason) }
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("REVISE_RECIPE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return []byte(strconv.Itoa(version.Version)), nil
+}
+
+//==============================================================================================================================
+//	 parse_version - Converts the version number passed, defaulting to the current version of the chocolates' recipe.
+//==============================================================================================================================
+func parse_version(c Chocolates, value string) (int, error) {
+
+	if value == "" {
+		if c.RecipeVersion == 0 { return 0, errors.New("No recipe has been recorded for " + c.ChocoID) }
+		return c.RecipeVersion, nil
+	}
+
+	version, err := strconv.Atoi(value)
+															if err != nil || version < 1 || version > c.RecipeVersion { return 0, errors.New("Invalid recipe version " + value) }
+
+	return version, nil
+}
+
+//==============================================================================================================================
+//	 get_recipe_version - Returns the version of the chocolates' recipe passed, or the current version if none is passed.
+//						  The caller must be allowed to see the chocolates themselves.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_recipe_version(stub Stub, caller string, caller_affiliation int, chocoID string, version_value string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	version, err := parse_version(c, version_value)
+															if err != nil { return nil, err }
+
+	v, err := t.retrieve_recipe_version(stub, chocoID, version)
+															if err != nil { return nil, err }
+
+	return json.Marshal(v)
+}
+
+//==============================================================================================================================
+//	 diff_recipe_versions - Returns what changed in the chocolates' recipe between the two versions passed, along with the
+//							reasons given for every version after the first.
+//==============================================================================================================================
+func (t *SimpleChaincode) diff_recipe_versions(stub Stub, caller string, caller_affiliation int, chocoID string, from_value string, to_value string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	from_version, err := parse_version(c, from_value)
+															if err != nil { return nil, err }
+
+	to_version, err := parse_version(c, to_value)
+															if err != nil { return nil, err }
+															if from_version > to_version { return nil, errors.New("From version must not be after to version") }
+
+	diff := Recipe_Diff{
+		ChocoID:				chocoID,
+		From:					from_version,
+		To:						to_version,
+		Reasons:				[]string{},
+		AddedIngredients:		[]Recipe_Ingredient{},
+		RemovedIngredients:		[]Recipe_Ingredient{},
+		ChangedIngredients:		[]Ingredient_Change{},
+		AddedContributors:		[]Recipe_Contributor{},
+		RemovedContributors:	[]Recipe_Contributor{},
+		ChangedContributors:	[]Contributor_Change{},
+	}
+
+	var from, to Recipe_Version
+
+	for version := from_version; version <= to_version; version++ {
+
+		v, err := t.retrieve_recipe_version(stub, chocoID, version)
+															if err != nil { return nil, err }
+
+		if version == from_version	{ from = v } else { diff.Reasons = append(diff.Reasons, v.Reason) }
+		if version == to_version	{ to = v }
+	}
+
+	old_ingredients := map[string]Recipe_Ingredient{}
+
+	for _, line := range from.Recipe.Ingredients { old_ingredients[line.Name] = line }
+
+	for _, line := range to.Recipe.Ingredients {
+
+		old, ok := old_ingredients[line.Name]
+
+		if !ok					{ diff.AddedIngredients = append(diff.AddedIngredients, line)
+		} else if old != line	{ diff.ChangedIngredients = append(diff.ChangedIngredients, Ingredient_Change{ Name: line.Name, Old: old, New: line }) }
+
+		delete(old_ingredients, line.Name)
+	}
+
+	for _, line := range from.Recipe.Ingredients {
+		if _, ok := old_ingredients[line.Name]; ok { diff.RemovedIngredients = append(diff.RemovedIngredients, line) }
+	}
+
+	old_roles := map[string]string{}
+
+	for _, contributor := range from.Recipe.Contributors { old_roles[contributor.Name] = contributor.Role }
+
+	for _, contributor := range to.Recipe.Contributors {
+
+		role, ok := old_roles[contributor.Name]
+
+		if !ok							{ diff.AddedContributors = append(diff.AddedContributors, contributor)
+		} else if role != contributor.Role	{ diff.ChangedContributors = append(diff.ChangedContributors, Contributor_Change{ Name: contributor.Name, OldRole: role, NewRole: contributor.Role }) }
+
+		delete(old_roles, contributor.Name)
+	}
+
+	for _, contributor := range from.Recipe.Contributors {
+		if _, ok := old_roles[contributor.Name]; ok { diff.RemovedContributors = append(diff.RemovedContributors, contributor) }
+	}
+
+	diff.Steps = diff_steps(from.Recipe.Steps, to.Recipe.Steps)
+
+	return json.Marshal(diff)
+}
+
+//==============================================================================================================================
+//	 diff_steps - Compares two lists of method steps, keeping the longest run of steps common to both in order and marking
+//				  the others as added or removed.
+//==============================================================================================================================
+func diff_steps(old []string, new []string) []Step_Change {
+
+	common := make([][]int, len(old) + 1)					// common[i][j] is the longest common run of old[i:] and new[j:]
+
+	for i := range common { common[i] = make([]int, len(new) + 1) }
+
+	for i := len(old) - 1; i >= 0; i-- {
+		for j := len(new) - 1; j >= 0; j-- {
+			if old[i] == new[j]								{ common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1]		{ common[i][j] = common[i+1][j]
+			} else											{ common[i][j] = common[i][j+1] }
+		}
+	}
+
+	changes := []Step_Change{}
+
+	i, j := 0, 0
+
+	for i < len(old) || j < len(new) {
+
+		if i < len(old) && j < len(new) && old[i] == new[j] {
+			changes = append(changes, Step_Change{ "kept", old[i] }); i++; j++
+		} else if j < len(new) && (i == len(old) || common[i][j+1] >= common[i+1][j]) {
+			changes = append(changes, Step_Change{ "added", new[j] }); j++
+		} else {
+			changes = append(changes, Step_Change{ "removed", old[i] }); i++
+		}
+	}
+
+	return changes
+}
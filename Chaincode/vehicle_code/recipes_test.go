@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const test_recipe = `{"ingredients": [{"name": "cocoa", "quantity": 70, "unit": "%"}, {"name": "sugar", "quantity": 25, "unit": "%"}],
+	"steps": ["Conche for 48 hours", "Temper at 31C", "Mould"], "contributors": [{"name": "Chef Watson", "role": "concept"}]}`
+
+const test_revision = `{"ingredients": [{"name": "cocoa", "quantity": 72, "unit": "%"}, {"name": "hazelnut", "quantity": 10, "unit": "%"}],
+	"steps": ["Roast hazelnuts", "Conche for 48 hours", "Temper at 31C", "Mould"],
+	"contributors": [{"name": "Chef Watson", "role": "reviewer"}, {"name": "Chocolatier", "role": "method"}]}`
+
+func TestReviseRecipe(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+
+	if _, err := l.query("durhone", "get_recipe_version", "AB1234567"); err == nil { t.Error("expected query before any recipe to fail") }
+
+	if v := string(l.must_invoke("durhone", "revise_recipe", test_recipe, "First draft", "AB1234567")); v != "1" { t.Errorf("version = %s, want 1", v) }
+	if v := string(l.must_invoke("durhone", "revise_recipe", test_revision, "More cocoa, add hazelnut", "AB1234567")); v != "2" { t.Errorf("version = %s, want 2", v) }
+
+	if l.stub.event_name != EVENT_UPDATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_UPDATED) }
+
+	c := l.chocolates("AB1234567")
+
+	if c.RecipeVersion != 2 || len(c.Ingredients) != 2 || c.Ingredients[1] != "hazelnut" || len(c.Contributers) != 2 || len(c.Revisions) != 1 {
+		t.Errorf("unexpected chocolates %+v", c)
+	}
+
+	var first Recipe_Version
+	json.Unmarshal(l.must_query("durhone", "get_recipe_version", "AB1234567", "1"), &first)
+
+	if first.Version != 1 || first.Author != "durhone" || first.Reason != "First draft" || first.Timestamp == "" || len(first.Recipe.Steps) != 3 {
+		t.Errorf("unexpected version %+v", first)
+	}
+
+	var current Recipe_Version
+	json.Unmarshal(l.must_query("durhone", "get_recipe_version", "AB1234567"), &current)
+
+	if current.Version != 2 || current.Recipe.Ingredients[0].Quantity != 72 { t.Errorf("unexpected current version %+v", current) }
+
+	for _, version := range []string{ "0", "3", "two" } {
+		if _, err := l.query("durhone", "get_recipe_version", "AB1234567", version); err == nil { t.Errorf("expected version %s to fail", version) }
+	}
+
+	if _, err := l.query("printer", "get_recipe_version", "AB1234567"); err == nil { t.Error("expected query by printer to fail") }
+
+	if _, err := l.invoke("durhone", "revise_recipe", test_recipe, " ", "AB1234567"); err == nil { t.Error("expected revision without a reason to fail") }
+	if _, err := l.invoke("printer", "revise_recipe", test_recipe, "Mine", "AB1234567"); err == nil { t.Error("expected revision by printer to fail") }
+
+	l.advance("AA0000001", STATE_PRODUCTION)
+
+	if _, err := l.invoke("durhone", "revise_recipe", test_recipe, "Too late", "AA0000001"); err == nil { t.Error("expected revision after finalizing to fail") }
+}
+
+func TestRecipeValidation(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+
+	tests := map[string][]Field_Error{
+		`["cocoa"]`:
+			{ { "recipe", "must be a JSON object" } },
+		`{"ingredients": [], "steps": "mix", "colour": "brown"}`:
+			{ { "colour", "unknown field" }, { "ingredients", "must not be empty" }, { "steps", "must be an array of steps" }, { "contributors", "is required" } },
+		`{"ingredients": [{"name": "cocoa", "quantity": 70, "unit": "%"}, {"name": "cocoa", "quantity": 0}], "steps": ["Mould", " "], "contributors": [{"name": "Chef Watson"}]}`:
+			{ { "ingredients[1].unit", "must not be empty" }, { "ingredients[1].name", "appears more than once" }, { "ingredients[1].quantity", "must be greater than zero" },
+			  { "steps[1]", "must not be empty" }, { "contributors[0].role", "must not be empty" } },
+	}
+
+	for recipe_json, want := range tests {
+
+		_, err := l.invoke("durhone", "revise_recipe", recipe_json, "Testing", "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected Validation_Error, got %v", recipe_json, err); continue }
+
+		got, _    := json.Marshal(invalid.Fields)
+		wanted, _ := json.Marshal(want)
+
+		if string(got) != string(wanted) { t.Errorf("%s: fields = %s, want %s", recipe_json, got, wanted) }
+	}
+
+	if c := l.chocolates("AB1234567"); c.RecipeVersion != 0 { t.Errorf("recipe version = %d, want 0", c.RecipeVersion) }
+}
+
+func TestDiffRecipeVersions(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+	l.must_invoke("durhone", "revise_recipe", test_recipe, "First draft", "AB1234567")
+	l.must_invoke("durhone", "revise_recipe", test_revision, "More cocoa, add hazelnut", "AB1234567")
+
+	var diff Recipe_Diff
+	json.Unmarshal(l.must_query("durhone", "diff_recipe_versions", "AB1234567", "1", "2"), &diff)
+
+	if len(diff.Reasons) != 1 || diff.Reasons[0] != "More cocoa, add hazelnut" { t.Errorf("reasons = %v", diff.Reasons) }
+
+	if len(diff.AddedIngredients) != 1 || diff.AddedIngredients[0].Name != "hazelnut" { t.Errorf("added ingredients = %+v", diff.AddedIngredients) }
+	if len(diff.RemovedIngredients) != 1 || diff.RemovedIngredients[0].Name != "sugar" { t.Errorf("removed ingredients = %+v", diff.RemovedIngredients) }
+	if len(diff.ChangedIngredients) != 1 || diff.ChangedIngredients[0].Old.Quantity != 70 || diff.ChangedIngredients[0].New.Quantity != 72 {
+		t.Errorf("changed ingredients = %+v", diff.ChangedIngredients)
+	}
+
+	if len(diff.AddedContributors) != 1 || diff.AddedContributors[0].Name != "Chocolatier" { t.Errorf("added contributors = %+v", diff.AddedContributors) }
+	if len(diff.RemovedContributors) != 0 { t.Errorf("removed contributors = %+v", diff.RemovedContributors) }
+	if len(diff.ChangedContributors) != 1 || diff.ChangedContributors[0].OldRole != "concept" || diff.ChangedContributors[0].NewRole != "reviewer" {
+		t.Errorf("changed contributors = %+v", diff.ChangedContributors)
+	}
+
+	got, _ := json.Marshal(diff.Steps)
+
+	if want := `[{"change":"added","step":"Roast hazelnuts"},{"change":"kept","step":"Conche for 48 hours"},{"change":"kept","step":"Temper at 31C"},{"change":"kept","step":"Mould"}]`; string(got) != want {
+		t.Errorf("steps = %s, want %s", got, want)
+	}
+
+	if _, err := l.query("durhone", "diff_recipe_versions", "AB1234567", "2", "1"); err == nil { t.Error("expected reversed versions to fail") }
+	if _, err := l.query("supplier", "diff_recipe_versions", "AB1234567", "1", "2"); err == nil { t.Error("expected diff by supplier to fail") }
+}
+
+func TestDiffSteps(t *testing.T) {
+
+	got, _ := json.Marshal(diff_steps([]string{ "a", "b", "c", "d" }, []string{ "a", "c", "e", "d" }))
+
+	if want := `[{"change":"kept","step":"a"},{"change":"removed","step":"b"},{"change":"kept","step":"c"},{"change":"added","step":"e"},{"change":"kept","step":"d"}]`; string(got) != want {
+		t.Errorf("steps = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+//==============================================================================================================================
+//	 Rework reasons - The codes that can be given for sending chocolates back a stage. Each rework transition in the
+//					  lifecycle lists the codes that apply to it.
+//==============================================================================================================================
+const   REWORK_TASTING_FAILED		= "TASTING_FAILED"
+const   REWORK_RECIPE_CHANGE		= "RECIPE_CHANGE"
+const   REWORK_PRINT_DEFECT			= "PRINT_DEFECT"
+const   REWORK_WRONG_ARTWORK		= "WRONG_ARTWORK"
+const   REWORK_RETURNED				= "RETURNED"
+const   REWORK_DAMAGED_IN_TRANSIT	= "DAMAGED_IN_TRANSIT"
+
+//==============================================================================================================================
+//	Rework - Records one time the chocolates were sent back a stage, by whom and why.
+//==============================================================================================================================
+type Rework struct {
+	Function		string					`json:"function"`
+	FromStatus		int						`json:"fromStatus"`
+	ToStatus		int						`json:"toStatus"`
+	Reason			string					`json:"reason"`
+	Caller			string					`json:"caller"`
+	Date			string					`json:"date"`
+}
+
+//=================================================================================================================================
+//	 rework - Sends the chocolates back a stage through the rework transition passed. The reason code must be one the
+//			  transition accepts; it is recorded on the chocolates, and so in their history, and the rework count goes up.
+//			  The transfer is otherwise checked and made like any other.
+//=================================================================================================================================
+func (t *SimpleChaincode) rework(stub Stub, transition Transition, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int, reason string) ([]byte, error) {
+
+	reason = strings.ToUpper(strings.TrimSpace(reason))
+
+	valid := false
+
+	for _, code := range transition.Reasons { if code == reason { valid = true } }
+
+															if !valid { return nil, errors.New("Invalid reason code for " + transition.Function + ": must be one of " + strings.Join(transition.Reasons, ", ")) }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	c.ReworkCount++
+	c.Reworks = append(c.Reworks, Rework{ transition.Function, transition.From, transition.To, reason, caller, date })
+
+	return t.transfer(stub, transition, c, caller, caller_affiliation, recipient_name, recipient_affiliation)
+}
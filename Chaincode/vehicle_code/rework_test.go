@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+func TestReworkTransitions(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		user		string
+		function	string
+		recipient	string
+		reason		string
+		ok			bool
+		want_status	int
+	}{
+		{ "testing to concepting",			STATE_TESTING,		"durhone",	"testing_to_concepting",	"durhone",	"TASTING_FAILED",		true,	STATE_CONCEPTING },
+		{ "supplying to printing",			STATE_SUPPLYING,	"supplier",	"supplying_to_printing",	"printer",	"print_defect",			true,	STATE_PRINTING },
+		{ "delivery to production",			STATE_DELIVERY,		"shipper",	"delivery_to_production",	"durhone",	"RETURNED",				true,	STATE_PRODUCTION },
+		{ "reason for another transition",	STATE_TESTING,		"durhone",	"testing_to_concepting",	"durhone",	"PRINT_DEFECT",			false,	0 },
+		{ "no reason",						STATE_DELIVERY,		"shipper",	"delivery_to_production",	"durhone",	"",						false,	0 },
+		{ "caller is not the custodian",	STATE_SUPPLYING,	"printer",	"supplying_to_printing",	"printer",	"PRINT_DEFECT",			false,	0 },
+		{ "rework from the wrong state",	STATE_PRODUCTION,	"durhone",	"testing_to_concepting",	"durhone",	"RECIPE_CHANGE",		false,	0 },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			_, err := l.invoke(test.user, test.function, test.recipient, test.reason, "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			c := l.chocolates("AB1234567")
+
+			if !test.ok {
+				if c.Status != test.state || c.ReworkCount != 0 { t.Errorf("denied rework changed the record: %+v", c) }
+				return
+			}
+
+			if c.Status != test.want_status || c.Custodian != test.recipient || c.ReworkCount != 1 { t.Errorf("unexpected chocolates %+v", c) }
+
+			if len(c.Reworks) != 1 || c.Reworks[0].Reason != strings.ToUpper(test.reason) || c.Reworks[0].FromStatus != test.state || c.Reworks[0].Caller != test.user {
+				t.Errorf("reworks = %+v", c.Reworks)
+			}
+
+			if l.stub.event_name != EVENT_TRANSFERRED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_TRANSFERRED) }
+		})
+	}
+}
+
+func TestReworkAndRetest(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_TESTING)
+	l.register("durhone", DU_RHONE)
+	l.must_invoke("durhone", "update_testers", `["durhone"]`, "AB1234567")
+	l.must_invoke("durhone", "open_tasting_session", "AB1234567")
+	l.must_invoke("durhone", "submit_tasting_score", `{"scores": {"flavour": 2, "texture": 3, "appearance": 4}, "approved": false}`, "AB1234567")
+	l.must_invoke("durhone", "close_tasting_session", "AB1234567")
+
+	l.must_invoke("durhone", "testing_to_concepting", "durhone", "TASTING_FAILED", "AB1234567")
+
+	c := l.chocolates("AB1234567")
+
+	if is_defined(c.Test) || is_defined(c.DateFinalized) || c.TastingApproved { t.Errorf("test results not reset: %+v", c) }
+
+	l.must_invoke("durhone", "revise_recipe", test_recipe, "Less bitter", "AB1234567")
+	l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")
+	l.must_invoke("printer", "printing_to_supplying", "supplier", "AB1234567")
+	l.must_invoke("supplier", "supplying_to_printing", "printer", "WRONG_ARTWORK", "AB1234567")
+	l.must_invoke("printer", "printing_to_supplying", "supplier", "AB1234567")
+
+	if _, err := l.invoke("supplier", "supplying_to_testing", "durhone", "AB1234567"); err == nil { t.Error("expected testing before the reprinted boxes arrive to fail") }
+
+	c = l.chocolates("AB1234567")
+
+	if c.ReworkCount != 2 || len(c.Reworks) != 2 || c.Reworks[1].Reason != REWORK_WRONG_ARTWORK { t.Errorf("unexpected reworks %d %+v", c.ReworkCount, c.Reworks) }
+
+	var history []History_Entry
+	json.Unmarshal(l.must_query("durhone", "get_chocolate_history", "AB1234567"), &history)
+
+	found := false
+
+	for _, entry := range history {
+		if entry.Function != "testing_to_concepting" { continue }
+		for _, change := range entry.Changes { if change.Field == "reworkCount" { found = true } }
+	}
+
+	if !found { t.Error("rework not recorded in history") }
+
+	if _, err := l.invoke("durhone", "set_approval_policy", "testing_to_concepting", `{"signers": [{"role": 1}]}`); err == nil { t.Error("expected approval policy on a rework transition to fail") }
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Shipment index - Shipments are stored under \x00shipment\x00<shipmentID>. Shipment IDs follow the same format as lot IDs.
+//==============================================================================================================================
+const   INDEX_SHIPMENT				= "shipment"
+
+const   SHIPMENT_PLANNED			= "planned"
+const   SHIPMENT_IN_TRANSIT			= "in_transit"
+const   SHIPMENT_DELIVERED			= "delivered"
+const   SHIPMENT_RETURNED			= "returned"
+const   SHIPMENT_CANCELLED			= "cancelled"
+
+//==============================================================================================================================
+//	Shipment - Defines the structure of the shipment of a chocolates record from Origin to Destination. The chocolates travel
+//			   each leg in turn with its carrier and are handed from one carrier to the next at the end of every leg but the
+//			   last. CurrentLeg is the leg the chocolates are on. JSON passed to create_shipment {"shipmentID": "SH-1",
+//			   "origin": "Brussels", "destination": "Armonk", "legs": [{"carrier": "shipper", "from": "Brussels", "to":
+//			   "Antwerp", "plannedDeparture": "2016-08-10T09:00:00Z", "plannedArrival": "2016-08-10T12:00:00Z"}, ...]}
+//==============================================================================================================================
+type Shipment struct {
+	ShipmentID		string					`json:"shipmentID"`
+	ChocoID			string					`json:"chocoID"`
+	Origin			string					`json:"origin"`
+	Destination		string					`json:"destination"`
+	Status			string					`json:"status"`
+	CurrentLeg		int						`json:"currentLeg"`
+	Legs			[]Shipment_Leg			`json:"legs"`
+	Handovers		[]Handover				`json:"handovers"`
+	CreatedBy		string					`json:"createdBy"`
+	DateCreated		string					`json:"dateCreated"`
+}
+
+type Shipment_Leg struct {
+	Carrier				string				`json:"carrier"`
+	From				string				`json:"from"`
+	To					string				`json:"to"`
+	PlannedDeparture	string				`json:"plannedDeparture"`
+	PlannedArrival		string				`json:"plannedArrival"`
+	ActualDeparture		string				`json:"actualDeparture"`
+	ActualArrival		string				`json:"actualArrival"`
+}
+
+//==============================================================================================================================
+//	Handover - Records the chocolates passing from the carrier of one leg to the carrier of the next. The handover is
+//			   signed by the sender when it is offered and by the receiver when it is accepted; Receiver is nil until then.
+//==============================================================================================================================
+type Handover struct {
+	Leg				int						`json:"leg"`
+	From			string					`json:"from"`
+	To				string					`json:"to"`
+	Location		string					`json:"location"`
+	Sender			Handover_Signature		`json:"sender"`
+	Receiver		*Handover_Signature		`json:"receiver"`
+}
+
+type Handover_Signature struct {
+	Username		string					`json:"username"`
+	TxID			string					`json:"txID"`
+	Timestamp		string					`json:"timestamp"`
+}
+
+//==============================================================================================================================
+//	 parse_shipment - Validates the JSON shipment passed, returning a Validation_Error listing every field that is invalid.
+//					  The legs must join up from the origin to the destination, each carried by a shipping company, and
+//					  each planned to leave no earlier than the one before arrives.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_shipment(stub Stub, value string) (Shipment, error) {
+
+	var s Shipment
+
+	err := json.Unmarshal([]byte(value), &s)
+															if err != nil { return s, &Validation_Error{ []Field_Error{ { "shipment", "must be a JSON object" } } } }
+
+	invalid := &Validation_Error{}
+
+	s.ShipmentID  = strings.TrimSpace(s.ShipmentID)
+	s.Origin      = strings.TrimSpace(s.Origin)
+	s.Destination = strings.TrimSpace(s.Destination)
+
+	if !lot_id.MatchString(s.ShipmentID)	{ invalid.add("shipmentID", "must be up to 64 letters, digits, dots, dashes or underscores") }
+	if s.Origin == ""						{ invalid.add("origin", "must not be empty") }
+	if s.Destination == ""					{ invalid.add("destination", "must not be empty") }
+
+	if len(s.Legs) == 0 || len(s.Legs) > MAX_LIST_LENGTH { invalid.add("legs", "must have between 1 and " + strconv.Itoa(MAX_LIST_LENGTH) + " legs") }
+
+	var previous_arrival time.Time
+
+	for i := range s.Legs {
+
+		leg   := &s.Legs[i]
+		field := fmt.Sprintf("legs[%d]", i)
+
+		leg.Carrier = strings.TrimSpace(leg.Carrier)
+		leg.From    = strings.TrimSpace(leg.From)
+		leg.To      = strings.TrimSpace(leg.To)
+
+		leg.ActualDeparture = "UNDEFINED"
+		leg.ActualArrival   = "UNDEFINED"
+
+		if affiliation, err := t.get_affiliation(stub, leg.Carrier); err != nil || affiliation != SHIPPING_CO {
+			invalid.add(field + ".carrier", "must be a shipping company")
+		} else if i > 0 && leg.Carrier == s.Legs[i-1].Carrier {
+			invalid.add(field + ".carrier", "must differ from the carrier of the leg before")
+		}
+
+		expected_from := s.Origin
+
+		if i > 0 { expected_from = s.Legs[i-1].To }
+
+		if leg.From != expected_from						{ invalid.add(field + ".from", "must be where the shipment is at the start of the leg, " + expected_from) }
+		if i == len(s.Legs) - 1 && leg.To != s.Destination	{ invalid.add(field + ".to", "must be the destination of the shipment") }
+		if leg.To == ""										{ invalid.add(field + ".to", "must not be empty") }
+
+		departure, err := time.Parse(TIME_FORMAT, leg.PlannedDeparture)
+
+		if err != nil										{ invalid.add(field + ".plannedDeparture", "must be an RFC 3339 timestamp")
+		} else if i > 0 && departure.Before(previous_arrival)	{ invalid.add(field + ".plannedDeparture", "must not be before the leg before arrives") }
+
+		arrival, err := time.Parse(TIME_FORMAT, leg.PlannedArrival)
+
+		if err != nil										{ invalid.add(field + ".plannedArrival", "must be an RFC 3339 timestamp")
+		} else if !arrival.After(departure)					{ invalid.add(field + ".plannedArrival", "must be after the planned departure") }
+
+		previous_arrival = arrival
+	}
+
+	if len(invalid.Fields) > 0 { return s, invalid }
+
+	return s, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_shipment - Returns the shipment with the ID passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_shipment(stub Stub, shipmentID string) (Shipment, error) {
+
+	var s Shipment
+
+	key, err := create_index_key(INDEX_SHIPMENT, shipmentID)
+															if err != nil { return s, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return s, errors.New("Error retrieving shipment") }
+															if bytes == nil { return s, errors.New("Shipment not found: " + shipmentID) }
+
+	err = json.Unmarshal(bytes, &s)
+															if err != nil { return s, errors.New("Corrupt shipment " + shipmentID) }
+
+	return s, nil
+}
+
+//==============================================================================================================================
+//	 save_shipment - Writes the shipment passed to the ledger.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_shipment(stub Stub, s Shipment) error {
+
+	key, err := create_index_key(INDEX_SHIPMENT, s.ShipmentID)
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(s)
+															if err != nil { return errors.New("Error converting shipment") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_SHIPMENT: Error storing shipment: %s", err); return errors.New("Error storing shipment") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 sign - Returns the caller's signature for the current transaction.
+//==============================================================================================================================
+func (t *SimpleChaincode) sign(stub Stub, caller string) (Handover_Signature, error) {
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return Handover_Signature{}, err }
+
+	return Handover_Signature{ Username: caller, TxID: stub.GetTxID(), Timestamp: now.Format(TIME_FORMAT) }, nil
+}
+
+//=================================================================================================================================
+//	 create_shipment - Plans the shipment of chocolates in production. The shipment ID also becomes the chocolates'
+//					   deliverer ID. Once planned, production_to_delivery must hand the chocolates to the carrier of the
+//					   first leg.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_shipment(stub Stub, c Chocolates, caller string, caller_affiliation int, shipment_json string) ([]byte, error) {
+
+	if 		c.Status			!= STATE_PRODUCTION		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= DU_RHONE				||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+															if is_defined(c.ShipmentID) { return nil, errors.New("Chocolates already have shipment " + c.ShipmentID) }
+
+	s, err := t.parse_shipment(stub, shipment_json)
+															if err != nil { return nil, err }
+
+	if _, err := t.retrieve_shipment(stub, s.ShipmentID); err == nil { return nil, errors.New("Shipment already exists: " + s.ShipmentID) }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { return nil, errors.New("Error retrieving transaction date") }
+
+	s.ChocoID     = c.ChocoID
+	s.Status      = SHIPMENT_PLANNED
+	s.CurrentLeg  = 0
+	s.Handovers   = []Handover{}
+	s.CreatedBy   = caller
+	s.DateCreated = date
+
+	err = t.save_shipment(stub, s)
+															if err != nil { return nil, err }
+
+	c.ShipmentID  = s.ShipmentID
+	c.DelivererID = s.ShipmentID
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("CREATE_SHIPMENT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return []byte(s.ShipmentID), nil
+}
+
+//=================================================================================================================================
+//	 depart_shipment - Run by production_to_delivery. Chocolates can only leave production once their shipment has been
+//					   planned, and must be handed to the carrier of its first leg, which then sets off.
+//=================================================================================================================================
+func (t *SimpleChaincode) depart_shipment(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	s, err := t.current_shipment(stub, *c)
+															if err != nil { return err }
+															if recipient_name != s.Legs[0].Carrier { return errors.New("Chocolates must be handed to " + s.Legs[0].Carrier + ", the carrier of the first leg of shipment " + s.ShipmentID) }
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return err }
+
+	s.Status = SHIPMENT_IN_TRANSIT
+	s.Legs[0].ActualDeparture = now.Format(TIME_FORMAT)
+
+	return t.save_shipment(stub, s)
+}
+
+//=================================================================================================================================
+//	 arrive_shipment - Run by delivery_to_delivered. Chocolates can only be delivered by the carrier of the final leg of
+//					   their shipment, which then arrives.
+//=================================================================================================================================
+func (t *SimpleChaincode) arrive_shipment(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	s, err := t.current_shipment(stub, *c)
+															if err != nil { return err }
+
+	last := len(s.Legs) - 1
+															if s.CurrentLeg != last || caller != s.Legs[last].Carrier { return errors.New("Only " + s.Legs[last].Carrier + ", the carrier of the final leg of shipment " + s.ShipmentID + ", can deliver the chocolates") }
+
+	now, err := t.get_tx_time(stub)
+															if err != nil { return err }
+
+	s.Status = SHIPMENT_DELIVERED
+	s.Legs[last].ActualArrival = now.Format(TIME_FORMAT)
+
+	return t.save_shipment(stub, s)
+}
+
+//=================================================================================================================================
+//	 return_shipment - Run by delivery_to_production. The shipment of returned chocolates is ended and a new one can be
+//					   planned.
+//=================================================================================================================================
+func (t *SimpleChaincode) return_shipment(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	s, err := t.current_shipment(stub, *c)
+															if err != nil { return err }
+
+	s.Status     = SHIPMENT_RETURNED
+	c.ShipmentID = "UNDEFINED"
+
+	return t.save_shipment(stub, s)
+}
+
+//=================================================================================================================================
+//	 cancel_shipment - Run by discontinue_chocolates. A shipment planned for the chocolates, or under way, is cancelled so
+//					   it isn't left in transit. The chocolates keep its ID as a record of where they were.
+//=================================================================================================================================
+func (t *SimpleChaincode) cancel_shipment(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	if !is_defined(c.ShipmentID) { return nil }
+
+	s, err := t.retrieve_shipment(stub, c.ShipmentID)
+															if err != nil { return err }
+
+	if s.Status != SHIPMENT_PLANNED && s.Status != SHIPMENT_IN_TRANSIT { return nil }
+
+	s.Status = SHIPMENT_CANCELLED
+
+	return t.save_shipment(stub, s)
+}
+
+//=================================================================================================================================
+//	 handover_shipment - Offers the chocolates to the carrier of the next leg at the end of the caller's leg, signed by the
+//						 caller. Custody passes once the next carrier accepts.
+//=================================================================================================================================
+func (t *SimpleChaincode) handover_shipment(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	s, err := t.current_shipment(stub, c)
+															if err != nil { return nil, err }
+
+	if 		c.Status			!= STATE_DELIVERY		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= SHIPPING_CO			||
+			s.Status			!= SHIPMENT_IN_TRANSIT	||
+			s.Legs[s.CurrentLeg].Carrier	!= caller	{
+															return nil, errors.New("Permission denied")
+	}
+
+															if s.CurrentLeg == len(s.Legs) - 1 { return nil, errors.New("The chocolates are on the final leg of shipment " + s.ShipmentID) }
+															if pending_handover(s) != nil { return nil, errors.New("A handover is already waiting to be accepted") }
+
+	signature, err := t.sign(stub, caller)
+															if err != nil { return nil, err }
+
+	s.Handovers = append(s.Handovers, Handover{
+		Leg:		s.CurrentLeg,
+		From:		caller,
+		To:			s.Legs[s.CurrentLeg + 1].Carrier,
+		Location:	s.Legs[s.CurrentLeg].To,
+		Sender:		signature,
+	})
+
+	return nil, t.save_shipment(stub, s)
+}
+
+//=================================================================================================================================
+//	 accept_handover - Accepts the chocolates offered to the caller, signed by the caller. The leg they were on ends, the
+//					   caller's leg begins and the caller becomes their custodian.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_handover(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	s, err := t.current_shipment(stub, c)
+															if err != nil { return nil, err }
+
+	handover := pending_handover(s)
+															if handover == nil { return nil, errors.New("No handover is waiting to be accepted") }
+															if handover.To != caller || caller_affiliation != SHIPPING_CO || c.Status != STATE_DELIVERY { return nil, errors.New("Permission denied") }
+
+	signature, err := t.sign(stub, caller)
+															if err != nil { return nil, err }
+
+	handover.Receiver = &signature
+
+	s.Legs[s.CurrentLeg].ActualArrival = signature.Timestamp
+	s.CurrentLeg++
+	s.Legs[s.CurrentLeg].ActualDeparture = signature.Timestamp
+
+	err = t.save_shipment(stub, s)
+															if err != nil { return nil, err }
+
+	c.Custodian     = caller
+	c.CustodianRole = caller_affiliation
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("ACCEPT_HANDOVER: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 current_shipment - Returns the chocolates' shipment, or an error if none has been planned with create_shipment.
+//==============================================================================================================================
+func (t *SimpleChaincode) current_shipment(stub Stub, c Chocolates) (Shipment, error) {
+
+															if !is_defined(c.ShipmentID) { return Shipment{}, errors.New("Chocolates have no shipment: plan one with create_shipment") }
+
+	return t.retrieve_shipment(stub, c.ShipmentID)
+}
+
+//==============================================================================================================================
+//	 pending_handover - Returns the handover of the shipment waiting to be accepted, or nil if there is none.
+//==============================================================================================================================
+func pending_handover(s Shipment) *Handover {
+
+	if len(s.Handovers) == 0 { return nil }
+
+	last := &s.Handovers[len(s.Handovers) - 1]
+
+	if last.Receiver != nil { return nil }
+
+	return last
+}
+
+//==============================================================================================================================
+//	 get_shipment - Returns the shipment with the ID passed. It can be seen by its carriers as well as those allowed to see
+//					the chocolates being shipped.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_shipment(stub Stub, caller string, caller_affiliation int, shipmentID string) ([]byte, error) {
+
+	s, err := t.retrieve_shipment(stub, shipmentID)
+															if err != nil { return nil, err }
+
+	for _, leg := range s.Legs {
+		if leg.Carrier == caller { return json.Marshal(s) }
+	}
+
+	c, err := t.retrieve_chocoID(stub, s.ChocoID)
+															if err != nil { return nil, err }
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	return json.Marshal(s)
+}
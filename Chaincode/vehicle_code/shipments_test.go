@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const test_shipment = `{"shipmentID": "SH-1", "origin": "Brussels", "destination": "Armonk", "legs": [
+	{"carrier": "shipper", "from": "Brussels", "to": "Antwerp", "plannedDeparture": "2016-08-10T09:00:00Z", "plannedArrival": "2016-08-10T12:00:00Z"},
+	{"carrier": "shipper2", "from": "Antwerp", "to": "Armonk", "plannedDeparture": "2016-08-10T14:00:00Z", "plannedArrival": "2016-08-20T12:00:00Z"}]}`
+
+func new_shipment_ledger(t *testing.T) *test_ledger {
+
+	l := new_test_ledger(t)
+	l.ecerts.register("shipper2", "shipper2\\group1\\4")
+	l.advance("AB1234567", STATE_PRODUCTION)
+
+	return l
+}
+
+func TestCreateShipment(t *testing.T) {
+
+	l := new_shipment_ledger(t)
+
+	if _, err := l.invoke("shipper", "create_shipment", test_shipment, "AB1234567"); err == nil { t.Error("expected create by shipper to fail") }
+
+	tests := map[string][]Field_Error{
+		`"shipment"`:	{ { "shipment", "must be a JSON object" } },
+		`{"shipmentID": "SH 1", "origin": "Brussels", "destination": "Armonk", "legs": []}`:
+						{ { "shipmentID", "must be up to 64 letters, digits, dots, dashes or underscores" }, { "legs", "must have between 1 and 50 legs" } },
+		`{"shipmentID": "SH-1", "origin": "Brussels", "destination": "Armonk", "legs": [
+			{"carrier": "printer", "from": "Brussels", "to": "Antwerp", "plannedDeparture": "2016-08-10T09:00:00Z", "plannedArrival": "2016-08-10T08:00:00Z"},
+			{"carrier": "shipper", "from": "Ghent", "to": "Boston", "plannedDeparture": "2016-08-10", "plannedArrival": "2016-08-20T12:00:00Z"}]}`:
+						{ { "legs[0].carrier", "must be a shipping company" }, { "legs[0].plannedArrival", "must be after the planned departure" },
+						  { "legs[1].from", "must be where the shipment is at the start of the leg, Antwerp" }, { "legs[1].to", "must be the destination of the shipment" },
+						  { "legs[1].plannedDeparture", "must be an RFC 3339 timestamp" } },
+		`{"shipmentID": "SH-1", "origin": "Brussels", "destination": "Armonk", "legs": [
+			{"carrier": "shipper", "from": "Brussels", "to": "Antwerp", "plannedDeparture": "2016-08-10T09:00:00Z", "plannedArrival": "2016-08-10T12:00:00Z"},
+			{"carrier": "shipper", "from": "Antwerp", "to": "Armonk", "plannedDeparture": "2016-08-10T11:00:00Z", "plannedArrival": "2016-08-20T12:00:00Z"}]}`:
+						{ { "legs[1].carrier", "must differ from the carrier of the leg before" }, { "legs[1].plannedDeparture", "must not be before the leg before arrives" } },
+	}
+
+	for shipment_json, want := range tests {
+
+		_, err := l.invoke("durhone", "create_shipment", shipment_json, "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected a validation error, got %v", shipment_json, err); continue }
+
+		got, _ := json.Marshal(invalid.Fields)
+		expected, _ := json.Marshal(want)
+
+		if string(got) != string(expected) { t.Errorf("%s:\n got %s\nwant %s", shipment_json, got, expected) }
+	}
+
+	if id := string(l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")); id != "SH-1" { t.Errorf("returned ID = %s", id) }
+
+	if l.stub.event_name != EVENT_UPDATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_UPDATED) }
+
+	if _, err := l.invoke("durhone", "create_shipment", test_shipment, "AB1234567"); err == nil { t.Error("expected a second shipment to fail") }
+
+	if c := l.chocolates("AB1234567"); c.ShipmentID != "SH-1" || c.DelivererID != "SH-1" { t.Errorf("unexpected chocolates %+v", c) }
+
+	var s Shipment
+	json.Unmarshal(l.must_query("shipper2", "get_shipment", "SH-1"), &s)
+
+	if s.Status != SHIPMENT_PLANNED || s.ChocoID != "AB1234567" || s.CreatedBy != "durhone" || len(s.Legs) != 2 || s.Legs[1].ActualDeparture != "UNDEFINED" {
+		t.Errorf("unexpected shipment %+v", s)
+	}
+
+	if _, err := l.query("supplier", "get_shipment", "SH-1"); err == nil { t.Error("expected query by supplier to fail") }
+}
+
+func TestShipmentSteps(t *testing.T) {
+
+	departed := func(l *test_ledger) { l.must_invoke("durhone", "production_to_delivery", "shipper", "AB1234567") }
+
+	handed := func(l *test_ledger) {
+		departed(l)
+		l.must_invoke("shipper", "handover_shipment", "AB1234567")
+	}
+
+	accepted := func(l *test_ledger) {
+		handed(l)
+		l.must_invoke("shipper2", "accept_handover", "AB1234567")
+	}
+
+	returned := func(l *test_ledger) {
+		departed(l)
+		l.must_invoke("shipper", "delivery_to_production", "durhone", "DAMAGED_IN_TRANSIT", "AB1234567")
+	}
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		function	string
+		args		[]string
+		ok			bool
+		check		func(l *test_ledger, c Chocolates, s Shipment) bool
+	}{
+		{ "depart",								nil,		"durhone",	"production_to_delivery",	[]string{ "shipper" },		true,
+			func(l *test_ledger, c Chocolates, s Shipment) bool { return c.Custodian == "shipper" && s.Status == SHIPMENT_IN_TRANSIT && is_defined(s.Legs[0].ActualDeparture) } },
+		{ "depart with the second carrier",		nil,		"durhone",	"production_to_delivery",	[]string{ "shipper2" },		false,	nil },
+		{ "deliverer update",					departed,	"shipper",	"update_delivererID",		[]string{ "TRUCK-7" },		false,	nil },
+		{ "delivery by the first carrier",		departed,	"shipper",	"delivery_to_delivered",	[]string{ "ibm" },			false,	nil },
+		{ "accept before a handover",			departed,	"shipper2",	"accept_handover",			nil,						false,	nil },
+		{ "handover by the next carrier",		departed,	"shipper2",	"handover_shipment",		nil,						false,	nil },
+		{ "handover",							departed,	"shipper",	"handover_shipment",		nil,						true,
+			func(l *test_ledger, c Chocolates, s Shipment) bool { return c.Custodian == "shipper" && len(s.Handovers) == 1 && s.Handovers[0].Receiver == nil } },
+		{ "second handover",					handed,		"shipper",	"handover_shipment",		nil,						false,	nil },
+		{ "accept by the sender",				handed,		"shipper",	"accept_handover",			nil,						false,	nil },
+		{ "accept handover",					handed,		"shipper2",	"accept_handover",			nil,						true,
+			func(l *test_ledger, c Chocolates, s Shipment) bool {
+				h := s.Handovers[0]
+				return c.Custodian == "shipper2" && c.Status == STATE_DELIVERY && s.CurrentLeg == 1 && l.stub.event_name == EVENT_TRANSFERRED &&
+					   h.From == "shipper" && h.To == "shipper2" && h.Location == "Antwerp" && h.Sender.TxID != "" && h.Receiver.Username == "shipper2"
+			} },
+		{ "handover on the final leg",			accepted,	"shipper2",	"handover_shipment",		nil,						false,	nil },
+		{ "delivery by the final carrier",		accepted,	"shipper2",	"delivery_to_delivered",	[]string{ "ibm" },			true,
+			func(l *test_ledger, c Chocolates, s Shipment) bool {
+				return s.Status == SHIPMENT_DELIVERED && s.Handovers[0].Receiver.Timestamp == s.Legs[0].ActualArrival && is_defined(s.Legs[1].ActualArrival)
+			} },
+		{ "return",								departed,	"shipper",	"delivery_to_production",	[]string{ "durhone", "DAMAGED_IN_TRANSIT" },	true,
+			func(l *test_ledger, c Chocolates, s Shipment) bool { return s.Status == SHIPMENT_RETURNED && !is_defined(c.ShipmentID) && !is_defined(c.DelivererID) } },
+		{ "depart again without a shipment",	returned,	"durhone",	"production_to_delivery",	[]string{ "shipper" },		false,	nil },
+		{ "plan the returned shipment again",	returned,	"durhone",	"create_shipment",			[]string{ test_shipment },	false,	nil },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_shipment_ledger(t)
+			l.must_invoke("durhone", "create_shipment", test_shipment, "AB1234567")
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, test.function, append(test.args, "AB1234567")...)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if test.check == nil { return }
+
+			s, err := l.cc.retrieve_shipment(l.stub, "SH-1")
+			if err != nil { t.Fatal(err) }
+
+			if c := l.chocolates("AB1234567"); !test.check(l, c, s) { t.Errorf("unexpected chocolates %+v and shipment %+v", c, s) }
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"time"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//==============================================================================================================================
+//	Stub - The operations of the shim that the chaincode uses. Init, Invoke and Query wrap the ChaincodeStub they are given
+//		   in a Shim_Stub; the unit tests pass an in-memory implementation instead.
+//==============================================================================================================================
+type Stub interface {
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	RangeQueryState(startKey string, endKey string) (State_Iterator, error)
+	GetCallerCertificate() ([]byte, error)
+	ReadCertAttribute(attributeName string) ([]byte, error)
+	GetTxID() string
+	GetTxTime() (time.Time, error)
+	SetEvent(name string, payload []byte) error
+}
+
+//==============================================================================================================================
+//	State_Iterator - Iterates over the keys returned by RangeQueryState in key order.
+//==============================================================================================================================
+type State_Iterator interface {
+	HasNext() bool
+	Next() (string, []byte, error)
+	Close() error
+}
+
+//==============================================================================================================================
+//	Shim_Stub - Adapts the HyperLedger ChaincodeStub to the Stub interface.
+//==============================================================================================================================
+type Shim_Stub struct {
+	*shim.ChaincodeStub
+}
+
+//==============================================================================================================================
+//	 RangeQueryState - Returns the ChaincodeStub's range iterator as a State_Iterator.
+//==============================================================================================================================
+func (s Shim_Stub) RangeQueryState(startKey string, endKey string) (State_Iterator, error) {
+
+	iter, err := s.ChaincodeStub.RangeQueryState(startKey, endKey)
+															if err != nil { return nil, err }
+
+	return iter, nil
+}
+
+//==============================================================================================================================
+//	 GetTxID - Returns the UUID of the current transaction.
+//==============================================================================================================================
+func (s Shim_Stub) GetTxID() string {
+
+	return s.ChaincodeStub.UUID
+}
+
+//==============================================================================================================================
+//	 GetTxTime - Returns the timestamp of the current transaction in UTC.
+//==============================================================================================================================
+func (s Shim_Stub) GetTxTime() (time.Time, error) {
+
+	timestamp, err := s.ChaincodeStub.GetTxTimestamp()
+															if err != nil || timestamp == nil { return time.Time{}, errors.New("Couldn't retrieve transaction timestamp") }
+
+	return time.Unix(timestamp.Seconds, int64(timestamp.Nanos)).UTC(), nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	 Tasting index - Tasting sessions are stored under \x00tasting\x00<chocoID>\x00<session>. The session number is zero
+//					 padded so a range query over one chocoID returns its sessions in order.
+//==============================================================================================================================
+const   INDEX_TASTING				= "tasting"
+
+//==============================================================================================================================
+//	 Tasting policy - The number of testers that must approve the chocolates, and the average score they must reach, before
+//					  they can go into production. Passed to Init as JSON and stored under TASTING_POLICY_KEY; ledgers
+//					  without one use the defaults.
+//==============================================================================================================================
+const   TASTING_POLICY_KEY			= "Tasting_Policy"
+const   DEFAULT_MIN_APPROVALS		= 1
+const   DEFAULT_MIN_SCORE			= 6.0
+
+//==============================================================================================================================
+//	 Tasting scores - Testers score every criterion from MIN_TASTING_SCORE to MAX_TASTING_SCORE.
+//==============================================================================================================================
+const   MIN_TASTING_SCORE			= 1
+const   MAX_TASTING_SCORE			= 10
+
+//==============================================================================================================================
+//	 Session status - A session is open until it is closed, or voided if the chocolates are sent back to be reworked first.
+//==============================================================================================================================
+const   SESSION_OPEN				= "open"
+const   SESSION_CLOSED				= "closed"
+const   SESSION_VOID				= "void"
+
+var tasting_criteria = []string{ "appearance", "flavour", "texture" }
+
+//==============================================================================================================================
+//	Tasting_Policy - Defines the approval threshold. JSON {"minApprovals": 2, "minScore": 7.5}
+//==============================================================================================================================
+type Tasting_Policy struct {
+	MinApprovals	int						`json:"minApprovals"`
+	MinScore		float64					`json:"minScore"`
+}
+
+//==============================================================================================================================
+//	Tasting_Result - Defines the structure of the scores submitted by one tester.
+//==============================================================================================================================
+type Tasting_Result struct {
+	Tester			string					`json:"tester"`
+	Scores			map[string]int			`json:"scores"`
+	Approved		bool					`json:"approved"`
+	Comments		string					`json:"comments"`
+	Timestamp		string					`json:"timestamp"`
+}
+
+//==============================================================================================================================
+//	Tasting_Session - Defines the structure of a tasting session. The testers and policy are fixed when the session is
+//					  opened; the approvals, average score and outcome are filled in when it is closed.
+//==============================================================================================================================
+type Tasting_Session struct {
+	ChocoID			string					`json:"chocoID"`
+	Session			int						`json:"session"`
+	Status			string					`json:"status"`
+	OpenedBy		string					`json:"openedBy"`
+	DateOpened		string					`json:"dateOpened"`
+	DateClosed		string					`json:"dateClosed"`
+	Testers			[]string				`json:"testers"`
+	Policy			Tasting_Policy			`json:"policy"`
+	Results			[]Tasting_Result		`json:"results"`
+	Approvals		int						`json:"approvals"`
+	AverageScore	float64					`json:"averageScore"`
+	Approved		bool					`json:"approved"`
+}
+
+//==============================================================================================================================
+//	 parse_tasting_policy - Converts the JSON policy passed to Init, checking that it can be met.
+//==============================================================================================================================
+func parse_tasting_policy(value string) (Tasting_Policy, error) {
+
+	var policy Tasting_Policy
+
+	err := json.Unmarshal([]byte(value), &policy)
+															if err != nil { return policy, errors.New("Invalid tasting policy") }
+															if policy.MinApprovals < 1 { return policy, errors.New("Invalid tasting policy: minApprovals must be at least 1") }
+															if policy.MinScore < MIN_TASTING_SCORE || policy.MinScore > MAX_TASTING_SCORE { return policy, errors.New("Invalid tasting policy: minScore must be between " + strconv.Itoa(MIN_TASTING_SCORE) + " and " + strconv.Itoa(MAX_TASTING_SCORE)) }
+
+	return policy, nil
+}
+
+//==============================================================================================================================
+//	 get_tasting_policy - Returns the tasting policy chosen at Init.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tasting_policy(stub Stub) (Tasting_Policy, error) {
+
+	bytes, err := stub.GetState(TASTING_POLICY_KEY)
+															if err != nil { return Tasting_Policy{}, errors.New("Error retrieving tasting policy") }
+
+	if bytes == nil { return Tasting_Policy{ MinApprovals: DEFAULT_MIN_APPROVALS, MinScore: DEFAULT_MIN_SCORE }, nil }
+
+	return parse_tasting_policy(string(bytes))
+}
+
+//==============================================================================================================================
+//	 retrieve_tasting_session - Returns the tasting session of the chocolates with the number passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_tasting_session(stub Stub, chocoID string, session int) (Tasting_Session, error) {
+
+	var s Tasting_Session
+
+	key, err := create_index_key(INDEX_TASTING, chocoID, fmt.Sprintf("%04d", session))
+															if err != nil { return s, err }
+
+	bytes, err := stub.GetState(key)
+															if err != nil { return s, errors.New("Error retrieving tasting session") }
+															if bytes == nil { return s, errors.New("Tasting session " + strconv.Itoa(session) + " not found for " + chocoID) }
+
+	err = json.Unmarshal(bytes, &s)
+															if err != nil { return s, errors.New("Corrupt tasting session") }
+
+	return s, nil
+}
+
+//==============================================================================================================================
+//	 save_tasting_session - Writes the tasting session passed to the ledger.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_tasting_session(stub Stub, s Tasting_Session) error {
+
+	key, err := create_index_key(INDEX_TASTING, s.ChocoID, fmt.Sprintf("%04d", s.Session))
+															if err != nil { return err }
+
+	bytes, err := json.Marshal(s)
+															if err != nil { return errors.New("Error converting tasting session") }
+
+	err = stub.PutState(key, bytes)
+															if err != nil { fmt.Printf("SAVE_TASTING_SESSION: Error storing tasting session: %s", err); return errors.New("Error storing tasting session") }
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 current_session - Returns the chocolates' latest tasting session if it is still open.
+//==============================================================================================================================
+func (t *SimpleChaincode) current_session(stub Stub, c Chocolates) (Tasting_Session, error) {
+
+															if c.TastingSession == 0 { return Tasting_Session{}, errors.New("No tasting session is open for " + c.ChocoID) }
+
+	s, err := t.retrieve_tasting_session(stub, c.ChocoID, c.TastingSession)
+															if err != nil { return s, err }
+															if s.Status != SESSION_OPEN { return s, errors.New("No tasting session is open for " + c.ChocoID) }
+
+	return s, nil
+}
+
+//=================================================================================================================================
+//	 open_tasting_session - Opens a new tasting session for chocolates being tested. The chocolates' testers are invited to
+//							score them under the current tasting policy, and any approval from an earlier session is
+//							withdrawn. Returns the session number.
+//=================================================================================================================================
+func (t *SimpleChaincode) open_tasting_session(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	if 		c.Status			!= STATE_TESTING		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= DU_RHONE				||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+															if len(c.Testers) == 0 { return nil, errors.New("Testers have not been defined") }
+
+	if c.TastingSession > 0 {
+
+		previous, err := t.retrieve_tasting_session(stub, c.ChocoID, c.TastingSession)
+															if err != nil { return nil, err }
+															if previous.Status == SESSION_OPEN { return nil, errors.New("Tasting session " + strconv.Itoa(previous.Session) + " is still open") }
+	}
+
+	policy, err := t.get_tasting_policy(stub)
+															if err != nil { return nil, err }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("OPEN_TASTING_SESSION: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+
+	s := Tasting_Session{
+		ChocoID:		c.ChocoID,
+		Session:		c.TastingSession + 1,
+		Status:			SESSION_OPEN,
+		OpenedBy:		caller,
+		DateOpened:		date,
+		DateClosed:		"UNDEFINED",
+		Testers:		c.Testers,
+		Policy:			policy,
+		Results:		[]Tasting_Result{},
+	}
+
+	err = t.save_tasting_session(stub, s)
+															if err != nil { return nil, err }
+
+	c.TastingSession  = s.Session
+	c.TastingApproved = false
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("OPEN_TASTING_SESSION: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return []byte(strconv.Itoa(s.Session)), nil
+}
+
+//=================================================================================================================================
+//	 submit_tasting_score - Records the caller's scores in the open tasting session. Only testers invited to the session who
+//							are active in the participant registry can submit, once each, while the chocolates are being
+//							tested. JSON {"scores": {"flavour": 8, "texture": 7, "appearance": 9},
+//							"approved": true, "comments": "..."}
+//=================================================================================================================================
+func (t *SimpleChaincode) submit_tasting_score(stub Stub, c Chocolates, caller string, caller_affiliation int, score_json string) ([]byte, error) {
+
+															if c.Status != STATE_TESTING { return nil, errors.New("Permission denied") }
+
+	s, err := t.current_session(stub, c)
+															if err != nil { return nil, err }
+
+	invited := false
+
+	for _, tester := range s.Testers { if tester == caller { invited = true } }
+
+															if !invited { return nil, errors.New("Permission denied") }
+
+	_, err = retrieve_participant(stub, caller)
+															if err != nil { return nil, err }
+
+	for _, result := range s.Results {
+															if result.Tester == caller { return nil, errors.New("Scores have already been submitted by " + caller) }
+	}
+
+	result, err := parse_tasting_result(score_json)
+															if err != nil { return nil, err }
+
+	timestamp, err := t.get_tx_time(stub)
+															if err != nil { return nil, err }
+
+	result.Tester    = caller
+	result.Timestamp = timestamp.Format(TIME_FORMAT)
+
+	s.Results = append(s.Results, result)
+
+	err = t.save_tasting_session(stub, s)
+															if err != nil { return nil, err }
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 parse_tasting_result - Validates the scores passed, returning a Validation_Error listing every field that is invalid.
+//							Every criterion must be scored.
+//==============================================================================================================================
+func parse_tasting_result(value string) (Tasting_Result, error) {
+
+	var result struct {
+		Scores		map[string]json.RawMessage		`json:"scores"`
+		Approved	*bool							`json:"approved"`
+		Comments	string							`json:"comments"`
+	}
+
+	err := json.Unmarshal([]byte(value), &result)
+															if err != nil { return Tasting_Result{}, &Validation_Error{ []Field_Error{ { "scores", "must be a JSON object of scores, approved and comments" } } } }
+
+	invalid := &Validation_Error{}
+
+	scores := map[string]int{}
+
+	names := []string{}
+
+	for name := range result.Scores { names = append(names, name) }
+	for _, name := range tasting_criteria { if _, ok := result.Scores[name]; !ok { names = append(names, name) } }
+
+	sort.Strings(names)
+
+	for _, name := range names {
+
+		known := false
+
+		for _, criterion := range tasting_criteria { if criterion == name { known = true } }
+
+		raw, passed := result.Scores[name]
+		field       := "scores." + name
+
+		if !known	{ invalid.add(field, "unknown criterion"); continue }
+		if !passed	{ invalid.add(field, "is required"); continue }
+
+		var score int
+
+		if err := json.Unmarshal(raw, &score); err != nil || score < MIN_TASTING_SCORE || score > MAX_TASTING_SCORE {
+			invalid.add(field, "must be a whole number from " + strconv.Itoa(MIN_TASTING_SCORE) + " to " + strconv.Itoa(MAX_TASTING_SCORE)); continue
+		}
+
+		scores[name] = score
+	}
+
+	if result.Approved == nil { invalid.add("approved", "is required") }
+
+	comments := strings.TrimSpace(result.Comments)
+
+	if len([]rune(comments)) > MAX_TEXT_LENGTH { invalid.add("comments", "must be at most " + strconv.Itoa(MAX_TEXT_LENGTH) + " characters") }
+
+	if len(invalid.Fields) > 0 { return Tasting_Result{}, invalid }
+
+	return Tasting_Result{ Scores: scores, Approved: *result.Approved, Comments: comments }, nil
+}
+
+//=================================================================================================================================
+//	 close_tasting_session - Closes the open tasting session of chocolates being tested and works out its outcome. The
+//							 chocolates are approved for production if enough testers approved them and the average of
+//							 every score submitted meets the session's policy. The outcome is also recorded as the
+//							 chocolates' test.
+//=================================================================================================================================
+func (t *SimpleChaincode) close_tasting_session(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+
+	if 		c.Status			!= STATE_TESTING		||
+			c.Custodian			!= caller				||
+			caller_affiliation	!= DU_RHONE				||
+			c.Delivered			== true					{
+															return nil, errors.New("Permission denied")
+	}
+
+	s, err := t.current_session(stub, c)
+															if err != nil { return nil, err }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("CLOSE_TASTING_SESSION: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+
+	total, count := 0, 0
+
+	for _, result := range s.Results {
+
+		if result.Approved { s.Approvals++ }
+
+		for _, score := range result.Scores { total += score; count++ }
+	}
+
+	if count > 0 { s.AverageScore = float64(total) / float64(count) }
+
+	s.Approved   = s.Approvals >= s.Policy.MinApprovals && s.AverageScore >= s.Policy.MinScore
+	s.Status     = SESSION_CLOSED
+	s.DateClosed = date
+
+	err = t.save_tasting_session(stub, s)
+															if err != nil { return nil, err }
+
+	c.TastingApproved = s.Approved
+	c.TestDate        = date
+	c.Test            = "Failed"
+
+	if s.Approved { c.Test = "Passed" }
+
+	_, err = t.save_changes(stub, c)
+															if err != nil { fmt.Printf("CLOSE_TASTING_SESSION: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+
+	return json.Marshal(s)
+}
+
+//=================================================================================================================================
+//	 void_tasting_session - Run by testing_to_concepting. A session still open when the chocolates are sent back to be
+//							reworked is voided, so its scores can't approve the new recipe.
+//=================================================================================================================================
+func (t *SimpleChaincode) void_tasting_session(stub Stub, c *Chocolates, caller string, recipient_name string) error {
+
+	if c.TastingSession == 0 { return nil }
+
+	s, err := t.retrieve_tasting_session(stub, c.ChocoID, c.TastingSession)
+															if err != nil { return err }
+
+	if s.Status != SESSION_OPEN { return nil }
+
+	date, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("VOID_TASTING_SESSION: Error retrieving transaction date: %s", err); return errors.New("Error retrieving transaction date") }
+
+	s.Status     = SESSION_VOID
+	s.DateClosed = date
+
+	return t.save_tasting_session(stub, s)
+}
+
+//==============================================================================================================================
+//	 get_tasting_session - Returns the chocolates' tasting session with the number passed, or the latest if none is passed.
+//						   Testers invited to a session can see it as well as those allowed to see the chocolates.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tasting_session(stub Stub, caller string, caller_affiliation int, chocoID string, session_value string) ([]byte, error) {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+															if err != nil { return nil, err }
+
+	session := c.TastingSession
+
+	if session_value != "" {
+		session, err = strconv.Atoi(session_value)
+															if err != nil || session < 1 || session > c.TastingSession { return nil, errors.New("Invalid tasting session " + session_value) }
+	}
+															if session == 0 { return nil, errors.New("No tasting session has been opened for " + chocoID) }
+
+	s, err := t.retrieve_tasting_session(stub, chocoID, session)
+															if err != nil { return nil, err }
+
+	for _, tester := range s.Testers {
+		if tester == caller { return json.Marshal(s) }
+	}
+
+	_, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
+															if err != nil { return nil, err }
+
+	return json.Marshal(s)
+}
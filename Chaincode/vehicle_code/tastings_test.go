@@ -0,0 +1,203 @@
+package main
+
+import (
+	"testing"
+	"encoding/json"
+)
+
+const test_scores = `{"scores": {"flavour": 8, "texture": 7, "appearance": 9}, "approved": true, "comments": "Smooth finish"}`
+const test_low_scores = `{"scores": {"flavour": 5, "texture": 6, "appearance": 7}, "approved": false}`
+
+const test_testers = `[{"username": "durhone", "role": 1}, {"username": "durhone2", "role": 1}, {"username": "printer", "role": 2}, {"username": "ibm", "role": 5}]`
+
+func TestTastingSessions(t *testing.T) {
+
+	open := func(l *test_ledger) { l.must_invoke("durhone", "open_tasting_session", "AB1234567") }
+
+	scored := func(l *test_ledger) {
+		open(l)
+		l.must_invoke("durhone2", "submit_tasting_score", test_scores, "AB1234567")
+		l.must_invoke("printer",  "submit_tasting_score", test_scores, "AB1234567")
+	}
+
+	approved := func(l *test_ledger) {
+		scored(l)
+		l.must_invoke("durhone", "close_tasting_session", "AB1234567")
+	}
+
+	tests := []struct {
+		name		string
+		prepare		func(l *test_ledger)
+		user		string
+		function	string
+		args		[]string
+		ok			bool
+		check		func(c Chocolates, s Tasting_Session) bool
+	}{
+		{ "open",								nil,		"durhone",	"open_tasting_session",		nil,								true,
+			func(c Chocolates, s Tasting_Session) bool { return c.TastingSession == 1 && s.Status == SESSION_OPEN && len(s.Testers) == 3 && s.Policy.MinApprovals == 2 } },
+		{ "open by printer",					nil,		"printer",	"open_tasting_session",		nil,								false,	nil },
+		{ "open while open",					open,		"durhone",	"open_tasting_session",		nil,								false,	nil },
+		{ "open withdraws approval",			approved,	"durhone",	"open_tasting_session",		nil,								true,
+			func(c Chocolates, s Tasting_Session) bool { return c.TastingSession == 2 && !c.TastingApproved } },
+		{ "score before a session",				nil,		"printer",	"submit_tasting_score",		[]string{ test_scores },			false,	nil },
+		{ "score",								open,		"printer",	"submit_tasting_score",		[]string{ test_scores },			true,
+			func(c Chocolates, s Tasting_Session) bool { return len(s.Results) == 1 && s.Results[0].Tester == "printer" && s.Results[0].Comments == "Smooth finish" } },
+		{ "score by uninvited tester",			open,		"supplier",	"submit_tasting_score",		[]string{ test_scores },			false,	nil },
+		{ "score by unregistered tester",		func(l *test_ledger) {
+			l.ecerts.register("bob", "bob\\group1\\2")
+			l.must_invoke("durhone", "update_testers", `["printer","bob"]`, "AB1234567")
+			open(l)
+		},													"bob",		"submit_tasting_score",		[]string{ test_scores },			false,	nil },
+		{ "score twice",						func(l *test_ledger) {
+			open(l)
+			l.must_invoke("printer", "submit_tasting_score", test_scores, "AB1234567")
+		},													"printer",	"submit_tasting_score",		[]string{ test_scores },			false,	nil },
+		{ "close approved",						scored,		"durhone",	"close_tasting_session",	nil,								true,
+			func(c Chocolates, s Tasting_Session) bool { return s.Status == SESSION_CLOSED && s.Approved && c.TastingApproved && c.Test == "Passed" } },
+		{ "close failed",						func(l *test_ledger) {
+			open(l)
+			l.must_invoke("printer", "submit_tasting_score", test_scores,     "AB1234567")
+			l.must_invoke("ibm",     "submit_tasting_score", test_low_scores, "AB1234567")
+		},													"durhone",	"close_tasting_session",	nil,								true,
+			func(c Chocolates, s Tasting_Session) bool { return s.Approvals == 1 && s.AverageScore == 7 && !s.Approved && !c.TastingApproved && c.Test == "Failed" } },
+		{ "close by printer",					scored,		"printer",	"close_tasting_session",	nil,								false,	nil },
+		{ "close without a session",			nil,		"durhone",	"close_tasting_session",	nil,								false,	nil },
+		{ "rework voids the open session",		scored,		"durhone",	"testing_to_concepting",	[]string{ "durhone", "RECIPE_CHANGE" },	true,
+			func(c Chocolates, s Tasting_Session) bool { return s.Status == SESSION_VOID && c.Status == STATE_CONCEPTING && !c.TastingApproved } },
+		{ "close after rework",					func(l *test_ledger) {
+			scored(l)
+			l.must_invoke("durhone", "testing_to_concepting", "durhone", "RECIPE_CHANGE", "AB1234567")
+		},													"durhone",	"close_tasting_session",	nil,								false,
+			func(c Chocolates, s Tasting_Session) bool { return s.Status == SESSION_VOID && !c.TastingApproved } },
+		{ "score after rework",					func(l *test_ledger) {
+			open(l)
+			l.must_invoke("durhone", "testing_to_concepting", "durhone", "TASTING_FAILED", "AB1234567")
+		},													"printer",	"submit_tasting_score",		[]string{ test_scores },			false,	nil },
+		{ "ingredients during a session",		open,		"durhone",	"update_ingredients",		[]string{ `["cocoa","salt"]` },		false,	nil },
+		{ "ingredients after approval",			approved,	"durhone",	"update_ingredients",		[]string{ `["cocoa","salt"]` },		true,
+			func(c Chocolates, s Tasting_Session) bool { return len(c.Ingredients) == 2 && !c.TastingApproved } },
+		{ "recipe during a session",			open,		"durhone",	"revise_recipe",			[]string{ test_recipe, "Less sugar" },	false,	nil },
+		{ "recipe after approval",				approved,	"durhone",	"revise_recipe",			[]string{ test_recipe, "Less sugar" },	true,
+			func(c Chocolates, s Tasting_Session) bool { return c.RecipeVersion == 1 && !c.TastingApproved } },
+		{ "production after ingredients change",	func(l *test_ledger) {
+			approved(l)
+			l.must_invoke("durhone", "update_dateFinalized", "2016-08-05", "AB1234567")
+			l.must_invoke("durhone", "update_ingredients", `["cocoa","salt"]`, "AB1234567")
+		},													"durhone",	"testing_to_produciton",	[]string{ "durhone" },				false,	nil },
+		{ "production after approval",			func(l *test_ledger) {
+			approved(l)
+			l.must_invoke("durhone", "update_dateFinalized", "2016-08-05", "AB1234567")
+		},													"durhone",	"testing_to_produciton",	[]string{ "durhone" },				true,
+			func(c Chocolates, s Tasting_Session) bool { return c.Status == STATE_PRODUCTION } },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t, "", test_testers, "", `{"minApprovals": 2, "minScore": 7}`)
+			l.advance("AB1234567", STATE_TESTING)
+			l.must_invoke("durhone", "update_testers", `["durhone2","printer","ibm"]`, "AB1234567")
+
+			if test.prepare != nil { test.prepare(l) }
+
+			_, err := l.invoke(test.user, test.function, append(test.args, "AB1234567")...)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if test.check == nil { return }
+
+			c := l.chocolates("AB1234567")
+
+			s, err := l.cc.retrieve_tasting_session(l.stub, "AB1234567", c.TastingSession)
+			if err != nil { t.Fatal(err) }
+
+			if !test.check(c, s) { t.Errorf("unexpected chocolates %+v and session %+v", c, s) }
+		})
+	}
+
+	t.Run("get_tasting_session", func(t *testing.T) {
+
+		l := new_test_ledger(t, "", test_testers, "", `{"minApprovals": 2, "minScore": 7}`)
+		l.advance("AB1234567", STATE_TESTING)
+		l.must_invoke("durhone", "update_testers", `["durhone2","printer","ibm"]`, "AB1234567")
+		approved(l)
+		open(l)
+
+		var first Tasting_Session
+		json.Unmarshal(l.must_query("ibm", "get_tasting_session", "AB1234567", "1"), &first)
+
+		if first.Session != 1 || len(first.Results) != 2 || !first.Approved { t.Errorf("unexpected session %+v", first) }
+
+		if _, err := l.query("supplier", "get_tasting_session", "AB1234567"); err == nil { t.Error("expected query by supplier to fail") }
+		if _, err := l.query("durhone", "get_tasting_session", "AB1234567", "3"); err == nil { t.Error("expected missing session to fail") }
+	})
+}
+
+func TestTastingScoreValidation(t *testing.T) {
+
+	l := new_test_ledger(t, "", test_testers)
+	l.advance("AB1234567", STATE_TESTING)
+	l.must_invoke("durhone", "update_testers", `["printer"]`, "AB1234567")
+	l.must_invoke("durhone", "open_tasting_session", "AB1234567")
+
+	tests := map[string][]Field_Error{
+		`[8, 7, 9]`:
+			{ { "scores", "must be a JSON object of scores, approved and comments" } },
+		`{"scores": {"flavour": 11, "texture": 7.5, "aroma": 5}}`:
+			{ { "scores.appearance", "is required" }, { "scores.aroma", "unknown criterion" }, { "scores.flavour", "must be a whole number from 1 to 10" },
+			  { "scores.texture", "must be a whole number from 1 to 10" }, { "approved", "is required" } },
+	}
+
+	for score_json, want := range tests {
+
+		_, err := l.invoke("printer", "submit_tasting_score", score_json, "AB1234567")
+
+		invalid, ok := err.(*Validation_Error)
+		if !ok { t.Errorf("%s: expected Validation_Error, got %v", score_json, err); continue }
+
+		got, _    := json.Marshal(invalid.Fields)
+		wanted, _ := json.Marshal(want)
+
+		if string(got) != string(wanted) { t.Errorf("%s: fields = %s, want %s", score_json, got, wanted) }
+	}
+}
+
+func TestTastingPolicy(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		policy		string
+		ok			bool
+		approved	bool
+	}{
+		{ "default",					"",										true,	true },
+		{ "strict",						`{"minApprovals": 1, "minScore": 7}`,	true,	false },
+		{ "no approvals needed",		`{"minApprovals": 0, "minScore": 7}`,	false,	false },
+		{ "score out of range",			`{"minApprovals": 1, "minScore": 11}`,	false,	false },
+		{ "not an object",				`"strict"`,								false,	false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := &test_ledger{ t: t, stub: new_mock_stub(), ecerts: new_mock_ecerts() }
+			l.cc = &SimpleChaincode{ ecerts: l.ecerts }
+			l.stub.begin(nil)
+
+			_, err := l.cc.init_chaincode(l.stub, "init", []string{ "localhost:5000", "", "", "", test.policy })
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if !test.ok { return }
+
+			l = new_test_ledger(t, "", test_testers, "", test.policy)
+			l.advance("AB1234567", STATE_TESTING)
+			l.must_invoke("durhone", "update_testers", `["printer"]`, "AB1234567")
+			l.must_invoke("durhone", "open_tasting_session", "AB1234567")
+			l.must_invoke("printer", "submit_tasting_score", `{"scores": {"flavour": 6, "texture": 6, "appearance": 6}, "approved": true}`, "AB1234567")
+			l.must_invoke("durhone", "close_tasting_session", "AB1234567")
+
+			if c := l.chocolates("AB1234567"); c.TastingApproved != test.approved { t.Errorf("approved = %v, want %v", c.TastingApproved, test.approved) }
+		})
+	}
+}
@@ -7,12 +7,7 @@ import (
 	"strings"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"encoding/json"
-	"crypto/x509"
-	"encoding/pem"
-	"net/http"
-	"net/url"
-    "io/ioutil"
-	"regexp"
+	"time"
 	
 )
 
@@ -25,11 +20,14 @@ const   PRINTER 				=  2
 const   SUPPLIER  				=  3
 const   SHIPPING_CO 			=  4
 const   IBM      				=  5
+const   ARBITER					=  6
+const   REGULATOR				=  7
 
 
 //==============================================================================================================================
 //	 Status types - Asset lifecycle is broken down into 7 statuses, this is part of the business logic to determine what can 
-//					be done to the chocolates at points in it's lifecycle
+//					be done to the chocolates at points in it's lifecycle. Chocolates taken out of the lifecycle end in one
+//					of the two terminal statuses.
 //==============================================================================================================================
 const   STATE_CONCEPTING  			=  0
 const 	STATE_PRINTING				=  1
@@ -38,14 +36,32 @@ const	STATE_TESTING               =  3
 const   STATE_PRODUCTION			=  4
 const   STATE_DELIVERY			 	=  5
 const	STATE_DELIVERED				=  6
+const	STATE_CANCELLED				=  7
+const	STATE_DISCONTINUED			=  8
+
+//==============================================================================================================================
+//	 Date formats - All dates stored against the chocolates are held as YYYY-MM-DD strings, timestamps as RFC 3339
+//==============================================================================================================================
+const	DATE_FORMAT					= "2006-01-02"
+const	TIME_FORMAT					= time.RFC3339
 
 //==============================================================================================================================
 //	 Structure Definitions 
 //==============================================================================================================================
-//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
-//				and other HyperLedger functions)
+//	Chaincode - A struct for use with Shim (A HyperLedger included go file used for get/put state
+//				and other HyperLedger functions). ecerts is where get_ecert looks up a user's ecert, the HyperLedger
+//				REST API when it is nil. resolver overrides the Identity_Resolver chosen at Init when set.
 //==============================================================================================================================
 type  SimpleChaincode struct {
+	ecerts		ECert_Source
+	resolver	Identity_Resolver
+}
+
+//==============================================================================================================================
+//	ECert_Source - Anything that can return the ecert for the username passed, html encoded as the REST API returns it.
+//==============================================================================================================================
+type ECert_Source interface {
+	get_ecert(stub Stub, name string) ([]byte, error)
 }
 
 //==============================================================================================================================
@@ -57,43 +73,129 @@ type Chocolates struct {
 	Chocolatier    	string `json:"chocolatier"`
 	EstablishDate	string `json:"establishDate"`
 	ChocoID         string `json:"ID"`
+	Product			string `json:"product"`					// Sets the storage limits the chocolates are kept within
 	//Supply Info
 	BoxOrderDate	string `json:"boxOrderDate"`
 	BoxDelvDate		string `json:"boxDelvDate"`
 	IngredOrderDate	string `json:"ingredOrderDate"`
-	IngredDelvDate	string `json:"ingredOrderDate"`
+	IngredDelvDate	string `json:"ingredDelvDate"`
 	IngredOrigin	string `json:"ingredOrigin"` 
 	// Recipe Info
 	Contributers  []string `json:"contributers"`
 	Ingredients	  []string `json:"ingredients"`
 	Method			string `json:"method"`
+	RecipeVersion	int    `json:"recipeVersion"`			// The current version of the structured recipe, 0 if none
 	//Taste Testing Info
 	Test	        string `json:"test"`
 	Testers       []string `json:"testers"`
 	Revisions	  []string `json:"revisions"`
 	TestDate        string `json:"testDate"`
 	DateFinalized	string `json:"dateFinalized"`
+	TastingSession	int    `json:"tastingSession"`			// The latest tasting session, 0 if none has been opened
+	TastingApproved	bool   `json:"tastingApproved"`			// Whether the latest closed session approved the chocolates
 	//Production/Delivery Info
 	DateProduced	string `json:"dateProduced"`
 	DatePackaged 	string `json:"datePackaged"`
 	DateArrived     string `json:"dateArrived"`
+	Quantity		int    `json:"quantity"`				// The number of boxes sent out, 0 if it wasn't recorded
 	DelivererID		string `json:"delivererID"`
+	ShipmentID		string `json:"shipmentID"`				// The shipment carrying the chocolates, UNDEFINED if none is planned
+	ReadingBatches	int    `json:"readingBatches"`			// The number of batches of storage readings submitted in transit
+	Excursions		int    `json:"excursions"`				// The number of those readings outside the storage limits
+	DeliveredBy		string `json:"deliveredBy"`				// The carrier that handed the chocolates to IBM
+	Deliveries	[]Proof_Of_Delivery `json:"deliveries"`	// Every time IBM accepted or rejected the chocolates
+	Dispute			int    `json:"dispute"`					// The latest dispute over a delivery, 0 if none has been opened
+	DisputeStatus	string `json:"disputeStatus"`
+	Recall			string `json:"recall"`					// The recall the chocolates were caught by, UNDEFINED if none
+	RecallStatus	string `json:"recallStatus"`				// One of "recalled", "returned" or "destroyed" once recalled
+	Receipt			string `json:"receipt"`
+	Lots		 []Lot_Usage `json:"lots"`					// The ingredient lots that went into the chocolates
 	//Status info
-	Owner			int    `json:"owner"`
+	Owner			string `json:"owner"`					// The participant that owns the chocolates
+	OwnerRole		int    `json:"ownerRole"`
+	Custodian		string `json:"custodian"`				// The participant that physically holds them
+	CustodianRole	int    `json:"custodianRole"`
+	ReworkCount		int    `json:"reworkCount"`				// The number of times the chocolates have been sent back a stage
+	Reworks		  []Rework `json:"reworks"`
+	Proposal		int    `json:"proposal"`				// The latest proposed transition, 0 if none has been proposed
+	OnHold			bool   `json:"onHold"`					// Whether the chocolates are frozen by a quality hold
+	HoldReason		string `json:"holdReason"`
+	Holds		  []Hold   `json:"holds"`
+	ClosedReason	string `json:"closedReason"`				// Why the chocolates were cancelled or discontinued
 	Delivered		bool   `json:"delivered"`
 	Status			int	   `json:"status"`
 }
 
+//==============================================================================================================================
+//	 UnmarshalJSON - Reads a chocolates record. Records saved before owners were tracked as participants hold the owner's
+//					 participant type as a number; their owner is taken to be that type, with no participant named.
+//==============================================================================================================================
+func (c *Chocolates) UnmarshalJSON(data []byte) error {
+
+	type chocolates Chocolates									// Has no UnmarshalJSON, so the fields decode as usual
+
+	var raw struct {
+		chocolates
+		Owner			json.RawMessage	`json:"owner"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+															if err != nil { return err }
+
+	*c = Chocolates(raw.chocolates)
+
+	if len(raw.Owner) == 0 || string(raw.Owner) == "null" { return nil }
+
+	if err := json.Unmarshal(raw.Owner, &c.Owner); err == nil { return nil }
+
+	err = json.Unmarshal(raw.Owner, &c.OwnerRole)
+															if err != nil { return errors.New("Invalid owner " + string(raw.Owner)) }
+
+	c.Owner = "UNDEFINED"
+
+	return nil
+}
+
 
 //==============================================================================================================================
-//	Choco Holder - Defines the structure that holds all the IDs for chocolates that have been created.
-//				Used as an index when querying all chocolates.
+//	Choco Holder - Defines the structure that held all the IDs for chocolates that had been created. Superseded by
+//				the per-record indexes, it is only read by migrate_chocoIDs when converting an existing ledger.
 //==============================================================================================================================
 
 type Choco_Holder struct {
 	ChocoIDs 	[]string `json:"chocoIDs"`
 }
 
+//==============================================================================================================================
+//	Transition - Defines a single step of the chocolates' lifecycle. A transfer named Function moves chocolates in state From
+//				 held by a Caller affiliate to a Recipient affiliate in state To, provided every Precondition holds. Custody
+//				 passes to the recipient; ownership only passes when IBM accepts the delivery. Stamp, if set, records the
+//				 transaction date against the fields that the step completes and Effect, if set, applies the step to records
+//				 kept outside the chocolates, failing the transfer if it can't. Rework transitions move the chocolates back a
+//				 stage and must be given one of their Reasons.
+//==============================================================================================================================
+type Transition struct {
+	Function		string
+	From			int
+	To				int
+	Caller			int
+	Recipient		int
+	Rework			bool
+	Reasons			[]string
+	Preconditions	[]Precondition
+	Stamp			func(c *Chocolates, date string)
+	Effect			func(t *SimpleChaincode, stub Stub, c *Chocolates, caller string, recipient_name string) error
+}
+
+//==============================================================================================================================
+//	Precondition - A check on the fields of the chocolates that must pass before a transition can take place. Description
+//				   is returned to the caller when it fails.
+//==============================================================================================================================
+type Precondition struct {
+	Description		string
+	Check			func(c Chocolates) bool
+}
+
 //==============================================================================================================================
 //	ECertResponse - Struct for storing the JSON response of retrieving an ECert. JSON OK -> Struct OK
 //==============================================================================================================================
@@ -107,23 +209,72 @@ type ECertResponse struct {
 //	Init Function - Called when the user deploys the chaincode																	
 //==============================================================================================================================
 func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+	return t.init_chaincode(Shim_Stub{stub}, function, args)
+}
+
+//==============================================================================================================================
+//	init_chaincode - Stores the peer address passed, used to retrieve ecerts, and the name of the Identity_Resolver to
+//					 use. Participants passed as a JSON array are registered so the registry can be used from the start;
+//					 at least one of them should be a DU_RHONE participant to administer the registry. The ID policy
+//					 sets the format of chocoIDs and is the legacy format if none is passed. The tasting policy sets how
+//					 many testers must approve chocolates, and the average score needed, before production.
+//==============================================================================================================================
+func (t *SimpleChaincode) init_chaincode(stub Stub, function string, args []string) ([]byte, error) {
 	
 	//Args
-	//				0
-	//			peer_address
+	//				0					1						2							3						4
+	//			peer_address		resolver (optional)		participants (optional)		ID policy (optional)	tasting policy (optional)
 	
 	
-	var chocoIDs Choco_Holder
+															if len(args) < 1 || len(args) > 5 { return nil, errors.New("Incorrect number of arguments passed") }
 	
-	bytes, err := json.Marshal(chocoIDs)
+	err := stub.PutState("Peer_Address", []byte(args[0]))
+															if err != nil { return nil, errors.New("Error storing peer address") }										
 	
-															if err != nil { return nil, errors.New("Error creating Choco_Holder record") }
-																
-	err = stub.PutState("chocoIDs", bytes)
+	resolver := RESOLVER_REST
 	
+	if len(args) > 1 && args[1] != "" { resolver = args[1] }
 	
-	err = stub.PutState("Peer_Address", []byte(args[0]))
-															if err != nil { return nil, errors.New("Error storing peer address") }										
+	_, err = t.new_resolver(resolver)
+															if err != nil { return nil, err }
+	
+	err = stub.PutState(RESOLVER_KEY, []byte(resolver))
+															if err != nil { return nil, errors.New("Error storing identity resolver") }
+	
+	if len(args) > 3 && args[3] != "" {
+	
+		_, err = find_id_policy(args[3])
+															if err != nil { return nil, err }
+		
+		err = stub.PutState(ID_POLICY_KEY, []byte(args[3]))
+															if err != nil { return nil, errors.New("Error storing ID policy") }
+	}
+	
+	if len(args) > 4 && args[4] != "" {
+	
+		_, err = parse_tasting_policy(args[4])
+															if err != nil { return nil, err }
+		
+		err = stub.PutState(TASTING_POLICY_KEY, []byte(args[4]))
+															if err != nil { return nil, errors.New("Error storing tasting policy") }
+	}
+	
+	if len(args) > 2 && args[2] != "" {
+	
+		var participants []Participant
+		
+		err = json.Unmarshal([]byte(args[2]), &participants)
+															if err != nil { return nil, errors.New("Invalid participants") }
+		
+		for _, p := range participants {
+		
+															if strings.TrimSpace(p.Username) == "" || !is_role(p.Role) { return nil, errors.New("Invalid participants") }
+		
+			err = t.enrol_participant(stub, p)
+															if err != nil { return nil, err }
+		}
+	}
 	
 	return nil, nil
 }
@@ -132,37 +283,14 @@ func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args [
 //	 General Functions
 //==============================================================================================================================
 //	 get_ecert - Takes the name passed and calls out to the REST API for HyperLedger to retrieve the ecert
-//				 for that user. Returns the ecert as retrived including html encoding.
+//				 for that user, unless another ECert_Source has been set. Returns the ecert as retrived including
+//				 html encoding. Only used by the Rest_Resolver.
 //==============================================================================================================================
-func (t *SimpleChaincode) get_ecert(stub *shim.ChaincodeStub, name string) ([]byte, error) {
+func (t *SimpleChaincode) get_ecert(stub Stub, name string) ([]byte, error) {
 	
-	var cert ECertResponse
-	
-	peer_address, err := stub.GetState("Peer_Address")
-															if err != nil { return nil, errors.New("Error retrieving peer address") }
-
-	response, err := http.Get("http://"+string(peer_address)+"/registrar/"+name+"/ecert") 	// Calls out to the HyperLedger REST API to get the ecert of the user with that name
-    
-															fmt.Println("HTTP RESPONSE", response)
-															
-															if err != nil { return nil, errors.New("Error calling ecert API") }
+	if t.ecerts != nil { return t.ecerts.get_ecert(stub, name) }
 	
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)					// Read the response from the http callout into the variable contents
-															
-															fmt.Println("HTTP BODY:", string(contents))
-															
-															if err != nil { return nil, errors.New("Could not read body") }
-	
-	err = json.Unmarshal(contents, &cert)
-	
-															if err != nil { return nil, errors.New("Could not retrieve ecert for user: "+name) }
-															
-															fmt.Println("CERT OBJECT:", cert)
-															
-															if cert.Error != "" { fmt.Println("GET ECERT ERRORED: ", cert.Error); return nil, errors.New(cert.Error)}
-	
-	return []byte(string(cert.OK)), nil
+	return default_ecerts.get_ecert(stub, name)
 }
 
 //==============================================================================================================================
@@ -170,67 +298,129 @@ func (t *SimpleChaincode) get_ecert(stub *shim.ChaincodeStub, name string) ([]by
 //				  Returns the username as a string.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) get_username(stub *shim.ChaincodeStub) (string, error) {
+func (t *SimpleChaincode) get_username(stub Stub) (string, error) {
 
 	bytes, err := stub.GetCallerCertificate();
 															if err != nil { return "", errors.New("Couldn't retrieve caller certificate") }
-	x509Cert, err := x509.ParseCertificate(bytes);				// Extract Certificate from result of GetCallerCertificate						
-															if err != nil { return "", errors.New("Couldn't parse certificate")	}
+	x509Cert, err := parse_certificate(bytes);				// Extract Certificate from result of GetCallerCertificate						
+															if err != nil { return "", err }
 															
 	return x509Cert.Subject.CommonName, nil
 }
 
 //==============================================================================================================================
-//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
-// 				  		certificates common name. The affiliation is stored as part of the common name.
+//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and returns the
+// 				  		affiliation held in the certificate, either in its common name or its role extension.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) check_affiliation(stub *shim.ChaincodeStub, cert string) (int, error) {																																																					
+func (t *SimpleChaincode) check_affiliation(stub Stub, cert string) (int, error) {
 	
-	decodedCert, err := url.QueryUnescape(cert);    				// make % etc normal //
+	x509Cert, err := decode_ecert(cert)
+															if err != nil { return -1, err }
 	
-															if err != nil { return -1, errors.New("Could not decode certificate") }
-	
-	pem, _ := pem.Decode([]byte(decodedCert))           				// Make Plain text   //
-
-	x509Cert, err := x509.ParseCertificate(pem.Bytes);				// Extract Certificate from argument //
-														
-															if err != nil { return -1, errors.New("Couldn't parse certificate")	}
-
-	cn := x509Cert.Subject.CommonName
-	
-	res := strings.Split(cn,"\\")
-	
-	affiliation, _ := strconv.Atoi(res[2])
+	_, affiliation, err := certificate_identity(x509Cert)
+															if err != nil { return -1, err }
 	
 	return affiliation, nil
 }
 
 //==============================================================================================================================
-//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
-//					 name passed.
+//	 get_caller_data - Asks the Identity_Resolver chosen at Init who the caller is and returns their username and
+//					 affiliation, as recorded in the participant registry if they are registered.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) get_caller_data(stub *shim.ChaincodeStub) (string, int, error){
+func (t *SimpleChaincode) get_caller_data(stub Stub) (string, int, error){
 
-	user, err := t.get_username(stub)
+	resolver, err := t.get_resolver(stub)
 																		if err != nil { return "", -1, err }
-																		
-	ecert, err := t.get_ecert(stub, user);					
+
+	user, affiliation, err := resolver.get_caller(stub)
 																		if err != nil { return "", -1, err }
 
-	affiliation, err := t.check_affiliation(stub,string(ecert));			
+	affiliation, err = apply_registry(stub, user, affiliation)
 																		if err != nil { return "", -1, err }
 
 	return user, affiliation, nil
 }
 
+//==============================================================================================================================
+//	 get_affiliation - Asks the Identity_Resolver chosen at Init for the affiliation of the participant named, as recorded
+//					   in the participant registry if they are registered.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_affiliation(stub Stub, name string) (int, error){
+
+	resolver, err := t.get_resolver(stub)
+																		if err != nil { return -1, err }
+
+	affiliation, err := resolver.get_affiliation(stub, name)
+																		if err != nil { return -1, err }
+
+	return apply_registry(stub, name, affiliation)
+}
+
+//==============================================================================================================================
+//	 is_defined - Returns false for fields that have not been set yet, either because they still hold the UNDEFINED
+//				  placeholder or because they were missing from the stored JSON.
+//==============================================================================================================================
+func is_defined(value string) bool {
+
+	return value != "" && value != "UNDEFINED"
+}
+
+//==============================================================================================================================
+//	 check_date - Returns true if the value passed is a date in the format YYYY-MM-DD.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_date(value string) bool {
+
+	_, err := time.Parse(DATE_FORMAT, value)
+	
+	return err == nil
+}
+
+//==============================================================================================================================
+//	 parse_list - Converts a JSON array of strings passed as an argument into a slice, rejecting empty entries.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_list(value string) ([]string, error) {
+
+	var list []string
+	
+	err := json.Unmarshal([]byte(value), &list)
+															if err != nil { return nil, errors.New("Value must be a JSON array of strings") }
+	
+	for _, entry := range list {
+															if strings.TrimSpace(entry) == "" { return nil, errors.New("Value must not contain empty entries") }
+	}
+	
+	return list, nil
+}
+
+//==============================================================================================================================
+//	 get_tx_date - Returns the date of the current transaction in the format YYYY-MM-DD. The transaction timestamp is
+//				   used rather than the local clock so every peer computes the same value.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tx_date(stub Stub) (string, error) {
+
+	timestamp, err := t.get_tx_time(stub)
+															if err != nil { return "", err }
+	
+	return timestamp.Format(DATE_FORMAT), nil
+}
+
+//==============================================================================================================================
+//	 get_tx_time - Returns the timestamp of the current transaction in UTC.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tx_time(stub Stub) (time.Time, error) {
+
+	return stub.GetTxTime()
+}
+
 //==============================================================================================================================
 //	 retrieve_chocoID - Gets the state of the data at chocoID in the ledger then converts it from the stored 
 //					JSON into the Chocolates struct for use in the contract. Returns the chocolates struct.
 //					Returns empty c if it errors.
 //==============================================================================================================================
-func (t *SimpleChaincode) retrieve_chocoID(stub *shim.ChaincodeStub, chocoID string) (Chocolates, error) {
+func (t *SimpleChaincode) retrieve_chocoID(stub Stub, chocoID string) (Chocolates, error) {
 	
 	var c Chocolates
 
@@ -242,6 +432,11 @@ func (t *SimpleChaincode) retrieve_chocoID(stub *shim.ChaincodeStub, chocoID str
 
 															if err != nil {	fmt.Printf("RETRIEVE_CHOCOID: Corrupt chocolates record "+string(bytes)+": %s", err); return c, errors.New("RETRIEVE_CHOCOID: Corrupt chocolates record"+string(bytes))	}
 	
+	if c.Custodian == "" {									// Records saved before custody was tracked separately are held by their owner
+		c.Custodian     = c.Owner
+		c.CustodianRole = c.OwnerRole
+	}
+	
 	return c, nil
 }
 
@@ -251,19 +446,56 @@ func (t *SimpleChaincode) retrieve_chocoID(stub *shim.ChaincodeStub, chocoID str
 // save_changes - Writes to the ledger the Chocolates struct passed in a JSON format. Uses the shim file's 
 //				  method 'PutState'.
 //==============================================================================================================================
-func (t *SimpleChaincode) save_changes(stub *shim.ChaincodeStub, c Chocolates) (bool, error) {
+func (t *SimpleChaincode) save_changes(stub Stub, c Chocolates) (bool, error) {
 	 
 	bytes, err := json.Marshal(c)
 	
 																if err != nil { fmt.Printf("SAVE_CHANGES: Error converting chocolates record: %s", err); return false, errors.New("Error converting chocolates record") }
 
-	err = stub.PutState(c.chocoID, bytes)
+	existing, err := stub.GetState(c.ChocoID)
+	
+																if err != nil { fmt.Printf("SAVE_CHANGES: Error retrieving existing record: %s", err); return false, errors.New("Error retrieving existing record") }
+	
+	var previous *Chocolates									// nil when the chocolates are being created
+	
+	if existing != nil {
+	
+		previous = &Chocolates{}
+		
+		err = json.Unmarshal(existing, previous)
+																if err != nil { fmt.Printf("SAVE_CHANGES: Corrupt existing record: %s", err); return false, errors.New("Corrupt existing record") }
+	}
+	
+	err = stub.PutState(c.ChocoID, bytes)
 	
 																if err != nil { fmt.Printf("SAVE_CHANGES: Error storing chocolates record: %s", err); return false, errors.New("Error storing chocolates record") }
 	
+	err = t.update_indexes(stub, previous, c)
+	
+																if err != nil { fmt.Printf("SAVE_CHANGES: Error updating indexes: %s", err); return false, errors.New("Error updating indexes") }
+	
 	return true, nil
 }
 
+//==============================================================================================================================
+//	 record_invoke - Called once an invoke has succeeded. Compares the record for chocoID now in the world state with the
+//					 copy taken before the invoke, appends the changes to the chocolates' history and emits the event
+//					 for the invoke. previous is nil for a create.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_invoke(stub Stub, function string, caller string, caller_affiliation int, previous *Chocolates, chocoID string) error {
+
+	c, err := t.retrieve_chocoID(stub, chocoID)
+																if err != nil { fmt.Printf("RECORD_INVOKE: Error retrieving chocoID: %s", err); return errors.New("Error retrieving chocoID for history") }
+
+	changes, err := diff_chocolates(previous, c)
+																if err != nil { fmt.Printf("RECORD_INVOKE: Error comparing records: %s", err); return errors.New("Error comparing chocolates records") }
+
+	err = t.record_history(stub, function, caller, caller_affiliation, chocoID, changes)
+																if err != nil { return err }
+
+	return t.emit_event(stub, function, previous, c, changes)
+}
+
 //==============================================================================================================================
 //	 Router Functions
 //==============================================================================================================================
@@ -271,63 +503,186 @@ func (t *SimpleChaincode) save_changes(stub *shim.ChaincodeStub, c Chocolates) (
 //		  initial arguments passed to other things for use in the called function e.g. name -> ecert
 //==============================================================================================================================
 func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+	return t.invoke(Shim_Stub{stub}, function, args)
+}
+
+func (t *SimpleChaincode) invoke(stub Stub, function string, args []string) ([]byte, error) {
 	
 	caller, caller_affiliation, err := t.get_caller_data(stub)
 
 	if err != nil { return nil, errors.New("Error retrieving caller information")}
 
 	
-	if function == "create_chocolates" { return t.create_chocolates(stub, caller, caller_affiliation, args[0])
+	if function == "create_chocolates" || function == "create_chocolates_auto" { 
+		
+		var result []byte
+		
+		if function == "create_chocolates" {
+		
+																							if len(args) < 1 || len(args) > 2 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+			attributes := ""																// The initial attributes are optional
+		
+			if len(args) == 2 { attributes = args[1] }
+		
+			result, err = t.create_chocolates(stub, caller, caller_affiliation, args[0], attributes)
+		} else {
+		
+																							if len(args) > 1 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+			attributes := ""
+		
+			if len(args) == 1 { attributes = args[0] }
+		
+			result, err = t.create_chocolates_auto(stub, caller, caller_affiliation, attributes)
+		}
+		
+																							if err != nil { return nil, err }
+		
+		err = t.record_invoke(stub, function, caller, caller_affiliation, nil, string(result))	// Nothing existed before the create so every field is recorded as changed
+		
+																							if err != nil { return nil, err }
+		
+		return result, nil
+		
+	} else if function == "migrate_chocoIDs" { return t.migrate_chocoIDs(stub, caller, caller_affiliation, args)
+	} else if function == "register_participant" || function == "deactivate_participant" {
+	
+																							if len(args) != 1 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		if function == "register_participant" { return t.register_participant(stub, caller, caller_affiliation, args[0]) }
+		
+		return t.deactivate_participant(stub, caller, caller_affiliation, args[0])
+		
+	} else if function == "change_role" {
+	
+																							if len(args) != 2 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		return t.change_role(stub, caller, caller_affiliation, args[0], args[1])
+		
+	} else if function == "set_approval_policy" {
+	
+																							if len(args) != 2 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		return t.set_approval_policy(stub, caller, caller_affiliation, args[0], args[1])
+		
+	} else if function == "set_storage_limits" {
+	
+																							if len(args) != 2 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		return t.set_storage_limits(stub, caller, caller_affiliation, args[0], args[1])
+		
+	} else if function == "create_ingredient_lot" {
+	
+																							if len(args) != 1 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		return t.create_ingredient_lot(stub, caller, caller_affiliation, args[0])
+		
+	} else if function == "initiate_recall" {
+	
+																							if len(args) != 1 { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		return t.initiate_recall(stub, caller, caller_affiliation, args[0])
+		
 	} else { 																				// If the function is not a create then there must be chocolates so we need to retrieve the chocolates.
 		
 		argPos := 1
 		
-		if function == "finish_delivery" {																// If its a delivery then only two arguments are passed (no update value) all others have three arguments and the chocoID is expected in the last argument
+		if function == "finish_delivery" || function == "open_tasting_session" || function == "close_tasting_session" ||		// If its a delivery, a tasting session is being opened or closed, a proposal signed or withdrawn
+		   function == "sign_proposal" || function == "withdraw_proposal" ||																// or a shipment handed over then only one argument is passed (no update value) all others have two
+		   function == "handover_shipment" || function == "accept_handover" {																// arguments and the chocoID is expected in the last argument
 			argPos = 0
+		} else if function == "use_ingredient_lot" || function == "revise_recipe" || function == "propose_transition" {		// Using a lot takes the lot ID and quantity, revising a recipe the recipe and reason and proposing a transition the transfer and recipient
+			argPos = 2
+		} else if transition, ok := t.get_transition(function); ok && transition.Rework {						// Rework transitions take the recipient and a reason code
+			argPos = 2
 		}
 		
-		v, err := t.retrieve_chocoID(stub, args[argPos])
+																							if len(args) <= argPos { fmt.Printf("INVOKE: Incorrect number of arguments passed"); return nil, errors.New("Incorrect number of arguments passed") }
+		
+		c, err := t.retrieve_chocoID(stub, args[argPos])
 		
 																							if err != nil { fmt.Printf("INVOKE: Error retrieving chocoID: %s", err); return nil, errors.New("Error retrieving chocoID") }
+		
+		err = t.check_frozen(c, function)														// Nothing can be done to chocolates that are on hold or have left the lifecycle
+		
+																							if err != nil { return nil, err }
+		
+		var result []byte
 																		
-		if strings.Contains(function, "update") == false           && 
-		   function 							!= "finish_delivery"    { 									// If the function is not an update or a delivery it must be a transfer so we need to get the ecert of the recipient.
+		if transition, ok := t.get_transition(function); ok { 									// If the function is a transfer we need to get the affiliation of the recipient.
 			
-				ecert, err := t.get_ecert(stub, args[0]);					
+				var found bool
+				
+				_, found, err = find_approval_policy(stub, function)
 				
 																		if err != nil { return nil, err }
-
-				rec_affiliation, err := t.check_affiliation(stub,string(ecert));	
+																		if found { return nil, errors.New(function + " needs approval: use propose_transition") }
+				
+				var rec_affiliation int
+			
+				rec_affiliation, err = t.get_affiliation(stub, args[0]);	
 				
 																		if err != nil { return nil, err }
 				
-				if 		   function == "concepting_to_printing"    { return t.concepting_to_printing(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
-				} else if  function == "printing_to_supplying"      { return t.printing_to_supplying(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
-				} else if  function == "supplying_to_testing"       { return t.supplying_to_testing(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
-				} else if  function == "testing_to_produciton"     { return t.testing_to_produciton(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
-				} else if  function == "production_to_delivery"    { return t.production_to_delivery(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
-				} else if  function == "delivery_to_delivered"     { return t.delivery_to_delivered(stub, c, caller, caller_affiliation, args[0], rec_affiliation)
+				if transition.Rework {
+					result, err = t.rework(stub, transition, c, caller, caller_affiliation, args[0], rec_affiliation, args[1])
+				} else {
+					result, err = t.transfer(stub, transition, c, caller, caller_affiliation, args[0], rec_affiliation)
 				}
 
-
-		} else if function == "update_boxOrderDate"  	    	{ return t.update_boxOrderDate(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_boxDelvDate"       		{ return t.update_boxDelvDate(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_ingredOrderDate" 			{ return t.update_ingredOrderDate(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_ingredDelvDate" 			{ return t.update_ingredDelvDate(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_ingredOrigin" 			{ return t.update_ingredOrigin(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_contributers" 			{ return t.update_contributers(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_ingredients" 				{ return t.update_ingredients(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_test" 					{ return t.update_test(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_testers"  	 			{ return t.update_testers(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_revisions" 				{ return t.update_revisions(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_dateFinalized" 			{ return t.update_dateFinalized(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_delivererID" 				{ return t.update_delivererID(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "update_receipt" 					{ return t.update_receipt(stub, c, caller, caller_affiliation, args[0])
-		} else if function == "finish_delivery" 			    { return t.finish_delivery(stub, c, caller, caller_affiliation) }
-		}
+		} else if termination, ok := t.get_termination(function); ok {
 		
+				result, err = t.terminate(stub, termination, c, caller, caller_affiliation, args[0])
+				
+		} else if function == "place_hold" 						{ result, err = t.place_hold(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "release_hold" 					{ result, err = t.release_hold(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_boxOrderDate"  	    	{ result, err = t.update_boxOrderDate(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_boxDelvDate"       		{ result, err = t.update_boxDelvDate(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_ingredOrderDate" 			{ result, err = t.update_ingredOrderDate(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_ingredDelvDate" 			{ result, err = t.update_ingredDelvDate(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_ingredOrigin" 			{ result, err = t.update_ingredOrigin(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_contributers" 			{ result, err = t.update_contributers(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_ingredients" 				{ result, err = t.update_ingredients(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_product" 					{ result, err = t.update_product(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_quantity" 				{ result, err = t.update_quantity(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_test" 					{ result, err = t.update_test(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_testers"  	 			{ result, err = t.update_testers(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_revisions" 				{ result, err = t.update_revisions(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_dateFinalized" 			{ result, err = t.update_dateFinalized(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_delivererID" 				{ result, err = t.update_delivererID(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "update_receipt" 					{ result, err = t.update_receipt(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "use_ingredient_lot" 				{ result, err = t.use_ingredient_lot(stub, c, caller, caller_affiliation, args[0], args[1])
+		} else if function == "revise_recipe" 					{ result, err = t.revise_recipe(stub, c, caller, caller_affiliation, args[0], args[1])
+		} else if function == "open_tasting_session" 			{ result, err = t.open_tasting_session(stub, c, caller, caller_affiliation)
+		} else if function == "submit_tasting_score" 			{ result, err = t.submit_tasting_score(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "close_tasting_session" 			{ result, err = t.close_tasting_session(stub, c, caller, caller_affiliation)
+		} else if function == "propose_transition" 				{ result, err = t.propose_transition(stub, c, caller, caller_affiliation, args[0], args[1])
+		} else if function == "sign_proposal" 					{ result, err = t.sign_proposal(stub, c, caller, caller_affiliation)
+		} else if function == "withdraw_proposal" 				{ result, err = t.withdraw_proposal(stub, c, caller, caller_affiliation)
+		} else if function == "create_shipment" 				{ result, err = t.create_shipment(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "handover_shipment" 				{ result, err = t.handover_shipment(stub, c, caller, caller_affiliation)
+		} else if function == "accept_handover" 				{ result, err = t.accept_handover(stub, c, caller, caller_affiliation)
+		} else if function == "record_readings" 				{ result, err = t.record_readings(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "accept_delivery" 				{ result, err = t.accept_delivery(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "finish_delivery" 				{ result, err = t.finish_delivery(stub, c, caller, caller_affiliation)
+		} else if function == "reject_delivery" 				{ result, err = t.reject_delivery(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "open_dispute" 					{ result, err = t.open_dispute(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "respond_to_dispute" 				{ result, err = t.respond_to_dispute(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "resolve_dispute" 				{ result, err = t.resolve_dispute(stub, c, caller, caller_affiliation, args[0])
+		} else if function == "record_recall_outcome" 			{ result, err = t.record_recall_outcome(stub, c, caller, caller_affiliation, args[0])
+		} else {
 																						return nil, errors.New("Function of that name doesn't exist.")
-			
+		}
+		
+																						if err != nil { return nil, err }
+		
+		err = t.record_invoke(stub, function, caller, caller_affiliation, &c, c.ChocoID)
+		
+																						if err != nil { return nil, err }
+		
+		return result, nil
 	}
 }
 //=================================================================================================================================	
@@ -335,24 +690,138 @@ func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args
 //  		initial arguments passed are passed on to the called function.
 //=================================================================================================================================	
 func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+
+	return t.query(Shim_Stub{stub}, function, args)
+}
+
+func (t *SimpleChaincode) query(stub Stub, function string, args []string) ([]byte, error) {
 	
 															
 	caller, caller_affiliation, err := t.get_caller_data(stub)
 
-																							if err != nil { fmt.Printf("QUERY: Error retrieving caller details", err); return nil, errors.New("QUERY: Error retrieving caller details") }
+																							if err != nil { fmt.Printf("QUERY: Error retrieving caller details: %s", err); return nil, errors.New("QUERY: Error retrieving caller details") }
 															
 	if function == "get_chocolate_details" { 
 	
 			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
 	
 	
-			v, err := t.retrieve_chocoID(stub, args[0])
+			c, err := t.retrieve_chocoID(stub, args[0])
 																							if err != nil { fmt.Printf("QUERY: Error retrieving chocoID: %s", err); return nil, errors.New("QUERY: Error retrieving chocoID "+err.Error()) }
 	
 			return t.get_chocolate_details(stub, c, caller, caller_affiliation)
 			
 	} else if function == "get_chocos" {
 			return t.get_chocos(stub, caller, caller_affiliation)
+	} else if function == "get_chocos_by" {
+	
+			if len(args) != 2 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_chocos_by(stub, caller, caller_affiliation, args[0], args[1])
+	} else if function == "get_chocolates_by_owner" || function == "get_chocolates_by_custodian" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			index := INDEX_OWNER
+			
+			if function == "get_chocolates_by_custodian" { index = INDEX_CUSTODIAN }
+			
+			return t.get_chocos_by(stub, caller, caller_affiliation, index, args[0])
+	} else if function == "get_chocolate_history" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_chocolate_history(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_chocos_page" {
+	
+			if len(args) > 3 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			page_args := make([]string, 3)												// Filter, page size and bookmark are all optional
+			copy(page_args, args)
+			
+			return t.get_chocos_page(stub, caller, caller_affiliation, page_args[0], page_args[1], page_args[2])
+	} else if function == "get_ingredient_lot" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_ingredient_lot(stub, args[0])
+	} else if function == "get_provenance" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_provenance(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_recipe_version" {
+	
+			if len(args) < 1 || len(args) > 2 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			version_args := make([]string, 2)											// The version is optional and defaults to the current one
+			copy(version_args, args)
+			
+			return t.get_recipe_version(stub, caller, caller_affiliation, version_args[0], version_args[1])
+	} else if function == "diff_recipe_versions" {
+	
+			if len(args) != 3 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.diff_recipe_versions(stub, caller, caller_affiliation, args[0], args[1], args[2])
+	} else if function == "get_tasting_session" {
+	
+			if len(args) < 1 || len(args) > 2 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			session_args := make([]string, 2)											// The session is optional and defaults to the latest one
+			copy(session_args, args)
+			
+			return t.get_tasting_session(stub, caller, caller_affiliation, session_args[0], session_args[1])
+	} else if function == "get_proposal" {
+	
+			if len(args) < 1 || len(args) > 2 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			proposal_args := make([]string, 2)											// The proposal number is optional and defaults to the latest one
+			copy(proposal_args, args)
+			
+			return t.get_proposal(stub, caller, caller_affiliation, proposal_args[0], proposal_args[1])
+	} else if function == "get_approval_policies" {
+			return t.get_approval_policies(stub)
+	} else if function == "get_shipment" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_shipment(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_storage_limits" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			limits, err := t.get_storage_limits(stub, args[0])
+			
+			if err != nil { return nil, err }
+			
+			return json.Marshal(limits)
+	} else if function == "get_dispute" {
+	
+			if len(args) < 1 || len(args) > 2 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			dispute_args := make([]string, 2)											// The dispute number is optional and defaults to the latest one
+			copy(dispute_args, args)
+			
+			return t.get_dispute(stub, caller, caller_affiliation, dispute_args[0], dispute_args[1])
+	} else if function == "get_open_disputes" {
+			return t.get_open_disputes(stub, caller, caller_affiliation)
+	} else if function == "get_recall" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_recall_status(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_cold_chain_report" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_cold_chain_report(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_participant" {
+	
+			if len(args) != 1 { fmt.Printf("Incorrect number of arguments passed"); return nil, errors.New("QUERY: Incorrect number of arguments passed") }
+			
+			return t.get_participant(stub, args[0])
+	} else if function == "get_participants" {
+			return t.get_participants(stub)
 	}
 																							return nil, errors.New("Received unknown function invocation")
 }
@@ -360,424 +829,648 @@ func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args
 //=================================================================================================================================
 //	 Create Function
 //=================================================================================================================================									
-//	 Create Chocolates - Creates the initial JSON for the chocolates and then saves it to the ledger.									
+//	 Create Chocolates - Creates new chocolates from the optional attributes passed and then saves them to the ledger.
+//						 Returns the chocoID, which is generated by the chaincode if the ID policy requires it.
 //=================================================================================================================================
-func (t *SimpleChaincode) create_chocolates(stub *shim.ChaincodeStub, caller string, caller_affiliation int, chocoID string) ([]byte, error) {								
+func (t *SimpleChaincode) create_chocolates(stub Stub, caller string, caller_affiliation int, chocoID string, attributes_json string) ([]byte, error) {								
 
+	if 	caller_affiliation != DU_RHONE {							// Only DU_RHONE can create a new chocoID
 
-	var c Chocolates																																										
-	
-			// Variables to define the JSON
-		//Company Info and ID
-	chocolatier    	:= "\"Chocolatier\":\"Du Rhone-IBM\", "
-	establishDate	:= "\"Chocolatier\":\"UNDEFINED\", "
-	chocoID         := "\"Chocolatier\":\""+chocoID+"\", "
-	//Supply Info
-	boxOrderDate	:= "\"Chocolatier\":\"UNDEFINED\", "
-	boxDelvDate		:= "\"Chocolatier\":\"UNDEFINED\", "
-	ingredOrderDate	:= "\"Chocolatier\":\"UNDEFINED\", "
-	ingredDelvDate	:= "\"Chocolatier\":\"UNDEFINED\", "
-	ingredOrigin	:= "\"Chocolatier\":\"UNDEFINED\", "
-	// Recipe Info
-	contributers    := "\"Chocolatier\":{} "
-	ingredients	    := "\"Chocolatier\":{} "
-	method			:= "\"Chocolatier\":\"Chef Watson + Chocolatier\", "
-	//Taste Testing Info
-	test	        := "\"Chocolatier\":\"UNDEFINED\", "
-	testers         := "\"Chocolatier\":{} "
-	revisions	    := "\"Chocolatier\":{} "
-	testDate        := "\"Chocolatier\":\"UNDEFINED\", "
-	dateFinalized	:= "\"Chocolatier\":\"UNDEFINED\", "
-	//Production/Delivery Info
-	dateProduced	:= "\"Chocolatier\":\"UNDEFINED\", "
-	datePackaged 	:= "\"Chocolatier\":\"UNDEFINED\", "
-	dateArrived     := "\"Chocolatier\":\"UNDEFINED\", "
-	delivererID		:= "\"Chocolatier\":\"UNDEFINED\", "
-	//Status info
-	owner			:= "\"Chocolatier\":2, "
-	delivered		:= "\"Chocolatier\":false"
-	status			:= "\"Chocolatier\":0, "
+																		return nil, errors.New("Permission Denied")
+	}
 
+	chocoID, err := t.assign_id(stub, chocoID)
 	
-	chocolates_json := "{"+chocolatier+establishDate+chocoID+boxOrderDate+boxDelvDate+ingredOrderDate+ingredDelvDate+ingredOrigin
-	+contributers+ingredients+method+test+testers+revisions+testDate+dateFinalized+dateProduced+datePackaged+dateArrived+delivererID+delivered+status+"}" 	// Concatenates the variables to create the total JSON object
-	
-	matched, err := regexp.Match("^[A-z][A-z][0-9]{7}", []byte(chocoID))  				// matched = true if the chocoID passed fits format of two letters followed by seven digits
+																		if err != nil { fmt.Printf("CREATE_CHOCOLATES: %s", err); return nil, err }
+
+	attributes, err := t.parse_attributes(attributes_json)
 	
-																		if err != nil { fmt.Printf("CREATE_CHOCOLATES: Invalid chocoID: %s", err); return nil, errors.New("Invalid chocoID") }
+																		if err != nil { return nil, err }
 	
-	if 				chocoID  == "" 	 || 
-					matched == false    {
-																		fmt.Printf("CREATE_CHOCOLATES: Invalid chocoID provided");
-																		return nil, errors.New("Invalid chocoID provided")
+	return t.save_new_chocolates(stub, caller, caller_affiliation, chocoID, attributes)
+}
+
+//=================================================================================================================================
+//	 create_chocolates_auto - Creates new chocolates under an ID derived by the chaincode, so clients creating chocolates at
+//							  the same time can't collide. Returns the new chocoID.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_chocolates_auto(stub Stub, caller string, caller_affiliation int, attributes_json string) ([]byte, error) {
+
+	if 	caller_affiliation != DU_RHONE {							// Only DU_RHONE can create a new chocoID
+
+																		return nil, errors.New("Permission Denied")
 	}
 
-	err = json.Unmarshal([]byte(chocolates_json), &c)							// Convert the JSON defined above into a chocolates object for go
+	attributes, err := t.parse_attributes(attributes_json)
+	
+																		if err != nil { return nil, err }
+	
+	chocolatier := attributes.Chocolatier
+	
+	if chocolatier == "" { chocolatier = DEFAULT_CHOCOLATIER }
 	
-																		if err != nil { return nil, errors.New("Invalid JSON object") }
+	chocoID, err := t.derive_id(stub, chocolatier)
+	
+																		if err != nil { fmt.Printf("CREATE_CHOCOLATES_AUTO: %s", err); return nil, err }
+	
+	return t.save_new_chocolates(stub, caller, caller_affiliation, chocoID, attributes)
+}
 
-	record, err := stub.GetState(c.chocoID) 								// If not an error then a record exists so cant create a new chocolates with this chocoID as it must be unique
+//=================================================================================================================================
+//	 save_new_chocolates - Saves new chocolates under the chocoID passed, which must not be in use. Returns the chocoID.
+//=================================================================================================================================
+func (t *SimpleChaincode) save_new_chocolates(stub Stub, caller string, caller_affiliation int, chocoID string, attributes Choco_Attributes) ([]byte, error) {
+
+	record, err := stub.GetState(chocoID) 								// If a record exists we cant create new chocolates with this chocoID as it must be unique
 	
+																		if err != nil { fmt.Printf("CREATE_CHOCOLATES: Error checking chocoID: %s", err); return nil, errors.New("Error checking chocoID") }
 																		if record != nil { return nil, errors.New("Chocolates already exists") }
 	
-	if 	caller_affiliation != DU_RHONE {							// Only DU_RHONE can create a new chocoID
-
-																		return nil, errors.New("Permission Denied")
-	}
+	date, err := t.get_tx_date(stub)
+	
+																		if err != nil { fmt.Printf("CREATE_CHOCOLATES: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+	
+	c := new_chocolates(chocoID, caller, caller_affiliation, attributes, date)
 	
 	_, err  = t.save_changes(stub, c)									
 			
 																		if err != nil { fmt.Printf("CREATE_CHOCOLATES: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
-	bytes, err := stub.GetState("chocoIDs")
+	return []byte(chocoID), nil
 
-																		if err != nil { return nil, errors.New("Unable to get chocoIDs") }
-																		
-	var chocoIDs Choco_Holder
+}
+
+//=================================================================================================================================
+//	 Transfer Functions
+//=================================================================================================================================
+//	 lifecycle - The transition table for the chocolates. Each entry is a transfer that can be invoked by name, moving the
+//				 chocolates from one state to the next and handing custody to the recipient. Du Rhone keeps ownership
+//				 until the chocolates are delivered to IBM. The rework entries at the end send the chocolates back a
+//				 stage. Adding or changing a stage of the lifecycle only requires an edit to this table.
+//=================================================================================================================================
+var lifecycle = []Transition{
+	{	Function: "concepting_to_printing",		From: STATE_CONCEPTING,	To: STATE_PRINTING,		Caller: DU_RHONE,		Recipient: PRINTER,
+		Preconditions: []Precondition{
+			{ "ingredients have not been defined",		func(c Chocolates) bool { return len(c.Ingredients)  > 0 } },
+			{ "contributers have not been defined",		func(c Chocolates) bool { return len(c.Contributers) > 0 } },
+		},
+	},
+	{	Function: "printing_to_supplying",		From: STATE_PRINTING,	To: STATE_SUPPLYING,	Caller: PRINTER,		Recipient: SUPPLIER,	},
+	{	Function: "supplying_to_testing",		From: STATE_SUPPLYING,	To: STATE_TESTING,		Caller: SUPPLIER,		Recipient: DU_RHONE,
+		Preconditions: []Precondition{
+			{ "boxes have not been delivered",				func(c Chocolates) bool { return is_defined(c.BoxDelvDate) } },
+			{ "ingredients have not been delivered",		func(c Chocolates) bool { return is_defined(c.IngredDelvDate) } },
+			{ "ingredient origin has not been defined",		func(c Chocolates) bool { return is_defined(c.IngredOrigin) } },
+		},
+
+		Stamp: func(c *Chocolates, date string) { c.TastingApproved = false },							// Every time the chocolates come into testing they must be tasted again
+	},
+	{	Function: "testing_to_produciton",		From: STATE_TESTING,	To: STATE_PRODUCTION,	Caller: DU_RHONE,		Recipient: DU_RHONE,
+		Preconditions: []Precondition{
+			{ "tasting session has not approved the chocolates",	func(c Chocolates) bool { return c.TastingApproved } },
+			{ "recipe has not been finalized",				func(c Chocolates) bool { return is_defined(c.DateFinalized) } },
+		},
+	},
+	{	Function: "production_to_delivery",		From: STATE_PRODUCTION,	To: STATE_DELIVERY,		Caller: DU_RHONE,		Recipient: SHIPPING_CO,
+		Stamp: func(c *Chocolates, date string) { c.DateProduced = date; c.DatePackaged = date },
+		Effect: (*SimpleChaincode).depart_shipment,
+	},
+	{	Function: "delivery_to_delivered",		From: STATE_DELIVERY,	To: STATE_DELIVERED,	Caller: SHIPPING_CO,	Recipient: IBM,
+		Preconditions: []Precondition{
+			{ "deliverer has not been assigned",			func(c Chocolates) bool { return is_defined(c.DelivererID) } },
+		},
+		Effect: (*SimpleChaincode).deliver,
+	},
+	{	Function: "testing_to_concepting",		From: STATE_TESTING,	To: STATE_CONCEPTING,	Caller: DU_RHONE,		Recipient: DU_RHONE,
+		Rework: true,	Reasons: []string{ REWORK_TASTING_FAILED, REWORK_RECIPE_CHANGE },
+		Stamp: func(c *Chocolates, date string) { c.Test = "UNDEFINED"; c.TestDate = "UNDEFINED"; c.DateFinalized = "UNDEFINED"; c.TastingApproved = false },
+		Effect: (*SimpleChaincode).void_tasting_session,
+	},
+	{	Function: "supplying_to_printing",		From: STATE_SUPPLYING,	To: STATE_PRINTING,		Caller: SUPPLIER,		Recipient: PRINTER,
+		Rework: true,	Reasons: []string{ REWORK_PRINT_DEFECT, REWORK_WRONG_ARTWORK },
+		Stamp: func(c *Chocolates, date string) { c.BoxDelvDate = "UNDEFINED" },						// The reprinted boxes have to be delivered again
+	},
+	{	Function: "delivery_to_production",		From: STATE_DELIVERY,	To: STATE_PRODUCTION,	Caller: SHIPPING_CO,	Recipient: DU_RHONE,
+		Rework: true,	Reasons: []string{ REWORK_RETURNED, REWORK_DAMAGED_IN_TRANSIT },
+		Stamp: func(c *Chocolates, date string) { c.DelivererID = "UNDEFINED" },
+		Effect: (*SimpleChaincode).return_shipment,
+	},
+}
+
+//=================================================================================================================================
+//	 get_transition - Returns the entry in the lifecycle table for the transfer function named, or false if there is none.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_transition(function string) (Transition, bool) {
+
+	for _, transition := range lifecycle {
+		if transition.Function == function { return transition, true }
+	}
+	
+	return Transition{}, false
+}
+
+//=================================================================================================================================
+//	 transfer - Evaluates the transition passed against the chocolates, caller and recipient. If the chocolates are in the
+//				transition's from state, held by the caller, the affiliations match and every precondition holds then
+//				custody passes to the recipient and the status is set to the transition's to state.
+//=================================================================================================================================
+func (t *SimpleChaincode) transfer(stub Stub, transition Transition, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
 	
-	err = json.Unmarshal(bytes, &chocoIDs)
+	name := strings.ToUpper(transition.Function)
 	
-																		if err != nil {	return nil, errors.New("Corrupt Choco_Holder record") }
-															
-	chocoIDs.Chocos = append(chocoIDs.Chocos, chocoID)
+	err := t.check_transfer(transition, c, caller, caller_affiliation, recipient_affiliation)
 	
+															if err != nil { return nil, err }
 	
-	bytes, err = json.Marshal(chocoIDs)
+	if transition.Stamp != nil {
 	
-															if err != nil { fmt.Print("Error creating Choco_Holder record") }
-
-	err = stub.PutState("chocoIDs", bytes)
-
-															if err != nil { return nil, errors.New("Unable to put the state") }
+		date, err := t.get_tx_date(stub)
+															if err != nil { fmt.Printf("%s: Error retrieving transaction date: %s", name, err); return nil, errors.New("Error retrieving transaction date") }
+		
+		transition.Stamp(&c, date)
+	}
+	
+	if transition.Effect != nil {
+	
+		err = transition.Effect(t, stub, &c, caller, recipient_name)
+															if err != nil { return nil, err }
+	}
+	
+	c.Custodian     = recipient_name						// Hand the chocolates to the recipient
+	c.CustodianRole = recipient_affiliation
+	
+	c.Status = transition.To								// and move the chocolates on to the next state
+	
+	_, err = t.save_changes(stub, c)
+	
+															if err != nil { fmt.Printf("%s: Error saving changes: %s", name, err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
+	
+}
 
+//=================================================================================================================================
+//	 check_transfer - Returns an error unless the chocolates are in the transition's from state, held by the caller, the
+//					  affiliations match and every precondition holds.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_transfer(transition Transition, c Chocolates, caller string, caller_affiliation int, recipient_affiliation int) error {
+	
+	name := strings.ToUpper(transition.Function)
+	
+	if		c.Status				!= transition.From		||
+			c.Custodian				!= caller				||
+			caller_affiliation		!= transition.Caller	||
+			recipient_affiliation	!= transition.Recipient	||
+			c.Delivered				== true					{
+			
+															fmt.Printf("%s: Permission Denied", name)
+															return errors.New("Permission denied")
+	}
+	
+	for _, precondition := range transition.Preconditions {
+	
+		if precondition.Check(c) == false {
+															fmt.Printf("%s: Chocolates not ready, %s", name, precondition.Description)
+															return errors.New("Chocolates not ready for transfer: " + precondition.Description)
+		}
+	}
+	
+	return nil
 }
 
 //=================================================================================================================================
-//	 Transfer Functions
+//	 Update Functions
 //=================================================================================================================================
-//	 concepting_to_printing
+//	 update_boxOrderDate
 //=================================================================================================================================
-func (t *SimpleChaincode) concepting_to_printing(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_boxOrderDate(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if     	c.Status				== STATE_CONCEPTING	&&
-			c.Owner					== caller			&&
-			caller_affiliation		== DU_RHONE			&&
-			recipient_affiliation	== PRINTER			&&
-			c.Delivered				== false			{		// If the roles and users are ok 
+															if t.check_date(new_value) == false { return nil, errors.New("Invalid value passed for new box order date") }
 	
-					c.Owner  = recipient_name			// then make the owner the new owner
-					c.Status = STATE_PRINTING			//Update State
-					
-	} else {									// Otherwise if there is an error
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			c.Delivered			== false				{
+			
+					c.BoxOrderDate = new_value				// Update to the new value
+	} else {
 	
-															fmt.Printf("CONCEPTING_TO_PRINTING: Permission Denied");
-															return nil, errors.New("Permission Denied")
+															return nil, errors.New("Permission denied")
 	
 	}
 	
-	_, err := t.save_changes(stub, c)						// Write new state
-
-															if err != nil {	fmt.Printf("CONCEPTING_TO_PRINTING: Error saving changes: %s", err); return nil, errors.New("Error saving changes")	}
-														
-	return nil, nil									// We are Done
+	_, err := t.save_changes(stub, c)						// Save the changes in the blockchain
+	
+															if err != nil { fmt.Printf("UPDATE_BOXORDERDATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 printing_to_supplying
+//	 update_boxDelvDate
 //=================================================================================================================================
-func (t *SimpleChaincode) printing_to_supplying(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_boxDelvDate(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if 		c.EstablishDate == "UNDEFINED" || 					
-			c.Ingredients   == {} 		   ||
-			c.Contributers  == {}		   ||
-			c.Method        == "UNDEFINED" || 
-			c.DateFinalized == "UNDEFINED"	{
-														//If any part of the chocolates is undefined it has not bene fully concepted so cannot be sent
-															fmt.Printf("PRINTING_TO_SUPPLYING: Chocolates not fully defined")
-															return nil, errors.New("Chocolates not fully defined")
-	}
+															if t.check_date(new_value) == false { return nil, errors.New("Invalid value passed for new box delivery date") }
 	
-	if 		c.Status				== STATE_PRINTING		&& 
-			c.Owner					== caller				&& 
-			caller_affiliation		== PRINTER				&&
-			recipient_affiliation	== SUPPLIER				&& 
-			C.Delivered             == false							{
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			is_defined(c.BoxOrderDate)	== true			&&			// Boxes can't be delivered before they have been ordered
+			c.Delivered			== false				{
 			
-					v.Owner = recipient_name
-					v.Status = STATE_SUPPLYING
-					
+					c.BoxDelvDate = new_value
 	} else {
+	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
 	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("PRINTING_TO_SUPPLYING: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_BOXDELVDATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
-//////////// 8.4.2016      4:47 p.m.
+//=================================================================================================================================
+//	 update_ingredOrderDate
+//=================================================================================================================================
+func (t *SimpleChaincode) update_ingredOrderDate(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+															if t.check_date(new_value) == false { return nil, errors.New("Invalid value passed for new ingredient order date") }
+	
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			c.Delivered			== false				{
+			
+					c.IngredOrderDate = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_changes(stub, c)
+	
+															if err != nil { fmt.Printf("UPDATE_INGREDORDERDATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
 
 //=================================================================================================================================
-//	 supplying_to_testing
+//	 update_ingredDelvDate
 //=================================================================================================================================
-func (t *SimpleChaincode) supplying_to_testing(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_ingredDelvDate(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if 		c.Status				== STATE_SUPPLYING	&&
-			c.Owner					== caller			&&
-			caller_affiliation		== SUPPLIER			&& 
-			recipient_affiliation	== DU_RHONE			&&
-			c.Delivered				== false					{
+															if t.check_date(new_value) == false { return nil, errors.New("Invalid value passed for new ingredient delivery date") }
+	
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			is_defined(c.IngredOrderDate)== true			&&			// Ingredients can't be delivered before they have been ordered
+			c.Delivered			== false				{
 			
-					c.Owner = recipient_name
-					c.Status = recipient_affiliation
+					c.IngredDelvDate = new_value
 	} else {
-		
+	
 															return nil, errors.New("Permission denied")
 	
 	}
 	
 	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("SUPPLYING_TO_TESTING: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_INGREDDELVDATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 testing_to_produciton
+//	 update_ingredOrigin
 //=================================================================================================================================
-func (t *SimpleChaincode) testing_to_produciton(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_ingredOrigin(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if 		c.Status				== STATE_TESTING			&& 
-			c.Owner					== caller					&& 
-			caller_affiliation		== DU_RHONE					&& 
-			recipient_affiliation	== DU_RHONE					&& 
-			c.Delivered     		== false					{
-		
-					c.Owner  = recipient_name
-					c.Status = recipient_affiliation
-					
+															if strings.TrimSpace(new_value) == "" { return nil, errors.New("Invalid value passed for new ingredient origin") }
+	
+	if 		c.Status			== STATE_SUPPLYING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SUPPLIER				&&
+			c.Delivered			== false				{
+			
+					c.IngredOrigin = new_value
 	} else {
+	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
 	_, err := t.save_changes(stub, c)
-															if err != nil { fmt.Printf("TESTING_TO_PRODUCTION: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+															if err != nil { fmt.Printf("UPDATE_INGREDORIGIN: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 production_to_delivery
+//	 update_contributers - Takes a JSON array of names and replaces the contributers to the recipe with it.
 //=================================================================================================================================
-func (t *SimpleChaincode) production_to_delivery(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_contributers(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if		c.Status				== STATE_PRODUCTION		&&
-			c.Owner  				== caller				&& 
-			caller_affiliation		== DU_RHONE				&& 
-			recipient_affiliation	== SHIPPING_CO			&& 
-			c.Delivered				== false					{
-		
-				c.Owner = recipient_name
-				c.Status = recipient_affiliation
+	contributers, err := t.parse_list(new_value)
+	
+															if err != nil { return nil, errors.New("Invalid value passed for new contributers") }
 	
+	if 		c.Status			== STATE_CONCEPTING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
+			
+					c.Contributers = contributers
 	} else {
+	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
-	_, err := t.save_changes(stub, v)
-															if err != nil { fmt.Printf("PRODUCTION_TO_DELIVERY: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	_, err = t.save_changes(stub, c)
+	
+															if err != nil { fmt.Printf("UPDATE_CONTRIBUTERS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 delivery_to_delivered
+//	 update_ingredients - Takes a JSON array of ingredients and replaces the ingredients of the recipe with it. Any tasting
+//						  approval is withdrawn, and the recipe can't be changed while a tasting session is open.
 //=================================================================================================================================
-func (t *SimpleChaincode) delivery_to_delivered(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_ingredients(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	ingredients, err := t.parse_list(new_value)
 	
-	if		c.Status				== STATE_DELIVERY		&&
-			c.Owner					== caller				&& 
-			caller_affiliation		== SHIPPING_CO			&& 
-			recipient_affiliation	== IBM					&&
-			c.Delivered				== false					{
+															if err != nil { return nil, errors.New("Invalid value passed for new ingredients") }
+	
+	if 		(c.Status			== STATE_CONCEPTING		||			// The recipe can still be tweaked while it is being taste tested
+			 c.Status			== STATE_TESTING)		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
 			
-					c.Owner = recipient_name
-					c.Status = STATE_DELIVERED
+					c.Ingredients     = ingredients
+					c.TastingApproved = false					// A changed recipe has to be tasted again
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	if c.TastingSession > 0 {
+	
+		s, err := t.retrieve_tasting_session(stub, c.ChocoID, c.TastingSession)
+															if err != nil { return nil, err }
+															if s.Status == SESSION_OPEN { return nil, errors.New("Ingredients can't be changed while tasting session " + strconv.Itoa(s.Session) + " is open") }
+	}
+	
+	_, err = t.save_changes(stub, c)
+	
+															if err != nil { fmt.Printf("UPDATE_INGREDIENTS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
+
+//=================================================================================================================================
+//	 update_product - Names the product the chocolates are, which sets the storage limits they are kept within in transit.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_product(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	new_value = strings.TrimSpace(new_value)
 	
+															if new_value == "" || strings.Contains(new_value, KEY_SEPARATOR) { return nil, errors.New("Invalid value passed for new product") }
+	
+	if 		c.Status			<= STATE_PRODUCTION		&&			// The product can't change once the chocolates are in transit
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
+			
+					c.Product = new_value
 	} else {
-		
+	
 															return nil, errors.New("Permission denied")
 	
 	}
 	
 	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("DELIVERY_TO_DELIVERED: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_PRODUCT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 Update Functions
-//=================================================================================================================================
-//	 update_vin
+//	 update_quantity - Records the number of boxes produced, which the quantity IBM receives is checked against.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_vin(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *SimpleChaincode) update_quantity(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	new_vin, err := strconv.Atoi(string(new_value)) 		                // will return an error if the new vin contains non numerical chars
+	quantity, err := strconv.Atoi(strings.TrimSpace(new_value))
 	
-															if err != nil || len(string(new_value)) != 15 { return nil, errors.New("Invalid value passed for new VIN") }
+															if err != nil || quantity <= 0 { return nil, errors.New("Invalid value passed for new quantity") }
 	
-	if 		v.Status			== STATE_MANUFACTURE	&& 
-			v.Owner				== caller				&&
-			caller_affiliation	== MANUFACTURER			&&
-			v.VIN				== 0					&&			// Can't change the VIN after its initial assignment
-			v.Scrapped			== false				{
+	if 		c.Status			== STATE_PRODUCTION		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
 			
-					v.VIN = new_vin					// Update to the new value
+					c.Quantity = quantity
 	} else {
 	
 															return nil, errors.New("Permission denied")
-		
+	
 	}
 	
-	_, err  = t.save_changes(stub, v)						// Save the changes in the blockchain
+	_, err = t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("UPDATE_VIN: Error saving changes: %s", err); return nil, errors.New("Error saving changes") } 
+															if err != nil { fmt.Printf("UPDATE_QUANTITY: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
-
 //=================================================================================================================================
-//	 update_registration
+//	 update_test - Records the outcome of a taste test and the date it was carried out on.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_registration(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-
+func (t *SimpleChaincode) update_test(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if		v.Owner				== caller			&& 
-			caller_affiliation	!= SCRAP_MERCHANT	&&
-			v.Scrapped			== false			{
-			
-					v.Reg = new_value
+															if strings.TrimSpace(new_value) == "" { return nil, errors.New("Invalid value passed for new test") }
 	
+	test_date, err := t.get_tx_date(stub)
+	
+															if err != nil { fmt.Printf("UPDATE_TEST: Error retrieving transaction date: %s", err); return nil, errors.New("Error retrieving transaction date") }
+	
+	if 		c.Status			== STATE_TESTING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
+			
+					c.Test     = new_value
+					c.TestDate = test_date
 	} else {
+	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
-	_, err := t.save_changes(stub, v)
+	_, err = t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("UPDATE_REGISTRATION: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_TEST: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 update_colour
+//	 update_testers - Takes a JSON array of names and replaces the taste testers with it.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_colour(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *SimpleChaincode) update_testers(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+	testers, err := t.parse_list(new_value)
+	
+															if err != nil { return nil, errors.New("Invalid value passed for new testers") }
 	
-	if 		v.Owner				== caller				&&
-			caller_affiliation	== MANUFACTURER			&&/*((v.Owner				== caller			&&
-			caller_affiliation	== MANUFACTURER)		||
-			caller_affiliation	== AUTHORITY)			&&*/
-			v.Scrapped			== false				{
+	if 		c.Status			== STATE_TESTING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			c.Delivered			== false				{
 			
-					v.Colour = new_value
+					c.Testers = testers
 	} else {
 	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
-	_, err := t.save_changes(stub, v)
+	_, err = t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("UPDATE_COLOUR: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_TESTERS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 update_make
+//	 update_revisions - Appends the revision passed to the list of revisions made to the recipe during testing.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_make(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *SimpleChaincode) update_revisions(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+															if strings.TrimSpace(new_value) == "" { return nil, errors.New("Invalid value passed for new revision") }
 	
-	if 		v.Status			== STATE_MANUFACTURE	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== MANUFACTURER			&&
-			v.Scrapped			== false				{
+	if 		c.Status			== STATE_TESTING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			is_defined(c.DateFinalized)	== false			&&			// Can't revise a recipe that has been finalized
+			c.Delivered			== false				{
 			
-					v.Make = new_value
+					c.Revisions = append(c.Revisions, new_value)
 	} else {
 	
 															return nil, errors.New("Permission denied")
 	
 	}
 	
-	_, err := t.save_changes(stub, v)
+	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("UPDATE_MAKE: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_REVISIONS: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 update_model
+//	 update_dateFinalized
 //=================================================================================================================================
-func (t *SimpleChaincode) update_model(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *SimpleChaincode) update_dateFinalized(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
 	
-	if 		v.Status			== STATE_MANUFACTURE	&&
-			v.Owner				== caller				&& 
-			caller_affiliation	== MANUFACTURER			&&
-			v.Scrapped			== false				{
+															if t.check_date(new_value) == false { return nil, errors.New("Invalid value passed for new date finalized") }
+	
+	if 		c.Status			== STATE_TESTING		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== DU_RHONE				&&
+			is_defined(c.Test)			== true			&&			// The recipe must have been taste tested before it can be finalized
+			c.Delivered			== false				{
 			
-					v.Model = new_value
-					
+					c.DateFinalized = new_value
 	} else {
+	
 															return nil, errors.New("Permission denied")
+	
 	}
 	
-	_, err := t.save_changes(stub, v)
+	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("UPDATE_MODEL: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+															if err != nil { fmt.Printf("UPDATE_DATEFINALIZED: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
 }
 
 //=================================================================================================================================
-//	 scrap_Chocolates
+//	 update_delivererID
 //=================================================================================================================================
-func (t *SimpleChaincode) scrap_Chocolates(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) update_delivererID(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+															if strings.TrimSpace(new_value) == "" { return nil, errors.New("Invalid value passed for new deliverer ID") }
+	
+															if is_defined(c.ShipmentID) { return nil, errors.New("Deliverer ID is set by shipment " + c.ShipmentID) }
+	
+	if 		c.Status			== STATE_DELIVERY		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== SHIPPING_CO			&&
+			c.Delivered			== false				{
+			
+					c.DelivererID = new_value
+	} else {
+	
+															return nil, errors.New("Permission denied")
+	
+	}
+	
+	_, err := t.save_changes(stub, c)
+	
+															if err != nil { fmt.Printf("UPDATE_DELIVERERID: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
+	
+	return nil, nil
+	
+}
 
-	if		v.Status			== STATE_BEING_SCRAPPED	&& 
-			v.Owner				== caller				&& 
-			caller_affiliation	== SCRAP_MERCHANT		&& 
-			v.Scrapped			== false				{
-		
-					v.Scrapped = true
-				
+//=================================================================================================================================
+//	 update_receipt - Records the receipt reference IBM issues for the delivery before it is finished.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_receipt(stub Stub, c Chocolates, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	
+															if strings.TrimSpace(new_value) == "" { return nil, errors.New("Invalid value passed for new receipt") }
+	
+	if 		c.Status			== STATE_DELIVERED		&&
+			c.Custodian			== caller				&&
+			caller_affiliation	== IBM					&&
+			c.Delivered			== false				{
+			
+					c.Receipt = new_value
 	} else {
-		return nil, errors.New("Permission denied")
+	
+															return nil, errors.New("Permission denied")
+	
 	}
 	
-	_, err := t.save_changes(stub, v)
+	_, err := t.save_changes(stub, c)
 	
-															if err != nil { fmt.Printf("SCRAP_Chocolates: Error saving changes: %s", err); return nil, errors.New("SCRAP_Chocolatesrror saving changes") }
+															if err != nil { fmt.Printf("UPDATE_RECEIPT: Error saving changes: %s", err); return nil, errors.New("Error saving changes") }
 	
 	return nil, nil
 	
@@ -786,16 +1479,17 @@ func (t *SimpleChaincode) scrap_Chocolates(stub *shim.ChaincodeStub, c Chocolate
 //=================================================================================================================================
 //	 Read Functions
 //=================================================================================================================================
-//	 get_Chocolates_details
+//	 get_chocolate_details
 //=================================================================================================================================
-func (t *SimpleChaincode) get_Chocolates_details(stub *shim.ChaincodeStub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) get_chocolate_details(stub Stub, c Chocolates, caller string, caller_affiliation int) ([]byte, error) {
 	
-	bytes, err := json.Marshal(v)
+	bytes, err := json.Marshal(c)
 	
-																if err != nil { return nil, errors.New("GET_Chocolates_DETAILS: Invalid Chocolates object") }
+																if err != nil { return nil, errors.New("GET_CHOCOLATE_DETAILS: Invalid Chocolates object") }
 																
-	if 		v.Owner				== caller		||
-			caller_affiliation	== AUTHORITY	{
+	if 		c.Owner				== caller		||
+			c.Custodian			== caller		||
+			caller_affiliation	== DU_RHONE		{
 			
 					return bytes, nil		
 	} else {
@@ -805,33 +1499,58 @@ func (t *SimpleChaincode) get_Chocolates_details(stub *shim.ChaincodeStub, c Cho
 }
 
 //=================================================================================================================================
-//	 get_Chocolates_details
+//	 get_chocos - Returns every chocolates record the caller is allowed to see.
 //=================================================================================================================================
 
-func (t *SimpleChaincode) get_Chocolatess(stub *shim.ChaincodeStub, caller string, caller_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) get_chocos(stub Stub, caller string, caller_affiliation int) ([]byte, error) {
 
-	bytes, err := stub.GetState("v5cIDs")
+	chocoIDs, err := t.get_indexed_ids(stub, INDEX_STATUS)			// Every chocolates record has exactly one entry in the status index
 		
-																			if err != nil { return nil, errors.New("Unable to get v5cIDs") }
-																	
-	var v5cIDs V5C_Holder
+																			if err != nil { return nil, errors.New("Unable to get chocoIDs") }
 	
-	err = json.Unmarshal(bytes, &v5cIDs)						
-	
-																			if err != nil {	return nil, errors.New("Corrupt V5C_Holder") }
+	return t.get_chocos_details(stub, chocoIDs, caller, caller_affiliation)
+}
+
+//=================================================================================================================================
+//	 get_chocos_by - Returns the chocolates records the caller is allowed to see that have the value passed in the index
+//					 named, one of status, owner, custodian, chocolatier or lot. Only the matching records are read.
+//=================================================================================================================================
+
+func (t *SimpleChaincode) get_chocos_by(stub Stub, caller string, caller_affiliation int, index string, value string) ([]byte, error) {
+
+	if 		index != INDEX_STATUS		&&
+			index != INDEX_OWNER		&&
+			index != INDEX_CUSTODIAN	&&
+			index != INDEX_LOT			&&
+			index != INDEX_CHOCOLATIER	{
+																			return nil, errors.New("Unknown index " + index)
+	}
+
+	chocoIDs, err := t.get_indexed_ids(stub, index, value)
+		
+																			if err != nil { return nil, errors.New("Unable to get chocoIDs") }
 	
+	return t.get_chocos_details(stub, chocoIDs, caller, caller_affiliation)
+}
+
+//=================================================================================================================================
+//	 get_chocos_details - Retrieves the chocolates with the IDs passed and returns a JSON array of those the caller is
+//						  allowed to see.
+//=================================================================================================================================
+
+func (t *SimpleChaincode) get_chocos_details(stub Stub, chocoIDs []string, caller string, caller_affiliation int) ([]byte, error) {
+
 	result := "["
 	
 	var temp []byte
-	var c Chocolates
 	
-	for _, v5c := range v5cIDs.V5Cs {
+	for _, chocoID := range chocoIDs {
 		
-		v, err = t.retrieve_v5c(stub, v5c)
+		c, err := t.retrieve_chocoID(stub, chocoID)
 		
-		if err != nil {return nil, errors.New("Failed to retrieve V5C")}
+		if err != nil {return nil, errors.New("Failed to retrieve chocoID")}
 		
-		temp, err = t.get_Chocolates_details(stub, c, caller, caller_affiliation)
+		temp, err = t.get_chocolate_details(stub, c, caller, caller_affiliation)
 		
 		if err == nil {
 			result += string(temp) + ","	
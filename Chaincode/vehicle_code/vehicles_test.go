@@ -0,0 +1,689 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+//==============================================================================================================================
+//	test_ledger - Runs the chaincode against a Mock_Stub with a participant registered for each affiliation.
+//==============================================================================================================================
+type test_ledger struct {
+	t				*testing.T
+	cc				*SimpleChaincode
+	stub			*Mock_Stub
+	ecerts			*Mock_ECerts
+}
+
+func new_test_ledger(t *testing.T, init_args ...string) *test_ledger {
+
+	l := &test_ledger{ t: t, stub: new_mock_stub(), ecerts: new_mock_ecerts() }
+	l.cc = &SimpleChaincode{ ecerts: l.ecerts }
+
+	l.ecerts.register("durhone",	"durhone\\group1\\1")
+	l.ecerts.register("durhone2",	"durhone2\\group1\\1")
+	l.ecerts.register("printer",	"printer\\group1\\2")
+	l.ecerts.register("supplier",	"supplier\\group1\\3")
+	l.ecerts.register("shipper",	"shipper\\group1\\4")
+	l.ecerts.register("ibm",		"ibm\\group1\\5")
+
+	l.stub.begin(nil)
+	_, err := l.cc.init_chaincode(l.stub, "init", append([]string{ "localhost:5000" }, init_args...))
+	if err != nil { t.Fatalf("init: %s", err) }
+
+	return l
+}
+
+func (l *test_ledger) invoke(user string, function string, args ...string) ([]byte, error) {
+
+	l.stub.begin(l.ecerts.callers[user])
+
+	result, err := l.cc.invoke(l.stub, function, args)
+
+	if err != nil { l.stub.rollback() }
+
+	return result, err
+}
+
+func (l *test_ledger) must_invoke(user string, function string, args ...string) []byte {
+
+	result, err := l.invoke(user, function, args...)
+	if err != nil { l.t.Fatalf("%s %s %v: %s", user, function, args, err) }
+
+	return result
+}
+
+func (l *test_ledger) query(user string, function string, args ...string) ([]byte, error) {
+
+	l.stub.begin(l.ecerts.callers[user])
+
+	return l.cc.query(l.stub, function, args)
+}
+
+func (l *test_ledger) must_query(user string, function string, args ...string) []byte {
+
+	result, err := l.query(user, function, args...)
+	if err != nil { l.t.Fatalf("%s %s %v: %s", user, function, args, err) }
+
+	return result
+}
+
+func (l *test_ledger) chocolates(chocoID string) Chocolates {
+
+	var c Chocolates
+
+	err := json.Unmarshal(l.stub.state[chocoID], &c)
+	if err != nil { l.t.Fatalf("chocolates %s: %s", chocoID, err) }
+
+	return c
+}
+
+//==============================================================================================================================
+//	 register - Adds the user named to the participant registry with the role passed, unless they are already registered.
+//==============================================================================================================================
+func (l *test_ledger) register(user string, role int) {
+
+	if _, found, _ := find_participant(l.stub, user); found { return }
+
+	l.must_invoke("durhone", "register_participant", fmt.Sprintf(`{"username": %q, "role": %d}`, user, role))
+}
+
+//==============================================================================================================================
+//	 single_leg_shipment - Returns a shipment for the chocolates named that shipper carries in one leg.
+//==============================================================================================================================
+func single_leg_shipment(chocoID string) string {
+
+	return `{"shipmentID": "SH-` + chocoID + `", "origin": "Brussels", "destination": "Armonk", "legs": [
+		{"carrier": "shipper", "from": "Brussels", "to": "Armonk", "plannedDeparture": "2016-08-10T09:00:00Z", "plannedArrival": "2016-08-20T12:00:00Z"}]}`
+}
+
+//==============================================================================================================================
+//	 advance - Creates the chocolates and drives them through the lifecycle until they reach the state passed, filling in
+//			   every field that the transfers on the way require.
+//==============================================================================================================================
+func (l *test_ledger) advance(chocoID string, state int) {
+
+	l.must_invoke("durhone", "create_chocolates", chocoID)
+
+	steps := []func(){
+		func() {
+			l.must_invoke("durhone",	"update_ingredients",		`["cocoa","hazelnut"]`,	chocoID)
+			l.must_invoke("durhone",	"update_contributers",		`["Chef Watson"]`,		chocoID)
+			l.must_invoke("durhone",	"concepting_to_printing",	"printer",				chocoID)
+		},
+		func() {
+			l.must_invoke("printer",	"printing_to_supplying",	"supplier",				chocoID)
+		},
+		func() {
+			l.must_invoke("supplier",	"update_boxOrderDate",		"2016-08-02",			chocoID)
+			l.must_invoke("supplier",	"update_boxDelvDate",		"2016-08-03",			chocoID)
+			l.must_invoke("supplier",	"update_ingredOrderDate",	"2016-08-02",			chocoID)
+			l.must_invoke("supplier",	"update_ingredDelvDate",	"2016-08-04",			chocoID)
+			l.must_invoke("supplier",	"update_ingredOrigin",		"Ghana",				chocoID)
+			l.must_invoke("supplier",	"supplying_to_testing",		"durhone",				chocoID)
+		},
+		func() {
+			l.register("durhone", DU_RHONE)
+			l.must_invoke("durhone",	"update_testers",			`["durhone"]`,			chocoID)
+			l.must_invoke("durhone",	"open_tasting_session",		chocoID)
+			l.must_invoke("durhone",	"submit_tasting_score",		test_scores,			chocoID)
+			l.must_invoke("durhone",	"close_tasting_session",	chocoID)
+			l.must_invoke("durhone",	"update_dateFinalized",		"2016-08-05",			chocoID)
+			l.must_invoke("durhone",	"testing_to_produciton",	"durhone",				chocoID)
+		},
+		func() {
+			l.must_invoke("durhone",	"create_shipment",			single_leg_shipment(chocoID),	chocoID)
+			l.must_invoke("durhone",	"production_to_delivery",	"shipper",				chocoID)
+		},
+		func() {
+			l.must_invoke("shipper",	"delivery_to_delivered",	"ibm",					chocoID)
+		},
+	}
+
+	for i := 0; i < state; i++ { steps[i]() }
+}
+
+func TestCreateChocolates(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		user		string
+		chocoID		string
+		ok			bool
+	}{
+		{ "du rhone creates",				"durhone",	"AB1234567",	true	},
+		{ "printer cannot create",			"printer",	"AB1234567",	false	},
+		{ "ibm cannot create",				"ibm",		"AB1234567",	false	},
+		{ "digits where letters expected",	"durhone",	"121234567",	false	},
+		{ "too few digits",					"durhone",	"AB12345",		false	},
+		{ "empty ID",						"durhone",	"",				false	},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+
+			_, err := l.invoke(test.user, "create_chocolates", test.chocoID)
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if !test.ok { return }
+
+			c := l.chocolates(test.chocoID)
+
+			if c.ChocoID != test.chocoID || c.Owner != test.user || c.Status != STATE_CONCEPTING || c.Delivered {
+				t.Errorf("unexpected record %+v", c)
+			}
+		})
+	}
+
+	t.Run("duplicate ID", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.must_invoke("durhone", "create_chocolates", "AB1234567")
+
+		_, err := l.invoke("durhone", "create_chocolates", "AB1234567")
+		if err == nil { t.Fatal("expected duplicate create to fail") }
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.must_invoke("durhone", "create_chocolates", "AB1234567")
+
+		c := l.chocolates("AB1234567")
+
+		if c.Chocolatier != DEFAULT_CHOCOLATIER || c.Method != DEFAULT_METHOD || c.EstablishDate != "2016-08-01" ||
+		   c.Test != "UNDEFINED" || c.Ingredients == nil || len(c.Ingredients) != 0 || c.OwnerRole != DU_RHONE {
+			t.Errorf("unexpected defaults %+v", c)
+		}
+	})
+
+	t.Run("attributes", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.must_invoke("durhone", "create_chocolates", "AB1234567", `{"chocolatier": " Maison Du Rhone ", "establishDate": "1875-03-01", "method": "Stone ground",
+			"ingredients": ["cocoa", "sugar"], "contributers": ["Chef Watson"]}`)
+
+		c := l.chocolates("AB1234567")
+
+		if c.Chocolatier != "Maison Du Rhone" || c.EstablishDate != "1875-03-01" || c.Method != "Stone ground" ||
+		   len(c.Ingredients) != 2 || len(c.Contributers) != 1 {
+			t.Errorf("attributes not applied %+v", c)
+		}
+
+		l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")		// Ingredients and contributers are already set
+	})
+
+	t.Run("invalid attributes", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+
+		tests := map[string][]Field_Error{
+			`[1, 2]`:								{ { "attributes", "must be a JSON object" } },
+			`{"chocolatier": 7}`:					{ { "chocolatier", "must be a string" } },
+			`{"establishDate": "01/03/1875"}`:		{ { "establishDate", "must be a date in the format YYYY-MM-DD" } },
+			`{"method": " ", "colour": "brown"}`:	{ { "colour", "unknown attribute" }, { "method", "must not be empty" } },
+			`{"ingredients": "cocoa"}`:				{ { "ingredients", "must be an array of strings" } },
+			`{"contributers": ["Chef Watson", ""]}`:	{ { "contributers", "entries must not be empty" } },
+			`{"method": "` + strings.Repeat("x", MAX_TEXT_LENGTH + 1) + `"}`:	{ { "method", "must be at most 256 characters" } },
+		}
+
+		for attributes, want := range tests {
+
+			_, err := l.invoke("durhone", "create_chocolates", "AB1234567", attributes)
+
+			invalid, ok := err.(*Validation_Error)
+			if !ok { t.Errorf("%s: expected Validation_Error, got %v", attributes, err); continue }
+
+			got, _  := json.Marshal(invalid.Fields)
+			wanted, _ := json.Marshal(want)
+
+			if string(got) != string(wanted) { t.Errorf("%s: fields = %s, want %s", attributes, got, wanted) }
+		}
+
+		if _, ok := l.stub.state["AB1234567"]; ok { t.Error("invalid create saved a record") }
+	})
+}
+
+func TestTransitions(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		prepare		func(l *test_ledger)
+		user		string
+		function	string
+		recipient	string
+		ok			bool
+		want_status	int
+	}{
+		{ "concepting to printing",				STATE_CONCEPTING,	func(l *test_ledger) {
+			l.must_invoke("durhone", "update_ingredients",  `["cocoa"]`, "AB1234567")
+			l.must_invoke("durhone", "update_contributers", `["Chef Watson"]`, "AB1234567")
+		},	"durhone",	"concepting_to_printing",	"printer",	true,	STATE_PRINTING },
+		{ "concepting without ingredients",		STATE_CONCEPTING,	nil,	"durhone",	"concepting_to_printing",	"printer",	false,	0 },
+		{ "printing to supplying",				STATE_PRINTING,		nil,	"printer",	"printing_to_supplying",	"supplier",	true,	STATE_SUPPLYING },
+		{ "supplying to testing",				STATE_SUPPLYING,	func(l *test_ledger) {
+			l.must_invoke("supplier", "update_boxOrderDate",	"2016-08-02", "AB1234567")
+			l.must_invoke("supplier", "update_boxDelvDate",		"2016-08-03", "AB1234567")
+			l.must_invoke("supplier", "update_ingredOrderDate",	"2016-08-02", "AB1234567")
+			l.must_invoke("supplier", "update_ingredDelvDate",	"2016-08-04", "AB1234567")
+			l.must_invoke("supplier", "update_ingredOrigin",	"Ghana",      "AB1234567")
+		},	"supplier",	"supplying_to_testing",		"durhone",	true,	STATE_TESTING },
+		{ "supplying before delivery",			STATE_SUPPLYING,	nil,	"supplier",	"supplying_to_testing",		"durhone",	false,	0 },
+		{ "testing to production",				STATE_TESTING,		func(l *test_ledger) {
+			l.register("durhone", DU_RHONE)
+			l.must_invoke("durhone", "update_testers",			`["durhone"]`, "AB1234567")
+			l.must_invoke("durhone", "open_tasting_session",	"AB1234567")
+			l.must_invoke("durhone", "submit_tasting_score",	test_scores,  "AB1234567")
+			l.must_invoke("durhone", "close_tasting_session",	"AB1234567")
+			l.must_invoke("durhone", "update_dateFinalized",	"2016-08-05", "AB1234567")
+		},	"durhone",	"testing_to_produciton",	"durhone",	true,	STATE_PRODUCTION },
+		{ "testing without tasting approval",	STATE_TESTING,		func(l *test_ledger) {
+			l.must_invoke("durhone", "update_test",				"Passed",     "AB1234567")
+			l.must_invoke("durhone", "update_dateFinalized",	"2016-08-05", "AB1234567")
+		},	"durhone",	"testing_to_produciton",	"durhone",	false,	0 },
+		{ "testing before finalized",			STATE_TESTING,		nil,	"durhone",	"testing_to_produciton",	"durhone",	false,	0 },
+		{ "production to delivery",				STATE_PRODUCTION,	func(l *test_ledger) {
+			l.must_invoke("durhone", "create_shipment", single_leg_shipment("AB1234567"), "AB1234567")
+		},	"durhone",	"production_to_delivery",	"shipper",	true,	STATE_DELIVERY },
+		{ "production without a shipment",		STATE_PRODUCTION,	nil,	"durhone",	"production_to_delivery",	"shipper",	false,	0 },
+		{ "delivery to delivered",				STATE_DELIVERY,		nil,	"shipper",	"delivery_to_delivered",	"ibm",		true,	STATE_DELIVERED },
+		{ "caller is not the custodian",		STATE_PRINTING,		nil,	"durhone",	"printing_to_supplying",	"supplier",	false,	0 },
+		{ "recipient has wrong affiliation",	STATE_PRINTING,		nil,	"printer",	"printing_to_supplying",	"ibm",		false,	0 },
+		{ "transfer from the wrong state",		STATE_PRINTING,		nil,	"printer",	"production_to_delivery",	"shipper",	false,	0 },
+		{ "custodian with wrong affiliation",	STATE_PRODUCTION,	nil,	"durhone2",	"production_to_delivery",	"shipper",	false,	0 },
+		{ "unknown recipient",					STATE_PRINTING,		nil,	"printer",	"printing_to_supplying",	"nobody",	false,	0 },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			if test.prepare != nil { test.prepare(l) }
+
+			before := l.chocolates("AB1234567")
+
+			_, err := l.invoke(test.user, test.function, test.recipient, "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			c := l.chocolates("AB1234567")
+
+			if !test.ok {
+				if c.Status != before.Status || c.Owner != before.Owner || c.Custodian != before.Custodian { t.Errorf("denied transfer changed the record: %+v", c) }
+				return
+			}
+
+			if c.Status    != test.want_status	{ t.Errorf("status = %d, want %d", c.Status, test.want_status) }
+			if c.Custodian != test.recipient	{ t.Errorf("custodian = %s, want %s", c.Custodian, test.recipient) }
+			if c.Owner     != "durhone"			{ t.Errorf("owner = %s, want durhone", c.Owner) }			// Du Rhone owns the chocolates until IBM accepts them
+		})
+	}
+}
+
+func TestProductionStampsDates(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_DELIVERY)
+
+	c := l.chocolates("AB1234567")
+
+	if !l.cc.check_date(c.DateProduced) || !l.cc.check_date(c.DatePackaged) { t.Errorf("production dates not stamped: %+v", c) }
+}
+
+func TestUpdates(t *testing.T) {
+
+	tests := []struct {
+		name		string
+		state		int
+		user		string
+		function	string
+		value		string
+		ok			bool
+		check		func(c Chocolates) bool
+	}{
+		{ "box order date",						STATE_SUPPLYING,	"supplier",	"update_boxOrderDate",		"2016-08-02",	true,	func(c Chocolates) bool { return c.BoxOrderDate == "2016-08-02" } },
+		{ "box order date invalid",				STATE_SUPPLYING,	"supplier",	"update_boxOrderDate",		"tomorrow",		false,	nil },
+		{ "box order date wrong state",			STATE_PRINTING,		"printer",	"update_boxOrderDate",		"2016-08-02",	false,	nil },
+		{ "box delivery before order",			STATE_SUPPLYING,	"supplier",	"update_boxDelvDate",		"2016-08-03",	false,	nil },
+		{ "ingredient order date",				STATE_SUPPLYING,	"supplier",	"update_ingredOrderDate",	"2016-08-02",	true,	func(c Chocolates) bool { return c.IngredOrderDate == "2016-08-02" } },
+		{ "ingredient delivery before order",	STATE_SUPPLYING,	"supplier",	"update_ingredDelvDate",	"2016-08-04",	false,	nil },
+		{ "ingredient origin",					STATE_SUPPLYING,	"supplier",	"update_ingredOrigin",		"Ghana",		true,	func(c Chocolates) bool { return c.IngredOrigin == "Ghana" } },
+		{ "ingredient origin by du rhone",		STATE_SUPPLYING,	"durhone",	"update_ingredOrigin",		"Ghana",		false,	nil },
+		{ "contributers",						STATE_CONCEPTING,	"durhone",	"update_contributers",		`["Chef Watson","Anna"]`,	true,	func(c Chocolates) bool { return len(c.Contributers) == 2 } },
+		{ "contributers not a list",			STATE_CONCEPTING,	"durhone",	"update_contributers",		"Chef Watson",	false,	nil },
+		{ "contributers by printer",			STATE_PRINTING,		"printer",	"update_contributers",		`["Anna"]`,		false,	nil },
+		{ "ingredients",						STATE_CONCEPTING,	"durhone",	"update_ingredients",		`["cocoa"]`,	true,	func(c Chocolates) bool { return c.Ingredients[0] == "cocoa" } },
+		{ "ingredients during testing",			STATE_TESTING,		"durhone",	"update_ingredients",		`["cocoa","salt"]`,	true,	func(c Chocolates) bool { return len(c.Ingredients) == 2 } },
+		{ "ingredients with empty entry",		STATE_CONCEPTING,	"durhone",	"update_ingredients",		`["cocoa",""]`,	false,	nil },
+		{ "product",							STATE_PRODUCTION,	"durhone",	"update_product",			"Dark 70%",		true,	func(c Chocolates) bool { return c.Product == "Dark 70%" } },
+		{ "product in transit",					STATE_DELIVERY,		"shipper",	"update_product",			"Dark 70%",		false,	nil },
+		{ "quantity",							STATE_PRODUCTION,	"durhone",	"update_quantity",			"120",			true,	func(c Chocolates) bool { return c.Quantity == 120 } },
+		{ "quantity not a number",				STATE_PRODUCTION,	"durhone",	"update_quantity",			"lots",			false,	nil },
+		{ "test",								STATE_TESTING,		"durhone",	"update_test",				"Passed",		true,	func(c Chocolates) bool { return c.Test == "Passed" && c.TestDate != "UNDEFINED" } },
+		{ "test outside testing",				STATE_PRODUCTION,	"durhone",	"update_test",				"Passed",		false,	nil },
+		{ "testers",							STATE_TESTING,		"durhone",	"update_testers",			`["Bob"]`,		true,	func(c Chocolates) bool { return c.Testers[0] == "Bob" } },
+		{ "revisions",							STATE_TESTING,		"durhone",	"update_revisions",			"Less sugar",	true,	func(c Chocolates) bool { return c.Revisions[0] == "Less sugar" } },
+		{ "date finalized before test",			STATE_TESTING,		"durhone",	"update_dateFinalized",		"2016-08-05",	false,	nil },
+		{ "deliverer set by the shipment",		STATE_DELIVERY,		"shipper",	"update_delivererID",		"TRUCK-7",		false,	nil },
+		{ "deliverer by ibm",					STATE_DELIVERY,		"ibm",		"update_delivererID",		"TRUCK-7",		false,	nil },
+		{ "receipt",							STATE_DELIVERED,	"ibm",		"update_receipt",			"R-100",		true,	func(c Chocolates) bool { return c.Receipt == "R-100" } },
+		{ "receipt by shipper",					STATE_DELIVERED,	"shipper",	"update_receipt",			"R-100",		false,	nil },
+		{ "unknown update",						STATE_CONCEPTING,	"durhone",	"update_colour",			"red",			false,	nil },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.advance("AB1234567", test.state)
+
+			_, err := l.invoke(test.user, test.function, test.value, "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+
+			if test.ok && !test.check(l.chocolates("AB1234567")) { t.Errorf("update not applied: %+v", l.chocolates("AB1234567")) }
+		})
+	}
+
+	t.Run("revisions after finalized", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.advance("AB1234567", STATE_TESTING)
+		l.must_invoke("durhone", "update_test", "Passed", "AB1234567")
+		l.must_invoke("durhone", "update_dateFinalized", "2016-08-05", "AB1234567")
+
+		_, err := l.invoke("durhone", "update_revisions", "More salt", "AB1234567")
+		if err == nil { t.Fatal("expected revision after finalizing to fail") }
+	})
+}
+
+func TestInvokeErrors(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_CONCEPTING)
+
+	tests := []struct {
+		name		string
+		function	string
+		args		[]string
+	}{
+		{ "unknown function",		"make_chocolates",		[]string{ "printer", "AB1234567" } },
+		{ "missing chocolates",		"update_test",			[]string{ "Passed", "ZZ0000000" } },
+		{ "missing arguments",		"update_test",			[]string{ "Passed" } },
+		{ "create without ID",		"create_chocolates",	[]string{} },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := l.invoke("durhone", test.function, test.args...); err == nil { t.Fatal("expected an error") }
+		})
+	}
+}
+
+func TestGetChocolateDetails(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AB1234567", STATE_PRINTING)
+
+	tests := []struct {
+		user		string
+		ok			bool
+	}{
+		{ "printer",	true	},		// Custodian
+		{ "durhone",	true	},		// Du Rhone can see every chocolate
+		{ "supplier",	false	},
+		{ "ibm",		false	},
+	}
+
+	for _, test := range tests {
+		t.Run(test.user, func(t *testing.T) {
+
+			result, err := l.query(test.user, "get_chocolate_details", "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if test.ok && !strings.Contains(string(result), `"ID":"AB1234567"`) { t.Errorf("unexpected result %s", result) }
+		})
+	}
+
+	if _, err := l.query("durhone", "get_chocolate_details", "ZZ0000000"); err == nil { t.Error("expected missing chocolates to fail") }
+	if _, err := l.query("durhone", "get_chocolate_details"); err == nil { t.Error("expected missing argument to fail") }
+	if _, err := l.query("durhone", "get_everything"); err == nil { t.Error("expected unknown query to fail") }
+}
+
+func TestGetChocos(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AA0000001", STATE_CONCEPTING)
+	l.advance("AA0000002", STATE_PRINTING)
+	l.advance("AA0000003", STATE_SUPPLYING)
+
+	count := func(result []byte) int {
+		var list []Chocolates
+		if err := json.Unmarshal(result, &list); err != nil { t.Fatalf("invalid result %s: %s", result, err) }
+		return len(list)
+	}
+
+	tests := []struct {
+		name		string
+		user		string
+		function	string
+		args		[]string
+		want		int
+	}{
+		{ "du rhone sees all",			"durhone",	"get_chocos",		nil,							3 },
+		{ "printer sees its own",		"printer",	"get_chocos",		nil,							1 },
+		{ "ibm sees none",				"ibm",		"get_chocos",		nil,							0 },
+		{ "by status",					"durhone",	"get_chocos_by",	[]string{ "status", "1" },		1 },
+		{ "by owner",					"durhone",	"get_chocos_by",	[]string{ "owner", "durhone" },	3 },
+		{ "by custodian",				"durhone",	"get_chocos_by",	[]string{ "custodian", "durhone" },	1 },
+		{ "chocolates by owner",		"durhone",	"get_chocolates_by_owner",		[]string{ "durhone" },	3 },
+		{ "chocolates by custodian",	"printer",	"get_chocolates_by_custodian",	[]string{ "printer" },	1 },
+		{ "custodian sees what it holds",	"supplier",	"get_chocolates_by_owner",	[]string{ "durhone" },	1 },
+		{ "by chocolatier",				"durhone",	"get_chocos_by",	[]string{ "chocolatier", "Du Rhone-IBM" },	3 },
+		{ "by owner not visible",		"printer",	"get_chocos_by",	[]string{ "owner", "supplier" },	0 },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			result, err := l.query(test.user, test.function, test.args...)
+			if err != nil { t.Fatal(err) }
+
+			if got := count(result); got != test.want { t.Errorf("got %d chocolates, want %d", got, test.want) }
+		})
+	}
+
+	if _, err := l.query("durhone", "get_chocos_by", "colour", "red"); err == nil { t.Error("expected unknown index to fail") }
+}
+
+func TestGetChocosPage(t *testing.T) {
+
+	l := new_test_ledger(t)
+
+	for _, id := range []string{ "AA0000001", "AA0000002", "AA0000003", "AA0000004", "AA0000005" } { l.advance(id, STATE_CONCEPTING) }
+	l.advance("AA0000006", STATE_DELIVERY)
+
+	page := func(user string, args ...string) Choco_Page {
+		result, err := l.query(user, "get_chocos_page", args...)
+		if err != nil { t.Fatalf("get_chocos_page %v: %s", args, err) }
+		var p Choco_Page
+		if err := json.Unmarshal(result, &p); err != nil { t.Fatalf("invalid page %s: %s", result, err) }
+		return p
+	}
+
+	t.Run("pages through every record", func(t *testing.T) {
+
+		seen, bookmark := 0, ""
+
+		for i := 0; i < 10; i++ {
+			p := page("durhone", "", "2", bookmark)
+			seen += p.Count
+			bookmark = p.Bookmark
+			if bookmark == "" { break }
+		}
+
+		if seen != 6 { t.Errorf("saw %d records, want 6", seen) }
+	})
+
+	t.Run("filters by status", func(t *testing.T) {
+		if p := page("durhone", `{"status": 0}`); p.Count != 5 || p.Bookmark != "" { t.Errorf("unexpected page %+v", p) }
+	})
+
+	t.Run("filters by delivered flag", func(t *testing.T) {
+		if p := page("durhone", `{"delivered": true}`); p.Count != 0 { t.Errorf("unexpected page %+v", p) }
+	})
+
+	t.Run("filters by date range", func(t *testing.T) {
+		if p := page("durhone", `{"dates": [{"field": "dateProduced", "from": "2016-08-01", "to": "2016-12-31"}]}`); p.Count != 1 || p.Results[0].ChocoID != "AA0000006" { t.Errorf("unexpected page %+v", p) }
+		if p := page("durhone", `{"dates": [{"field": "dateProduced", "to": "2016-07-31"}]}`); p.Count != 0 { t.Errorf("unexpected page %+v", p) }
+	})
+
+	t.Run("filters by owner and custodian", func(t *testing.T) {
+		if p := page("shipper", `{"custodian": "shipper"}`); p.Count != 1 { t.Errorf("unexpected page %+v", p) }
+		if p := page("shipper", `{"owner": "shipper"}`);     p.Count != 0 { t.Errorf("unexpected page %+v", p) }
+	})
+
+	t.Run("rejects invalid input", func(t *testing.T) {
+
+		invalid := [][]string{
+			{ "{not json" },
+			{ `{"dates": [{"field": "colour"}]}` },
+			{ `{"dates": [{"field": "dateProduced", "from": "August"}]}` },
+			{ "", "0" },
+			{ "", "1000" },
+			{ "", "2", "not-a-bookmark" },
+			{ `{"status": 1}`, "2", page("durhone", "", "2").Bookmark },		// Bookmark from a different filter
+		}
+
+		for _, args := range invalid {
+			if _, err := l.query("durhone", "get_chocos_page", args...); err == nil { t.Errorf("expected %v to fail", args) }
+		}
+	})
+}
+
+func TestHistoryAndEvents(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.must_invoke("durhone", "create_chocolates", "AB1234567")
+
+	if l.stub.event_name != EVENT_CREATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_CREATED) }
+
+	l.must_invoke("durhone", "update_ingredients", `["cocoa"]`, "AB1234567")
+
+	if l.stub.event_name != EVENT_UPDATED { t.Errorf("event = %s, want %s", l.stub.event_name, EVENT_UPDATED) }
+
+	l.must_invoke("durhone", "update_contributers", `["Chef Watson"]`, "AB1234567")
+	l.must_invoke("durhone", "concepting_to_printing", "printer", "AB1234567")
+
+	var event Choco_Event
+	if err := json.Unmarshal(l.stub.event_payload, &event); err != nil { t.Fatal(err) }
+
+	if l.stub.event_name != EVENT_TRANSFERRED || event.FromStatus != STATE_CONCEPTING || event.ToStatus != STATE_PRINTING ||
+	   event.OldOwner != "durhone" || event.NewOwner != "durhone" || event.OldCustodian != "durhone" || event.NewCustodian != "printer" ||
+	   event.TxID != l.stub.GetTxID() {
+		t.Errorf("unexpected event %s %+v", l.stub.event_name, event)
+	}
+
+	if _, err := l.invoke("durhone", "update_test", "Passed", "AB1234567"); err == nil { t.Fatal("expected update to fail") }
+
+	result, err := l.query("printer", "get_chocolate_history", "AB1234567")
+	if err != nil { t.Fatal(err) }
+
+	var history []History_Entry
+	if err := json.Unmarshal(result, &history); err != nil { t.Fatal(err) }
+
+	functions := []string{ "create_chocolates", "update_ingredients", "update_contributers", "concepting_to_printing" }
+
+	if len(history) != len(functions) { t.Fatalf("got %d history entries, want %d", len(history), len(functions)) }
+
+	for i, entry := range history {
+		if entry.Function != functions[i] { t.Errorf("entry %d function = %s, want %s", i, entry.Function, functions[i]) }
+	}
+
+	transfer := history[3]
+
+	if transfer.Caller != "durhone" || transfer.Affiliation != DU_RHONE || len(transfer.Changes) != 3 ||
+	   transfer.Changes[0].Field != "custodian" || transfer.Changes[1].Field != "custodianRole" || transfer.Changes[2].Field != "status" {
+		t.Errorf("unexpected transfer entry %+v", transfer)
+	}
+
+	if _, err := l.query("supplier", "get_chocolate_history", "AB1234567"); err == nil { t.Error("expected history query by supplier to fail") }
+}
+
+func TestMigrateChocoIDs(t *testing.T) {
+
+	l := new_test_ledger(t)
+	l.advance("AA0000001", STATE_CONCEPTING)
+	l.advance("AA0000002", STATE_PRINTING)
+
+	for key := range l.stub.state {											// Take the ledger back to how earlier versions left it
+		if strings.HasPrefix(key, KEY_SEPARATOR) { delete(l.stub.state, key) }
+	}
+	l.stub.state["chocoIDs"] = []byte(`{"chocoIDs":["AA0000001","AA0000002"]}`)
+
+	if _, err := l.invoke("printer", "migrate_chocoIDs"); err == nil { t.Fatal("expected migrate by printer to fail") }
+
+	if remaining := string(l.must_invoke("durhone", "migrate_chocoIDs", "1")); remaining != "1" { t.Errorf("remaining = %s, want 1", remaining) }
+	if remaining := string(l.must_invoke("durhone", "migrate_chocoIDs"));      remaining != "0" { t.Errorf("remaining = %s, want 0", remaining) }
+
+	if _, ok := l.stub.state["chocoIDs"]; ok { t.Error("chocoIDs not removed") }
+
+	result, err := l.query("printer", "get_chocos_by", "custodian", "printer")
+	if err != nil || !strings.Contains(string(result), "AA0000002") { t.Errorf("migrated index not queryable: %s %v", result, err) }
+}
+
+func TestLegacyOwnership(t *testing.T) {
+
+	const baseline_record = `{"chocolatier":"Du Rhone-IBM","establishDate":"UNDEFINED","ID":"AB1234567","contributers":["Chef Watson"],"owner":2,"delivered":false,"status":1}`
+
+	tests := []struct {
+		name		string
+		record		string
+		ok			bool
+		owner		string
+		role		int
+		custodian	string
+	}{
+		{ "owner saved as a participant type",	baseline_record,														true,	"UNDEFINED",	PRINTER,	"UNDEFINED" },
+		{ "owner saved before custody",			`{"ID":"AB1234567","owner":"printer","ownerRole":2,"status":1}`,		true,	"printer",		PRINTER,	"printer" },
+		{ "owner not recorded",					`{"ID":"AB1234567","status":1}`,										true,	"",				0,			"" },
+		{ "owner unreadable",					`{"ID":"AB1234567","owner":{"name":"printer"},"status":1}`,			false,	"",				0,			"" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			l := new_test_ledger(t)
+			l.stub.state["AB1234567"] = []byte(test.record)
+
+			c, err := l.cc.retrieve_chocoID(l.stub, "AB1234567")
+
+			if test.ok != (err == nil) { t.Fatalf("expected ok=%v, got %v", test.ok, err) }
+			if !test.ok { return }
+
+			if c.ChocoID != "AB1234567" || c.Status != STATE_PRINTING || c.Owner != test.owner || c.OwnerRole != test.role || c.Custodian != test.custodian {
+				t.Errorf("unexpected record %+v", c)
+			}
+		})
+	}
+
+	t.Run("migrate_chocoIDs", func(t *testing.T) {
+
+		l := new_test_ledger(t)
+		l.stub.state["AB1234567"] = []byte(baseline_record)
+		l.stub.state["chocoIDs"]  = []byte(`{"chocoIDs":["AB1234567"]}`)
+
+		if remaining := string(l.must_invoke("durhone", "migrate_chocoIDs")); remaining != "0" { t.Errorf("remaining = %s, want 0", remaining) }
+
+		result, err := l.query("durhone", "get_chocos_by", "status", strconv.Itoa(STATE_PRINTING))
+		if err != nil || !strings.Contains(string(result), "AB1234567") { t.Errorf("migrated baseline record not queryable: %s %v", result, err) }
+	})
+}